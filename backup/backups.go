@@ -13,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime/debug"
+	"sync"
 	"time"
 )
 
@@ -22,6 +23,9 @@ type Backups struct {
 	lastBkDay int
 	hourList  []int
 	buckets   *BucketsDb
+
+	hourLock sync.Mutex // hourList changes on a config reload
+	runLock  sync.Mutex // one backup at a time, scheduled or from the admin socket
 }
 
 var BackupsInstance *Backups
@@ -34,6 +38,8 @@ func BackupsInit(buckets *BucketsDb) {
 	BackupsInstance.lastBkHr = -1
 	BackupsInstance.bkfolder = EnvironmentInstance.GetEnv("BK_PATH", "")
 	BackupsInstance.hourList = EnvironmentInstance.GetIntArray("BK_HOURS")
+	AddReloadHook(BackupsInstance.reload)
+	SetBackupRunner(BackupsInstance.backupNow)
 
 	path, err := filepath.Abs(BackupsInstance.bkfolder)
 	if err != nil {
@@ -48,6 +54,20 @@ func BackupsInit(buckets *BucketsDb) {
 	}
 }
 
+// reload - BK_HOURS, the other settings are read for each backup
+func (b *Backups) reload() {
+	hours := EnvironmentInstance.GetIntArray("BK_HOURS")
+	b.hourLock.Lock()
+	defer b.hourLock.Unlock()
+	b.hourList = hours
+}
+
+func (b *Backups) hours() []int {
+	b.hourLock.Lock()
+	defer b.hourLock.Unlock()
+	return b.hourList
+}
+
 func (b *Backups) Run() {
 	for {
 		time.Sleep(15 * time.Second)
@@ -69,9 +89,10 @@ func (b *Backups) createBackup(name common.BucketName, db *badger.DB) {
 	suffixHour := EnvironmentInstance.GetBoolEnv("BK_SUFFIX_HOUR")
 	bkZip := EnvironmentInstance.GetBoolEnv("BK_ZIP")
 
-	StatsInstance.Backups[name].LastStart = time.Now()
-	StatsInstance.Backups[name].Status = "running"
-	StatsInstance.Backups[name].LastMessage = "Creating backup"
+	bstat := StatsInstance.Backup(name)
+	bstat.LastStart = time.Now()
+	bstat.Status = "running"
+	bstat.LastMessage = "Creating backup"
 
 	// log.Printf("Backup started: %s\n", name)
 	origBfname := CreateBackupFilename(name, suffixDay, suffixHour)
@@ -83,9 +104,9 @@ func (b *Backups) createBackup(name common.BucketName, db *badger.DB) {
 	destFilename := path.Join(b.bkfolder, bfname)
 	f, err := os.Create(destFilename)
 	if err != nil {
-		StatsInstance.Backups[name].LastEnd = time.Now()
-		StatsInstance.Backups[name].Status = "failed"
-		StatsInstance.Backups[name].LastMessage = "error creating backup: " + err.Error()
+		bstat.LastEnd = time.Now()
+		bstat.Status = "failed"
+		bstat.LastMessage = "error creating backup: " + err.Error()
 		return
 	}
 
@@ -101,8 +122,8 @@ func (b *Backups) createBackup(name common.BucketName, db *badger.DB) {
 	//	wz = zip.NewWriter(f)
 	//	w, err = wz.Create(origBfname)
 	//	if err != nil {
-	//		StatsInstance.Backups[name].Status = "failed"
-	//		StatsInstance.Backups[name].LastMessage = "error creating zip file: " + err.Error()
+	//		bstat.Status = "failed"
+	//		bstat.LastMessage = "error creating zip file: " + err.Error()
 	//		return
 	//	}
 	//} else {
@@ -117,18 +138,18 @@ func (b *Backups) createBackup(name common.BucketName, db *badger.DB) {
 	stream.NumGo = bkgonum // Default is 16 -- reduce memory usage
 	_, err = stream.Backup(w, 0)
 
-	StatsInstance.Backups[name].LastEnd = time.Now()
+	bstat.LastEnd = time.Now()
 
 	failed := false
 	if err != nil {
-		StatsInstance.Backups[name].Status = "failed"
-		StatsInstance.Backups[name].LastMessage = "error creating backup: " + err.Error()
+		bstat.Status = "failed"
+		bstat.LastMessage = "error creating backup: " + err.Error()
 		failed = true
 		return
 	} else {
 		if bkZip {
-			// StatsInstance.Backups[name].Status = "completed"
-			StatsInstance.Backups[name].LastMessage = "Zipping file"
+			// bstat.Status = "completed"
+			bstat.LastMessage = "Zipping file"
 		}
 	}
 	//if wz != nil {
@@ -149,16 +170,17 @@ func (b *Backups) createBackup(name common.BucketName, db *badger.DB) {
 		_, err := cmdStruct.Output()
 		if err != nil {
 			// fmt.Println(err)
-			StatsInstance.Backups[name].Status = "gzip failed."
-			StatsInstance.Backups[name].LastMessage = "error zipping: " + err.Error() + " > " + destFilenameZip
+			bstat.Status = "gzip failed."
+			bstat.LastMessage = "error zipping: " + err.Error() + " > " + destFilenameZip
 			failed = true
 		} else {
-			StatsInstance.Backups[name].Status = "completed"
-			StatsInstance.Backups[name].LastMessage = ""
+			bstat.Status = "completed"
+			bstat.LastMessage = ""
 		}
 	}
 
 	if !failed {
+		bstat.LastSuccess = time.Now()
 		if bkZip {
 			go ScpEnvInstance.AddScpJob(name, destFilenameZip)
 		} else {
@@ -184,7 +206,7 @@ func (b *Backups) runBk() {
 	//bug: if one hour in list it will only run once.
 	// need to add day
 	if time.Now().Hour() != b.lastBkHr || time.Now().Day() != b.lastBkDay {
-		for _, h := range b.hourList {
+		for _, h := range b.hours() {
 			if h == time.Now().Hour() && time.Now().Day() != b.lastBkDay {
 				runBk = true
 				break
@@ -196,8 +218,38 @@ func (b *Backups) runBk() {
 		b.lastBkDay = time.Now().Day()
 		StatsInstance.LastBKStart = time.Now()
 
-		for name, db := range BucketsInstance.DbBucket {
-			b.createBackup(name, db)
+		b.backupBuckets(BucketsInstance.OpenBuckets())
+	}
+}
+
+func (b *Backups) backupBuckets(dbs map[common.BucketName]*badger.DB) {
+	b.runLock.Lock()
+	defer b.runLock.Unlock()
+	for name, db := range dbs {
+		b.createBackup(name, db)
+	}
+}
+
+// backupNow - starts the backup of the bucket, all the open buckets if empty
+func (b *Backups) backupNow(bucket common.BucketName) error {
+	dbs := BucketsInstance.OpenBuckets()
+	if len(bucket) > 0 {
+		db, ok := dbs[bucket]
+		if !ok {
+			return fmt.Errorf("bucket not found: %s", bucket)
 		}
+		dbs = map[common.BucketName]*badger.DB{bucket: db}
 	}
+
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				fmt.Println("error in backup", rec)
+				fmt.Printf("%s", debug.Stack())
+			}
+		}()
+		StatsInstance.LastBKStart = time.Now()
+		b.backupBuckets(dbs)
+	}()
+	return nil
 }
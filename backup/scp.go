@@ -15,7 +15,8 @@ import (
 	"time"
 )
 
-type ScpEnv struct {
+// scpSettings - the remote, read again on a config reload
+type scpSettings struct {
 	scpHost    string
 	scpDir     string
 	scpUname   string
@@ -24,6 +25,10 @@ type ScpEnv struct {
 	suffixDay  bool
 	suffixHour bool
 	bkZip      bool
+}
+
+type ScpEnv struct {
+	scpSettings
 
 	mutex sync.Mutex
 
@@ -35,27 +40,50 @@ var ScpEnvInstance *ScpEnv
 func ScpInit(b *BucketsDb) {
 	ScpEnvInstance = &ScpEnv{}
 	ScpEnvInstance._init(b)
+	AddReloadHook(ScpEnvInstance.reload)
 	go ScpEnvInstance.SendLoop()
 }
 
+func loadScpSettings() scpSettings {
+	return scpSettings{
+		scpHost:    EnvironmentInstance.GetEnv("BK_SCP_HOST", ""),
+		scpDir:     EnvironmentInstance.GetEnv("BK_SCP_DIR", ""),
+		scpUname:   EnvironmentInstance.GetEnv("BK_SCP_UNAME", ""),
+		scpUpwd:    EnvironmentInstance.GetEnv("BK_SCP_UPWD", ""),
+		scpKeypath: EnvironmentInstance.GetEnv("BK_SCP_PATH_TO_KEY", ""),
+		suffixDay:  EnvironmentInstance.GetBoolEnv("BK_SCP_SUFFIX_DAY"),
+		suffixHour: EnvironmentInstance.GetBoolEnv("BK_SCP_SUFFIX_HOUR"),
+		bkZip:      EnvironmentInstance.GetBoolEnv("BK_ZIP"),
+	}
+}
+
 func (s *ScpEnv) _init(b *BucketsDb) {
-	s.scpHost = EnvironmentInstance.GetEnv("BK_SCP_HOST", "")
-	s.scpDir = EnvironmentInstance.GetEnv("BK_SCP_DIR", "")
-	s.scpUname = EnvironmentInstance.GetEnv("BK_SCP_UNAME", "")
-	s.scpUpwd = EnvironmentInstance.GetEnv("BK_SCP_UPWD", "")
-	s.scpKeypath = EnvironmentInstance.GetEnv("BK_SCP_PATH_TO_KEY", "")
-	s.suffixDay = EnvironmentInstance.GetBoolEnv("BK_SCP_SUFFIX_DAY")
-	s.suffixHour = EnvironmentInstance.GetBoolEnv("BK_SCP_SUFFIX_HOUR")
-	s.bkZip = EnvironmentInstance.GetBoolEnv("BK_ZIP")
+	s.scpSettings = loadScpSettings()
 	s.buckets = b
 }
 
+// reload - the next copies use the new remote
+func (s *ScpEnv) reload() {
+	settings := loadScpSettings()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scpSettings = settings
+}
+
+// settings - a copy of the remote in use
+func (s *ScpEnv) settings() scpSettings {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.scpSettings
+}
+
 func (s *ScpEnv) IsEnabled() bool {
-	if len(s.scpHost) == 0 ||
-		len(s.scpDir) == 0 ||
-		len(s.scpUname) == 0 ||
-		(len(s.scpUpwd) == 0 &&
-			len(s.scpKeypath) == 0) {
+	settings := s.settings()
+	if len(settings.scpHost) == 0 ||
+		len(settings.scpDir) == 0 ||
+		len(settings.scpUname) == 0 ||
+		(len(settings.scpUpwd) == 0 &&
+			len(settings.scpKeypath) == 0) {
 		return false
 	}
 	return true
@@ -152,26 +180,27 @@ func (s *ScpEnv) sendScp(j *common.ScpJob) {
 	j.Status = common.ScpRunning
 	j.LastStart = time.Now()
 
-	scpDestName := CreateBackupFilename(j.BucketName, ScpEnvInstance.suffixDay, ScpEnvInstance.suffixHour)
-	if ScpEnvInstance.bkZip {
+	env := s.settings()
+	scpDestName := CreateBackupFilename(j.BucketName, env.suffixDay, env.suffixHour)
+	if env.bkZip {
 		scpDestName = AddZipToFilename(scpDestName)
 	}
 
 	var sshConf *ssh.ClientConfig
 
-	if len(ScpEnvInstance.scpUpwd) > 0 {
-		// log.Printf("scp using name/password %s. %s", ScpEnvInstance.scpUname, strings.Repeat("x", len(ScpEnvInstance.scpUpwd)))
-		sshConf = scp.NewSSHConfigFromPassword(ScpEnvInstance.scpUname, ScpEnvInstance.scpUpwd)
+	if len(env.scpUpwd) > 0 {
+		// log.Printf("scp using name/password %s. %s", env.scpUname, strings.Repeat("x", len(env.scpUpwd)))
+		sshConf = scp.NewSSHConfigFromPassword(env.scpUname, env.scpUpwd)
 	} else {
 		// log.Printf("scp using name/private key")
-		privPEM, err := ioutil.ReadFile(ScpEnvInstance.scpKeypath)
+		privPEM, err := ioutil.ReadFile(env.scpKeypath)
 		if err != nil {
 			j.Message = fmt.Sprintf("error creating scp config read private key %s", err.Error())
 			j.Status = common.ScpError
 			j.NextSend = time.Now().Add(5 * time.Minute)
 			return
 		}
-		sshConf, err = scp.NewSSHConfigFromPrivateKey(ScpEnvInstance.scpUname, privPEM)
+		sshConf, err = scp.NewSSHConfigFromPrivateKey(env.scpUname, privPEM)
 		if err != nil {
 			j.Message = fmt.Sprintf("error creating scp config with private key %s", err.Error())
 			j.Status = common.ScpError
@@ -180,7 +209,7 @@ func (s *ScpEnv) sendScp(j *common.ScpJob) {
 		}
 
 	}
-	scpClient, err := scp.NewClient(ScpEnvInstance.scpHost, sshConf, &scp.ClientOption{})
+	scpClient, err := scp.NewClient(env.scpHost, sshConf, &scp.ClientOption{})
 	if err != nil {
 		j.Message = fmt.Sprintf("error creating scp client %s", err.Error())
 		j.Status = common.ScpError
@@ -194,8 +223,8 @@ func (s *ScpEnv) sendScp(j *common.ScpJob) {
 		Timeout:      0,
 		PreserveProp: true,
 	}
-	destFile := path.Join(ScpEnvInstance.scpDir, scpDestName)
-	// log.Printf("Scp %s:%s -> %s", ScpEnvInstance.scpHost, j.Fname, destFile)
+	destFile := path.Join(env.scpDir, scpDestName)
+	// log.Printf("Scp %s:%s -> %s", env.scpHost, j.Fname, destFile)
 	err = scpClient.CopyFileToRemote(j.Fname, destFile, transferOptions)
 	if err != nil {
 		log.Printf("error sending file:%s, %s", j.Fname, err)
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/samlotti/relKV/common"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ListBuckets - the open buckets the token has access to
+func (c *Client) ListBuckets(ctx context.Context) ([]*common.BucketData, error) {
+	buckets := make([]*common.BucketData, 0)
+	if err := c.callJSON(ctx, http.MethodGet, "/", nil, nil, &buckets); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// CreateBucket - creates or opens the bucket, the server requires ALLOW_CREATE_DB.
+// An invalid name is errors.Is ErrBadBucket.
+func (c *Client) CreateBucket(ctx context.Context, bucket string) error {
+	resp, err := c.call(ctx, http.MethodPut, "/"+url.PathEscape(bucket), nil, nil, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Status - the status report, also returned when the status is failing
+func (c *Client) Status(ctx context.Context) (*common.StatusReport, error) {
+	h := http.Header{}
+	h.Set(common.HEADER_FORMAT_KEY, "json")
+	// a failing status is returned with 500
+	resp, err := c.call(ctx, http.MethodGet, "/status", h, nil, http.StatusOK, http.StatusInternalServerError)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	status := &common.StatusReport{}
+	if err := json.Unmarshal(data, status); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, &Error{Status: resp.StatusCode, Message: string(data)}
+		}
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,255 @@
+// Package client - a Go client for the relKV http endpoints
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/samlotti/relKV/common"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The errors to check with errors.Is, the details are in *Error
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrBadBucket     = errors.New("bad bucket")
+	ErrDuplicateKey  = errors.New("duplicate key")
+	ErrPrecondition  = errors.New("precondition failed")
+	ErrScanTruncated = errors.New("scan truncated")
+)
+
+// Error - a request rejected by the server
+type Error struct {
+	Status       int    // http status, 0 for the error entry ending a scan
+	Message      string // error_msg of the response
+	Code         string // error_code of the response, ex: bucket_not_found
+	DuplicateKey string // the key already used by another key or alias
+	RetryAfter   time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if len(e.DuplicateKey) > 0 {
+		msg += ", duplicate key: " + e.DuplicateKey
+	}
+	if e.Status == 0 {
+		return msg
+	}
+	return fmt.Sprintf("error %d: %s", e.Status, msg)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrBadBucket:
+		return e.Code == common.ERROR_CODE_BUCKET_NOT_FOUND || e.Code == common.ERROR_CODE_INVALID_BUCKET
+	case ErrDuplicateKey:
+		return len(e.DuplicateKey) > 0
+	case ErrPrecondition:
+		return e.Status == http.StatusPreconditionFailed
+	case ErrScanTruncated:
+		return e.Status == 0 && strings.HasPrefix(e.Message, "scan truncated")
+	}
+	return false
+}
+
+// Client - the requests to a server, safe for concurrent use
+type Client struct {
+	base      string
+	token     string
+	keyName   string // set to sign the requests, the token is then not sent
+	http      *http.Client
+	retries   int
+	retryWait time.Duration
+}
+
+// New - baseURL is http(s)://host:port, token is the SECRET or a token of the ACL_FILE, empty without auth
+func New(baseURL string, token string) *Client {
+	return &Client{
+		base:      strings.TrimSuffix(baseURL, "/"),
+		token:     token,
+		http:      http.DefaultClient,
+		retryWait: 500 * time.Millisecond,
+	}
+}
+
+// SetHTTPClient - for the timeouts or the TLS config
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	c.http = hc
+}
+
+// SetSigning - the requests are signed with the token (AUTH_MODE hmac or both), keyName is the name of the
+// token in the ACL_FILE or secret for the SECRET
+func (c *Client) SetSigning(keyName string) {
+	c.keyName = keyName
+}
+
+// SetRetries - retries a request refused with 429 or 503, 0 = no retry. A request that failed to be sent
+// is retried if the method is idempotent or the connection was never made, a POST may have been run.
+// The wait is multiplied by the attempt, a Retry-After from the server is used instead.
+func (c *Client) SetRetries(retries int, wait time.Duration) {
+	c.retries = retries
+	c.retryWait = wait
+}
+
+// NewRequest - a request to the path of the server, send it with Do
+func (c *Client) NewRequest(ctx context.Context, method string, path string, body []byte) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+}
+
+// Do - adds the authentication and sends the request, with the retries.
+// The response is returned as is, check the status.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	// kept to sign and send again
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		req.Body = http.NoBody
+		if len(body) > 0 {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		c.authenticate(req, body)
+
+		// set when the request could have reached the server
+		var connected int32
+		trace := &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { atomic.StoreInt32(&connected, 1) }}
+		resp, err := c.http.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if attempt >= c.retries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		wait := c.retryWait * time.Duration(attempt+1)
+		if err != nil && !isIdempotent(req.Method) && atomic.LoadInt32(&connected) == 1 {
+			return resp, err
+		}
+		if err == nil {
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+				return resp, nil
+			}
+			if secs, err := strconv.Atoi(resp.Header.Get(common.RESP_HEADER_RETRY_AFTER)); err == nil {
+				wait = time.Duration(secs) * time.Second
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// isIdempotent - the request can be sent again without changing the result
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// authenticate - the token header, or the signature with a new nonce for each attempt
+func (c *Client) authenticate(req *http.Request, body []byte) {
+	if len(c.token) == 0 {
+		return
+	}
+	if len(c.keyName) == 0 {
+		req.Header.Set("tkn", c.token)
+		return
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	nonce := hex.EncodeToString(buf)
+	ts := time.Now().Unix()
+	req.Header.Set(common.HEADER_SIGN_KEY, c.keyName)
+	req.Header.Set(common.HEADER_SIGN_TS, strconv.FormatInt(ts, 10))
+	req.Header.Set(common.HEADER_SIGN_NONCE, nonce)
+	req.Header.Set(common.HEADER_SIGN_SIG, common.SignRequest(c.token, req.Method, req.URL.RequestURI(), ts, nonce, body))
+}
+
+// call - sends the request, a status not in okStatus is returned as *Error.
+// The caller closes the body of the response.
+func (c *Client) call(ctx context.Context, method string, path string, headers http.Header, body []byte, okStatus ...int) (*http.Response, error) {
+	req, err := c.NewRequest(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, vals := range headers {
+		req.Header[key] = vals
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range okStatus {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+// responseError - the error of a failed request, reads the body
+func responseError(resp *http.Response) *Error {
+	e := &Error{
+		Status:       resp.StatusCode,
+		Message:      resp.Header.Get(common.RESP_HEADER_ERROR_MSG),
+		Code:         resp.Header.Get(common.RESP_HEADER_ERROR_CODE),
+		DuplicateKey: resp.Header.Get(common.RESP_HEADER_DUPLICATE_ERROR),
+	}
+	if len(e.Message) == 0 {
+		data, _ := io.ReadAll(resp.Body)
+		e.Message = strings.TrimSpace(string(data))
+	}
+	if len(e.Message) == 0 {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get(common.RESP_HEADER_RETRY_AFTER)); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// callJSON - decodes the body of a 200 response into v
+func (c *Client) callJSON(ctx context.Context, method string, path string, headers http.Header, body []byte, v interface{}) error {
+	resp, err := c.call(ctx, method, path, headers, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// keyPath - the key is escaped, it can have ? # or %
+func keyPath(bucket string, key string) string {
+	return "/" + url.PathEscape(bucket) + "/" + url.PathEscape(key)
+}
+
+// parseETag - the version of the ETag header, 0 if missing
+func parseETag(etag string) uint64 {
+	version, _ := strconv.ParseUint(strings.Trim(strings.TrimPrefix(etag, "W/"), `"`), 10, 64)
+	return version
+}
@@ -0,0 +1,283 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/samlotti/relKV/common"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Item - a key read with Get
+type Item struct {
+	Key     string
+	Value   []byte
+	TTL     int64  // seconds remaining, 0 = does not expire
+	Version uint64 // the ETag, for an alias the version of its key
+	Aliases []string
+}
+
+// SetOptions - nil for a plain write
+type SetOptions struct {
+	Aliases     []string // nil keeps the aliases of the key, otherwise the full list, empty removes them
+	TTL         int64    // seconds until the key expires, 0 = never
+	IfMatch     uint64   // only write if the key is at this version, 0 = no check
+	IfNoneMatch bool     // only create the key
+}
+
+// DeleteOptions - nil for a plain delete
+type DeleteOptions struct {
+	Aliases []string // additional aliases, only needed for keys written before the aliases were recorded
+	IfMatch uint64   // only delete if the key is at this version, 0 = no check
+}
+
+// SearchOptions - the selection of the keys, nil for all
+type SearchOptions struct {
+	Prefix         string
+	Segments       []string
+	Start          string // inclusive unless StartExclusive
+	End            string // exclusive unless EndInclusive
+	StartExclusive bool
+	EndInclusive   bool
+	Reverse        bool
+	Skip           int
+	Max            int    // 0 = all, the cursor is returned when reached
+	Cursor         string // continue a previous search
+	Values         bool
+	B64            bool // values as base64
+	WithAliases    bool // the aliases of each key and the key of each alias
+	Timeout        int  // seconds, 0 = the default of the server
+}
+
+func (o *SearchOptions) headers() http.Header {
+	h := http.Header{}
+	if o == nil {
+		return h
+	}
+	set := func(key string, val string) {
+		if len(val) > 0 {
+			h.Set(key, val)
+		}
+	}
+	flag := func(key string, on bool) {
+		if on {
+			h.Set(key, "1")
+		}
+	}
+	number := func(key string, n int) {
+		if n > 0 {
+			h.Set(key, strconv.Itoa(n))
+		}
+	}
+	set(common.HEADER_PREFIX_KEY, o.Prefix)
+	set(common.HEADER_SEGMENT_KEY, strings.Join(o.Segments, common.HEADER_SEGMENT_SEPARATOR))
+	set(common.HEADER_START_KEY, o.Start)
+	set(common.HEADER_END_KEY, o.End)
+	set(common.HEADER_CURSOR_KEY, o.Cursor)
+	flag(common.HEADER_START_EXCLUSIVE_KEY, o.StartExclusive)
+	flag(common.HEADER_END_INCLUSIVE_KEY, o.EndInclusive)
+	flag(common.HEADER_REVERSE_KEY, o.Reverse)
+	flag(common.HEADER_VALUES_KEY, o.Values)
+	flag(common.HEADER_B64_KEY, o.B64)
+	flag(common.HEADER_WITH_ALIASES_KEY, o.WithAliases)
+	number(common.HEADER_SKIP_KEY, o.Skip)
+	number(common.HEADER_MAX_KEY, o.Max)
+	number(common.HEADER_TIMEOUT_KEY, o.Timeout)
+	return h
+}
+
+// Set - writes the key, returns its new version.
+// A duplicate alias returns an *Error with the DuplicateKey, errors.Is ErrDuplicateKey.
+func (c *Client) Set(ctx context.Context, bucket string, key string, value []byte, opts *SetOptions) (uint64, error) {
+	h := http.Header{}
+	if opts != nil {
+		if opts.Aliases != nil {
+			h.Set(common.HEADER_ALIAS_KEY, strings.Join(opts.Aliases, common.HEADER_ALIAS_SEPARATOR))
+		}
+		if opts.TTL > 0 {
+			h.Set(common.HEADER_TTL_KEY, strconv.FormatInt(opts.TTL, 10))
+		}
+		if opts.IfMatch > 0 {
+			h.Set(common.HEADER_IF_MATCH, fmt.Sprintf(`"%d"`, opts.IfMatch))
+		}
+		if opts.IfNoneMatch {
+			h.Set(common.HEADER_IF_NONE_MATCH, "*")
+		}
+	}
+	resp, err := c.call(ctx, http.MethodPost, keyPath(bucket, key), h, value, http.StatusCreated)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return parseETag(resp.Header.Get(common.RESP_HEADER_ETAG)), nil
+}
+
+// Get - the key or an alias, errors.Is ErrNotFound if missing
+func (c *Client) Get(ctx context.Context, bucket string, key string) (*Item, error) {
+	resp, err := c.call(ctx, http.MethodGet, keyPath(bucket, key), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	item := &Item{Key: key, Version: parseETag(resp.Header.Get(common.RESP_HEADER_ETAG))}
+	item.TTL, _ = strconv.ParseInt(resp.Header.Get(common.RESP_HEADER_TTL), 10, 64)
+	if aliases := resp.Header.Get(common.RESP_HEADER_ALIASES); len(aliases) > 0 {
+		item.Aliases = strings.Split(aliases, common.HEADER_ALIAS_SEPARATOR)
+	}
+	if item.Value, err = io.ReadAll(resp.Body); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Delete - the key and its aliases, returns the number of entries deleted
+func (c *Client) Delete(ctx context.Context, bucket string, key string, opts *DeleteOptions) (int, error) {
+	h := http.Header{}
+	if opts != nil {
+		if len(opts.Aliases) > 0 {
+			h.Set(common.HEADER_ALIAS_KEY, strings.Join(opts.Aliases, common.HEADER_ALIAS_SEPARATOR))
+		}
+		if opts.IfMatch > 0 {
+			h.Set(common.HEADER_IF_MATCH, fmt.Sprintf(`"%d"`, opts.IfMatch))
+		}
+	}
+	resp, err := c.call(ctx, http.MethodDelete, keyPath(bucket, key), h, nil, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	deleted, _ := strconv.Atoi(resp.Header.Get("rec_deleted"))
+	return deleted, nil
+}
+
+// SearchEach - calls fn for each key as it is read, the search stops if fn returns an error.
+// The cursor is returned when Max was reached or the scan was truncated, errors.Is ErrScanTruncated.
+func (c *Client) SearchEach(ctx context.Context, bucket string, opts *SearchOptions, fn func(kv *common.KV) error) (string, error) {
+	resp, err := c.call(ctx, http.MethodGet, "/"+url.PathEscape(bucket), opts.headers(), nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var entryErr error
+	err = decodeEntries(resp.Body, func(kv *common.KV) error {
+		if len(kv.Error) > 0 {
+			entryErr = &Error{Message: kv.Error}
+			return entryErr
+		}
+		return fn(kv)
+	})
+	if err != nil && err != entryErr {
+		return "", err
+	}
+	// the trailer is only read at the end of the body
+	io.Copy(io.Discard, resp.Body)
+	return resp.Trailer.Get(common.RESP_HEADER_CURSOR), entryErr
+}
+
+// Search - the keys of SearchEach in a list
+func (c *Client) Search(ctx context.Context, bucket string, opts *SearchOptions) ([]*common.KV, string, error) {
+	kvs := make([]*common.KV, 0)
+	cursor, err := c.SearchEach(ctx, bucket, opts, func(kv *common.KV) error {
+		kvs = append(kvs, kv)
+		return nil
+	})
+	return kvs, cursor, err
+}
+
+// GetKeys - the keys in the order requested, a missing key has its Error set.
+// b64 returns the values as base64.
+func (c *Client) GetKeys(ctx context.Context, bucket string, keys []string, b64 bool) ([]*common.KV, error) {
+	h := http.Header{}
+	if b64 {
+		h.Set(common.HEADER_B64_KEY, "1")
+	}
+	resp, err := c.call(ctx, http.MethodPost, "/get/"+url.PathEscape(bucket), h, []byte(strings.Join(keys, "\n")), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	kvs := make([]*common.KV, 0, len(keys))
+	err = decodeEntries(resp.Body, func(kv *common.KV) error {
+		// the keys not read after a timeout are left out, the last entry has the error
+		if len(kv.Key) == 0 && len(kv.Error) > 0 {
+			return &Error{Message: kv.Error}
+		}
+		kvs = append(kvs, kv)
+		return nil
+	})
+	return kvs, err
+}
+
+// Batch - the operations in a single transaction, if one fails nothing is written.
+// The results are returned with the *Error of a failed batch.
+func (c *Client) Batch(ctx context.Context, bucket string, ops []*common.BatchOp, b64 bool) ([]*common.BatchResult, error) {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	h := http.Header{}
+	if b64 {
+		h.Set(common.HEADER_B64_KEY, "1")
+	}
+	req, err := c.NewRequest(ctx, http.MethodPost, "/api/batch/"+url.PathEscape(bucket), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = h
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var results []*common.BatchResult
+	if json.Unmarshal(data, &results) != nil {
+		results = nil
+	}
+	if resp.StatusCode < 300 {
+		return results, nil
+	}
+
+	e := &Error{Status: resp.StatusCode, Message: resp.Header.Get(common.RESP_HEADER_ERROR_MSG), Code: resp.Header.Get(common.RESP_HEADER_ERROR_CODE)}
+	for _, result := range results {
+		if result.Status >= 300 && result.Status != http.StatusFailedDependency {
+			e.Status = result.Status
+			e.Message = fmt.Sprintf("key %s: %s", result.Key, result.Error)
+			e.DuplicateKey = result.DuplicateKey
+			break
+		}
+	}
+	if len(e.Message) == 0 {
+		e.Message = strings.TrimSpace(string(data))
+	}
+	return results, e
+}
+
+// decodeEntries - the json list of a search or get keys, read as it arrives
+func decodeEntries(rd io.Reader, fn func(kv *common.KV) error) error {
+	dec := json.NewDecoder(rd)
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		kv := &common.KV{}
+		if err := dec.Decode(kv); err != nil {
+			return err
+		}
+		if err := fn(kv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
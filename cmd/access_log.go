@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLogger - writes one json line per request, out is nil when ACCESS_LOG is not set
+type accessLogger struct {
+	lock sync.Mutex
+	out  io.Writer
+	file *os.File
+}
+
+// accessEntry - a line of the access log, filled in while the request is handled
+type accessEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	Remote    string  `json:"remote"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Route     string  `json:"route,omitempty"`
+	Bucket    string  `json:"bucket,omitempty"`
+	Key       string  `json:"key,omitempty"`
+	User      string  `json:"user,omitempty"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	BytesIn   int64   `json:"bytes_in"`
+	Bytes     int64   `json:"bytes"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type accessEntryKey struct{}
+
+// newAccessLogger - ACCESS_LOG is stdout, stderr or a file name, empty = no access log
+func newAccessLogger(dest string) (*accessLogger, error) {
+	l := &accessLogger{}
+	switch dest {
+	case "":
+	case "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("error opening ACCESS_LOG: %w", err)
+		}
+		l.out = f
+		l.file = f
+	}
+	return l, nil
+}
+
+func (l *accessLogger) Close() {
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+func (l *accessLogger) write(entry *accessEntry) {
+	if l.out == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+// validRequestID - a propagated id is kept if it is short and printable
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Handler - wraps the router, sets X-Request-ID and logs every request including the ones not routed
+func (l *accessLogger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(HEADER_REQUEST_ID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(HEADER_REQUEST_ID, id)
+
+		entry := &accessEntry{
+			RequestID: id,
+			Remote:    r.RemoteAddr,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			BytesIn:   r.ContentLength,
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		entry.Time = start.UTC().Format(time.RFC3339Nano)
+		entry.Status = sw.code
+		entry.Bytes = sw.bytes
+		entry.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		entry.Error = w.Header().Get(RESP_HEADER_ERROR_MSG)
+		l.write(entry)
+	})
+}
+
+// routeMiddleware - adds the route, bucket and key once the route is matched
+func (l *accessLogger) routeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if entry := getAccessEntry(r); entry != nil {
+			if route := mux.CurrentRoute(r); route != nil {
+				entry.Route = route.GetName()
+			}
+			vars := mux.Vars(r)
+			entry.Bucket = vars["bucket"]
+			entry.Key = vars["key"]
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getAccessEntry(r *http.Request) *accessEntry {
+	entry, _ := r.Context().Value(accessEntryKey{}).(*accessEntry)
+	return entry
+}
+
+// setAccessUser - the name of the token used, set by the auth middleware
+func setAccessUser(r *http.Request, user string) {
+	if entry := getAccessEntry(r); entry != nil {
+		entry.User = user
+	}
+}
+
+// requestID - the X-Request-ID of the request, for the error logs
+func requestID(r *http.Request) string {
+	if entry := getAccessEntry(r); entry != nil {
+		return entry.RequestID
+	}
+	return "-"
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/samlotti/relKV/common"
+	"os"
+	"path"
+	"strings"
+)
+
+// Access rights granted on buckets
+const (
+	rightRead   = 'r' // search, get, count, watch
+	rightWrite  = 'w' // set, batch
+	rightDelete = 'd' // delete keys, batch deletes
+	rightAdmin  = 'a' // create bucket, admin endpoints
+)
+
+// routeRights - the right needed for each named route, a route not listed is only allowed with SECRET
+var routeRights = map[string]byte{
+	"createBucket": rightAdmin,
+	"listBuckets":  rightRead,
+	"searchKeys":   rightRead,
+	"deleteKeys":   rightDelete,
+	"orphans":      rightAdmin,
+	"audit":        rightAdmin,
+	"getKeys":      rightRead,
+	"batchWrite":   rightWrite,
+	"watch":        rightRead,
+	"countKeys":    rightRead,
+	"setKey":       rightWrite,
+	"getKey":       rightRead,
+	"delKey":       rightDelete,
+}
+
+// aclGrant - rights on the buckets matching the glob, eg "ctl_*"
+type aclGrant struct {
+	Buckets string `json:"buckets"`
+	Rights  string `json:"rights"` // any of r, w, d, a
+}
+
+// aclToken - a token and what it is allowed to do
+type aclToken struct {
+	Name   string      `json:"name"`
+	Token  string      `json:"token"`
+	Grants []*aclGrant `json:"grants"`
+
+	hash [32]byte
+}
+
+type aclConfig struct {
+	Tokens []*aclToken `json:"tokens"`
+}
+
+// loadACL - reads the token configuration from the json file
+//
+//	{ "tokens": [
+//	    { "name": "reporting", "token": "...", "grants": [ { "buckets": "ctl_*", "rights": "r" } ] }
+//	] }
+func loadACL(file string) ([]*aclToken, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ACL_FILE: %w", err)
+	}
+
+	config := &aclConfig{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("error reading ACL_FILE: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for _, token := range config.Tokens {
+		if len(token.Name) == 0 || names[token.Name] || token.Name == SIGN_SECRET_KEY {
+			return nil, fmt.Errorf("ACL_FILE: each token needs a unique name, found: '%s'", token.Name)
+		}
+		names[token.Name] = true
+
+		if len(token.Token) < 16 {
+			return nil, fmt.Errorf("ACL_FILE: token %s is too short, at least 16 characters", token.Name)
+		}
+		if err = validateGrants(token.Grants); err != nil {
+			return nil, fmt.Errorf("ACL_FILE: token %s %w", token.Name, err)
+		}
+		token.hash = sha256.Sum256([]byte(token.Token))
+	}
+	return config.Tokens, nil
+}
+
+// validateGrants - the bucket patterns and rights must be valid
+func validateGrants(grants []*aclGrant) error {
+	for _, grant := range grants {
+		if grant == nil {
+			return errors.New("has an empty grant")
+		}
+		if _, err := path.Match(grant.Buckets, ""); err != nil || len(grant.Buckets) == 0 {
+			return fmt.Errorf("has an invalid bucket pattern: '%s'", grant.Buckets)
+		}
+		for _, right := range grant.Rights {
+			if !strings.ContainsRune("rwda", right) {
+				return fmt.Errorf("has an invalid right: '%c'", right)
+			}
+		}
+	}
+	return nil
+}
+
+// allows - true if a grant for the bucket has the right.
+func (t *aclToken) allows(bucket string, right byte) bool {
+	for _, grant := range t.Grants {
+		if matched, _ := path.Match(grant.Buckets, bucket); !matched {
+			continue
+		}
+		if strings.IndexByte(grant.Rights, right) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAny - true if the token has any right on the bucket
+func (t *aclToken) allowsAny(bucket string) bool {
+	for _, grant := range t.Grants {
+		if matched, _ := path.Match(grant.Buckets, bucket); matched && len(grant.Rights) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	. "github.com/samlotti/relKV/common"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reload trigger of the reload command
+const reloadTriggerAdmin = "admin"
+
+// maxAdminLine - longest command accepted
+const maxAdminLine = 64 * 1024
+
+// adminHelp - the commands and their arguments
+var adminHelp = []string{
+	ADMIN_CMD_STATUS + " <- the status report",
+	ADMIN_CMD_BUCKETS + " <- the buckets, open or not",
+	ADMIN_CMD_CREATE + " {bucket} <- create or open the bucket",
+	ADMIN_CMD_CLOSE + " {bucket} <- close the bucket, requests to it fail until opened again",
+	ADMIN_CMD_BACKUP + " [bucket] <- start a backup of the bucket, all the open buckets if not given",
+	ADMIN_CMD_GC + " [bucket] <- a value log gc cycle",
+	ADMIN_CMD_FLATTEN + " {bucket} [workers] <- compact the LSM tree to a single level",
+	ADMIN_CMD_LOGLEVEL + " {DEBUG|INFO|WARNING|ERROR}",
+	ADMIN_CMD_RELOAD + " <- reload the config",
+	ADMIN_CMD_STOP + " <- stop the server",
+	ADMIN_CMD_QUIT + " <- end the connection",
+}
+
+var backupRunnerLock sync.Mutex
+var backupRunner func(bucket BucketName) error
+
+// SetBackupRunner - set by the backup package when backups are enabled, starts a backup
+// of the bucket or all the open buckets if empty.
+func SetBackupRunner(fn func(bucket BucketName) error) {
+	backupRunnerLock.Lock()
+	defer backupRunnerLock.Unlock()
+	backupRunner = fn
+}
+
+// adminError - a failed command with the code of the reply
+type adminError struct {
+	code int
+	msg  string
+}
+
+func (e *adminError) Error() string {
+	return e.msg
+}
+
+func adminErrorf(code int, f string, v ...interface{}) error {
+	return &adminError{code: code, msg: fmt.Sprintf(f, v...)}
+}
+
+func ProcessUnixCommands() {
+	unixSocket := EnvironmentInstance.GetEnv("CMD_UNIX_SOCKET", "")
+	if len(unixSocket) == 0 {
+		log.Println("No socket support, CMD_UNIX_SOCKET not specified")
+		return
+	}
+
+	_, err := os.Stat(unixSocket)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		// log.Fatal("sock file exists: ", unixSocket)
+		os.Remove(unixSocket)
+	}
+
+	l, err := net.Listen("unix", unixSocket)
+	if err != nil {
+		log.Fatal("cannot open:", unixSocket, " err: ", err)
+	}
+
+	for {
+		fd, err := l.Accept()
+		if err != nil {
+			BucketsInstance.logger.Errorf("accept error on unix socket: %s", err)
+			continue
+		}
+		go handleCommands(fd)
+	}
+}
+
+// handleCommands - reads the commands, one per line, until quit or the client closes the connection
+func handleCommands(fd net.Conn) {
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 1024), maxAdminLine)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == ADMIN_CMD_QUIT {
+			return
+		}
+
+		reply := BucketsInstance.adminCommand(args)
+		data, _ := json.Marshal(reply)
+		if _, err := fd.Write(append(data, '\n')); err != nil {
+			return
+		}
+		// the reply is sent first, the process ends with the server
+		if args[0] == ADMIN_CMD_STOP && reply.Code == http.StatusOK {
+			BucketsInstance.shutDownServer()
+			return
+		}
+	}
+}
+
+// adminCommand - runs the command, args[0] is the name
+func (b *BucketsDb) adminCommand(args []string) *AdminReply {
+	reply := &AdminReply{Command: args[0], Code: http.StatusOK}
+
+	data, err := b.runAdminCommand(args[0], args[1:])
+	if err != nil {
+		reply.Code = http.StatusInternalServerError
+		var aerr *adminError
+		if errors.As(err, &aerr) {
+			reply.Code = aerr.code
+		}
+		reply.Error = err.Error()
+		b.logger.Warningf("admin command %s: %s", strings.Join(args, " "), err)
+		return reply
+	}
+
+	if data != nil {
+		if reply.Data, err = json.Marshal(data); err != nil {
+			reply.Code = http.StatusInternalServerError
+			reply.Error = err.Error()
+		}
+	}
+	return reply
+}
+
+func (b *BucketsDb) runAdminCommand(cmd string, args []string) (interface{}, error) {
+	argCount := map[string][2]int{
+		ADMIN_CMD_HELP: {0, 0}, ADMIN_CMD_STATUS: {0, 0}, ADMIN_CMD_BUCKETS: {0, 0},
+		ADMIN_CMD_CREATE: {1, 1}, ADMIN_CMD_CLOSE: {1, 1}, ADMIN_CMD_BACKUP: {0, 1}, ADMIN_CMD_GC: {0, 1},
+		ADMIN_CMD_FLATTEN: {1, 2}, ADMIN_CMD_LOGLEVEL: {1, 1}, ADMIN_CMD_RELOAD: {0, 0}, ADMIN_CMD_STOP: {0, 0},
+	}
+	count, ok := argCount[cmd]
+	if !ok {
+		return nil, adminErrorf(http.StatusBadRequest, "invalid command: %s, try %s", cmd, ADMIN_CMD_HELP)
+	}
+	if len(args) < count[0] || len(args) > count[1] {
+		return nil, adminErrorf(http.StatusBadRequest, "invalid arguments for %s", cmd)
+	}
+	arg := ""
+	if len(args) > 0 {
+		arg = args[0]
+	}
+
+	switch cmd {
+	case ADMIN_CMD_HELP:
+		return adminHelp, nil
+	case ADMIN_CMD_STATUS:
+		return b.collectStatus(), nil
+	case ADMIN_CMD_BUCKETS:
+		return b.collectStatus().Buckets, nil
+	case ADMIN_CMD_CREATE:
+		return b.adminCreate(arg)
+	case ADMIN_CMD_CLOSE:
+		if err := b.CloseBucket(BucketName(arg)); err != nil {
+			return nil, adminErrorf(http.StatusNotFound, "%s: %s", err, arg)
+		}
+		return "closed " + arg, nil
+	case ADMIN_CMD_BACKUP:
+		return b.adminBackup(arg)
+	case ADMIN_CMD_GC:
+		return b.adminGC(arg)
+	case ADMIN_CMD_FLATTEN:
+		return b.adminFlatten(arg, args[1:])
+	case ADMIN_CMD_LOGLEVEL:
+		if err := checkValue("LOG_LEVEL", "level", arg); err != nil {
+			return nil, adminErrorf(http.StatusBadRequest, "%s", err)
+		}
+		b.logger.SetLevel(convertLogLevel(arg))
+		return "log level " + arg, nil
+	case ADMIN_CMD_RELOAD:
+		status := b.reloadConfig(reloadTriggerAdmin)
+		if !status.Ok {
+			return nil, adminErrorf(http.StatusBadRequest, "%s", status.Error)
+		}
+		return status, nil
+	case ADMIN_CMD_STOP:
+		return "stopping", nil
+	}
+	return nil, adminErrorf(http.StatusBadRequest, "invalid command: %s", cmd)
+}
+
+// adminCreate - like the create bucket request, allowed without ALLOW_CREATE_DB
+func (b *BucketsDb) adminCreate(bucket string) (interface{}, error) {
+	if !validateBucketName(bucket) {
+		return nil, adminErrorf(http.StatusBadRequest, "invalid bucket name: %s", bucket)
+	}
+	if _, err := b.getDB(bucket); err == nil {
+		return "already open " + bucket, nil
+	}
+	if err := b.openBucket(BucketName(bucket)); err != nil {
+		return nil, err
+	}
+	if err := b.auditLog.Write(&AuditEntry{Op: AUDIT_OP_CREATE_BUCKET, Bucket: bucket, User: "admin", Remote: "unix"}); err != nil {
+		b.logger.Errorf("audit log: %s", err)
+	}
+	return "opened " + bucket, nil
+}
+
+func (b *BucketsDb) adminBackup(bucket string) (interface{}, error) {
+	backupRunnerLock.Lock()
+	run := backupRunner
+	backupRunnerLock.Unlock()
+	if run == nil {
+		return nil, adminErrorf(http.StatusConflict, "backups are not enabled")
+	}
+	if err := run(BucketName(bucket)); err != nil {
+		return nil, adminErrorf(http.StatusNotFound, "%s", err)
+	}
+	return "backup started", nil
+}
+
+// adminGC - one cycle on the bucket or on all the open buckets
+func (b *BucketsDb) adminGC(bucket string) (interface{}, error) {
+	dbs := b.OpenBuckets()
+	if len(bucket) > 0 {
+		db, err := b.getDB(bucket)
+		if err != nil {
+			return nil, adminErrorf(http.StatusNotFound, "%s: %s", err, bucket)
+		}
+		dbs = map[BucketName]*badger.DB{BucketName(bucket): db}
+	}
+
+	results := make([]*AdminGC, 0)
+	for _, name := range sortBucketKeys(dbs) {
+		result := &AdminGC{Bucket: string(name)}
+		rewritten, err := b.valueLogGC(name, dbs[name])
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Rewritten = rewritten
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (b *BucketsDb) adminFlatten(bucket string, args []string) (interface{}, error) {
+	db, err := b.getDB(bucket)
+	if err != nil {
+		return nil, adminErrorf(http.StatusNotFound, "%s: %s", err, bucket)
+	}
+	workers := 1
+	if len(args) > 0 {
+		if workers, err = strconv.Atoi(args[0]); err != nil || workers <= 0 {
+			return nil, adminErrorf(http.StatusBadRequest, "invalid workers: %s", args[0])
+		}
+	}
+	if err := db.Flatten(workers); err != nil {
+		return nil, err
+	}
+	return "flattened " + bucket, nil
+}
@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/samlotti/relKV/common"
 	"log"
@@ -61,11 +60,39 @@ func BootServer(version string, readyChannel chan *BucketsDb) {
 	BucketsInstance.Init()
 	StatsInstance.init()
 
+	accessLog, err := newAccessLogger(EnvironmentInstance.GetEnv("ACCESS_LOG", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer accessLog.Close()
+	BucketsInstance.accessLog = accessLog
+
+	BucketsInstance.auditLogPath = EnvironmentInstance.GetEnv("AUDIT_LOG", "")
+	BucketsInstance.auditLog, err = OpenAuditLog(BucketsInstance.auditLogPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer BucketsInstance.auditLog.Close()
+
+	certs, err := newCertReloaderFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	BucketsInstance.certs = certs
+
+	cfg, err := loadRuntimeConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	BucketsInstance.applyConfig(cfg)
+	BucketsInstance.configValues = snapshotConfig()
+
 	BucketsInstance.openDBBuckets()
 
 	defer BucketsInstance.Close()
 
 	go BucketsInstance.runGC()
+	go BucketsInstance.runOrphanSweep()
 
 	//cmd.BackupsInit(BucketsInstance)
 	//go cmd.BackupsInstance.Run()
@@ -74,10 +101,22 @@ func BootServer(version string, readyChannel chan *BucketsDb) {
 
 	srv := http.Server{
 		Addr:              listen,
-		Handler:           BucketsInstance.newHTTPRouter(),
+		Handler:           accessLog.Handler(BucketsInstance.newHTTPRouter()),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	BucketsInstance.serverCtx = serverCtx
+	srv.RegisterOnShutdown(serverCancel)
+
+	if certs != nil {
+		srv.TLSConfig = certs.tlsConfig()
+		log.Printf("TLS enabled, client certificates required: %t", len(certs.caFile) > 0)
+	}
+
+	// SIGHUP reloads the config and the certificates
+	BucketsInstance.watchConfig(serverCtx)
+
 	go func() {
 		BucketsInstance.stopChan = make(chan os.Signal, 1)
 
@@ -97,55 +136,15 @@ func BootServer(version string, readyChannel chan *BucketsDb) {
 	BucketsInstance.ServerState = Running
 	readyChannel <- BucketsInstance
 
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Println(err)
-	}
-
-}
-
-func ProcessUnixCommands() {
-	unixSocket := EnvironmentInstance.GetEnv("CMD_UNIX_SOCKET", "")
-	if len(unixSocket) == 0 {
-		log.Println("No socket support, CMD_UNIX_SOCKET not specified")
-		return
-	}
-
-	_, err := os.Stat(unixSocket)
-	if err == nil || !errors.Is(err, os.ErrNotExist) {
-		// log.Fatal("sock file exists: ", unixSocket)
-		os.Remove(unixSocket)
-	}
-
-	l, err := net.Listen("unix", unixSocket)
-	if err != nil {
-		log.Fatal("cannot open:", unixSocket, " err: ", err)
-	}
-
-	for {
-		fd, err := l.Accept()
-		if err != nil {
-			log.Println("accept error on unix socket:", err)
-			continue
-		}
-		go handleCommands(fd)
-	}
-}
-
-func handleCommands(fd net.Conn) {
-	fmt.Println("unix client connected")
-	buf := make([]byte, 1024)
-	n, err := fd.Read(buf[:])
-	if err != nil {
-		return
+	if certs != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
 	}
-	cmd := string(buf[:n])
-	if cmd == "stop\n" {
-		fmt.Println("Stop called")
-		BucketsInstance.shutDownServer()
-		fd.Write([]byte("stopped\n"))
+	if err != nil && err != http.ErrServerClosed {
+		BucketsInstance.logger.Errorf("http server: %s", err)
 	}
 
-	fd.Close()
 }
 
 // CheckPortAvail if a port is available
@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditMaxDefault - entries returned by a query when max is not given
+const auditMaxDefault = 1000
+
+// AuditLog - append only file of the changes, one json line per entry.
+// A nil AuditLog records nothing, used when AUDIT_LOG is not set.
+type AuditLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// AuditQuery - the entries returned are in the bucket, key starting with the prefix and From <= time < To
+type AuditQuery struct {
+	Bucket string // empty = all
+	Prefix string
+	From   time.Time // zero = no limit
+	To     time.Time // zero = no limit
+	Max    int       // 0 = all
+}
+
+// OpenAuditLog - opens the file for appending, nil if the path is empty
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening AUDIT_LOG: %w", err)
+	}
+	return &AuditLog{file: f}, nil
+}
+
+func (a *AuditLog) Close() {
+	if a != nil {
+		a.file.Close()
+	}
+}
+
+// Write - appends the entry, the time is set if not given
+func (a *AuditLog) Write(entry *AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+// audit - records a change made by the request with the caller, the change is already committed
+func (b *BucketsDb) audit(r *http.Request, entry *AuditEntry) {
+	if b.auditLog == nil {
+		return
+	}
+	if id := getIdentity(r); id != nil {
+		entry.User = id.name
+	}
+	entry.Remote = r.RemoteAddr
+	entry.RequestID = requestID(r)
+	if err := b.auditLog.Write(entry); err != nil {
+		b.logger.Errorf("audit log %s: %s", entry.RequestID, err)
+	}
+}
+
+// describeRange - the selection of a bulk delete for the audit log
+func describeRange(rng *keyRange) string {
+	var parts []string
+	if len(rng.prefix) > 0 {
+		parts = append(parts, HEADER_PREFIX_KEY+"="+string(rng.prefix))
+	}
+	if len(rng.segments) > 0 {
+		parts = append(parts, HEADER_SEGMENT_KEY+"="+strings.Join(rng.segments, HEADER_SEGMENT_SEPARATOR))
+	}
+	if len(rng.start) > 0 {
+		parts = append(parts, HEADER_START_KEY+"="+string(rng.start))
+		if rng.startExclusive {
+			parts = append(parts, HEADER_START_EXCLUSIVE_KEY+"=1")
+		}
+	}
+	if len(rng.end) > 0 {
+		parts = append(parts, HEADER_END_KEY+"="+string(rng.end))
+		if rng.endInclusive {
+			parts = append(parts, HEADER_END_INCLUSIVE_KEY+"=1")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// QueryAudit - reads the audit log file and returns the matching entries, oldest first
+func QueryAudit(path string, q *AuditQuery) ([]*AuditEntry, error) {
+	result := make([]*AuditEntry, 0)
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return result, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// a line cut by a crash
+			continue
+		}
+		if len(q.Bucket) > 0 && entry.Bucket != q.Bucket {
+			continue
+		}
+		if len(q.Prefix) > 0 && !strings.HasPrefix(entry.Key, q.Prefix) {
+			continue
+		}
+		if !q.From.IsZero() && entry.Time.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !entry.Time.Before(q.To) {
+			continue
+		}
+		result = append(result, entry)
+		if q.Max > 0 && len(result) >= q.Max {
+			break
+		}
+	}
+	return result, scanner.Err()
+}
+
+// ParseAuditTime - RFC3339 or unix seconds, empty is the zero time
+func ParseAuditTime(val string) (time.Time, error) {
+	if len(val) == 0 {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s, expected RFC3339 or unix seconds", val)
+	}
+	return t, nil
+}
+
+// auditQuery - the audit entries of the bucket.
+// parameters supported:
+//
+//	prefix <- keys starting with the prefix
+//	from, to <- RFC3339 or unix seconds, from is inclusive and to is exclusive
+//	max <- default 1000
+func (b *BucketsDb) auditQuery(writer http.ResponseWriter, request *http.Request) {
+	bucket := mux.Vars(request)["bucket"]
+
+	if b.auditLog == nil {
+		SendError(writer, "audit log is not enabled, set AUDIT_LOG", http.StatusNotFound)
+		return
+	}
+
+	q := &AuditQuery{
+		Bucket: bucket,
+		Prefix: getHeaderKey(HEADER_PREFIX_KEY, request),
+		Max:    auditMaxDefault,
+	}
+	var err error
+	if q.From, err = ParseAuditTime(getHeaderKey(HEADER_FROM_KEY, request)); err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = ParseAuditTime(getHeaderKey(HEADER_TO_KEY, request)); err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if max := getHeaderKey(HEADER_MAX_KEY, request); len(max) > 0 {
+		if q.Max, err = strconv.Atoi(max); err != nil || q.Max <= 0 {
+			SendError(writer, "invalid max: "+max, http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := QueryAudit(b.auditLogPath, q)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(writer, http.StatusOK, entries)
+}
@@ -1,30 +1,292 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// AUTH_MODE values
+const (
+	authModeToken = "token" // tkn header
+	authModeHMAC  = "hmac"  // signed requests only
+	authModeBoth  = "both"
+)
+
+// maxSignedBody - largest body read to check the signature
+const maxSignedBody = 64 << 20
+
 type AuthSecret struct {
 	secret string
+	tokens []*aclToken // from ACL_FILE
+
+	jwt *jwtVerifier // bearer tokens, nil if not configured
+
+	mode string
+	skew time.Duration // accepted difference from the server clock for signed requests
+
+	nonceLock sync.Mutex
+	nonces    map[string]time.Time // used nonces until they expire
+}
+
+// authIdentity - the caller, token is nil for SECRET which has all rights
+type authIdentity struct {
+	name  string
+	token *aclToken
 }
 
+type authContextKey struct{}
+
 func NewAuthSecret(secret string) *AuthSecret {
 	mw := &AuthSecret{}
 	mw.secret = secret
+	mw.mode = authModeToken
+	mw.skew = 5 * time.Minute
+	mw.nonces = make(map[string]time.Time)
 	return mw
 }
 
+// SetMode - token, hmac or both
+func (mw *AuthSecret) SetMode(mode string, skew time.Duration) error {
+	switch mode {
+	case authModeToken, authModeHMAC, authModeBoth:
+	default:
+		return fmt.Errorf("invalid AUTH_MODE: %s, expected token, hmac or both", mode)
+	}
+	mw.mode = mode
+	mw.skew = skew
+	return nil
+}
+
+// LoadACL - adds the tokens from the ACL file
+func (mw *AuthSecret) LoadACL(file string) error {
+	tokens, err := loadACL(file)
+	if err != nil {
+		return err
+	}
+	mw.tokens = tokens
+	return nil
+}
+
+// SetJWT - accepts bearer tokens checked by the verifier
+func (mw *AuthSecret) SetJWT(v *jwtVerifier) {
+	mw.jwt = v
+}
+
+// identifyBearer - the identity from a JWT, the rights come from its claim
+func (mw *AuthSecret) identifyBearer(bearer string) (*authIdentity, error) {
+	token, err := mw.jwt.verify(bearer)
+	if err != nil {
+		return nil, err
+	}
+	return &authIdentity{name: token.Name, token: token}, nil
+}
+
+// identify - the identity for the token, nil if not valid.
+// All the tokens are compared in constant time.
+func (mw *AuthSecret) identify(tkn string) *authIdentity {
+	if len(tkn) == 0 {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(tkn))
+
+	var found *authIdentity
+	if len(mw.secret) > 0 {
+		secretHash := sha256.Sum256([]byte(mw.secret))
+		if subtle.ConstantTimeCompare(hash[:], secretHash[:]) == 1 {
+			found = &authIdentity{name: SIGN_SECRET_KEY}
+		}
+	}
+	for _, token := range mw.tokens {
+		if subtle.ConstantTimeCompare(hash[:], token.hash[:]) == 1 && found == nil {
+			found = &authIdentity{name: token.Name, token: token}
+		}
+	}
+	return found
+}
+
+// identifySigned - checks the signature of the request, the timestamp and the nonce.
+// Returns the identity of the key used to sign.
+func (mw *AuthSecret) identifySigned(r *http.Request) (*authIdentity, error) {
+	keyName := r.Header.Get(HEADER_SIGN_KEY)
+	nonce := r.Header.Get(HEADER_SIGN_NONCE)
+	sig := strings.ToLower(r.Header.Get(HEADER_SIGN_SIG))
+	ts, err := strconv.ParseInt(r.Header.Get(HEADER_SIGN_TS), 10, 64)
+	if err != nil || len(keyName) == 0 || len(nonce) == 0 || len(nonce) > 128 {
+		return nil, errors.New("invalid signed request")
+	}
+
+	signedAt := time.Unix(ts, 0)
+	if time.Since(signedAt) > mw.skew || time.Until(signedAt) > mw.skew {
+		return nil, errors.New("signed request expired")
+	}
+
+	var id *authIdentity
+	key := ""
+	if keyName == SIGN_SECRET_KEY {
+		if len(mw.secret) > 0 {
+			id = &authIdentity{name: SIGN_SECRET_KEY}
+			key = mw.secret
+		}
+	} else {
+		for _, token := range mw.tokens {
+			if token.Name == keyName {
+				id = &authIdentity{name: token.Name, token: token}
+				key = token.Token
+			}
+		}
+	}
+	if id == nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	// The body is read to check it, and put back for the handler
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxSignedBody {
+			return nil, errors.New("body too large to sign")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := SignRequest(key, r.Method, r.RequestURI, ts, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	if !mw.useNonce(keyName+"\n"+nonce, signedAt.Add(mw.skew)) {
+		return nil, errors.New("nonce already used")
+	}
+	return id, nil
+}
+
+// useNonce - false if the nonce was seen before, it is kept until it could no longer be accepted
+func (mw *AuthSecret) useNonce(nonce string, expires time.Time) bool {
+	mw.nonceLock.Lock()
+	defer mw.nonceLock.Unlock()
+
+	now := time.Now()
+	if exp, ok := mw.nonces[nonce]; ok && exp.After(now) {
+		return false
+	}
+	mw.nonces[nonce] = expires
+
+	if len(mw.nonces)%1000 == 0 {
+		for n, exp := range mw.nonces {
+			if exp.Before(now) {
+				delete(mw.nonces, n)
+			}
+		}
+	}
+	return true
+}
+
+// authenticate - the caller from the signature or the token depending on the mode.
+// A bearer token is accepted in every mode when JWT is configured.
+func (mw *AuthSecret) authenticate(r *http.Request) (*authIdentity, error) {
+	if mw.jwt != nil {
+		if authz := r.Header.Get(HEADER_AUTHORIZATION); len(authz) > 7 && strings.EqualFold(authz[:7], "Bearer ") {
+			return mw.identifyBearer(strings.TrimSpace(authz[7:]))
+		}
+	}
+	signed := len(r.Header.Get(HEADER_SIGN_SIG)) > 0
+	if signed && mw.mode != authModeToken {
+		return mw.identifySigned(r)
+	}
+	if mw.mode == authModeHMAC {
+		return nil, errors.New("signed request required")
+	}
+	if id := mw.identify(getHeaderKey("tkn", r)); id != nil {
+		return id, nil
+	}
+	return nil, errors.New(http.StatusText(http.StatusUnauthorized))
+}
+
+// keepNonces - the nonces used with the previous settings cannot be used again after a reload
+func (mw *AuthSecret) keepNonces(old *AuthSecret) {
+	old.nonceLock.Lock()
+	defer old.nonceLock.Unlock()
+	for n, exp := range old.nonces {
+		mw.nonces[n] = exp
+	}
+}
+
+// authMiddleware - checks the request with the auth settings in use, none if authentication is off
+func (b *BucketsDb) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := b.runtime().auth; auth != nil {
+			auth.Middleware(next).ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (mw *AuthSecret) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		tkn := getHeaderKey("tkn", r)
-		//fmt.Printf("tkn:%s\n", tkn)
-		//fmt.Printf("sec:%s\n", mw.secret)
-		if mw.secret != tkn {
-			SendError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		} else {
-			next.ServeHTTP(w, r)
+		id, err := mw.authenticate(r)
+		if err != nil {
+			SendError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		setAccessUser(r, id.name)
+
+		if id.token != nil {
+			bucket := mux.Vars(r)["bucket"]
+			routeName := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				routeName = route.GetName()
+			}
+
+			right, ok := routeRights[routeName]
+			// without a bucket the handler limits the results
+			if !ok || (len(bucket) > 0 && !id.token.allows(bucket, right)) {
+				SendError(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
 		}
 
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, id)))
 	})
 }
+
+// getIdentity - the caller of the request, nil if authentication is off
+func getIdentity(r *http.Request) *authIdentity {
+	id, _ := r.Context().Value(authContextKey{}).(*authIdentity)
+	return id
+}
+
+// isAllowed - true if the caller has the right on the bucket
+func isAllowed(r *http.Request, bucket string, right byte) bool {
+	id := getIdentity(r)
+	if id == nil || id.token == nil {
+		return true
+	}
+	return id.token.allows(bucket, right)
+}
+
+// isAllowedAny - true if the caller has any right on the bucket
+func isAllowedAny(r *http.Request, bucket string) bool {
+	id := getIdentity(r)
+	if id == nil || id.token == nil {
+		return true
+	}
+	return id.token.allowsAny(bucket)
+}
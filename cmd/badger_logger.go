@@ -3,9 +3,10 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
 )
 
-type loggingLevel int
+type loggingLevel int32
 
 type BadgerLogger struct {
 	level loggingLevel
@@ -25,7 +26,7 @@ func convertLogLevel(slevel string) loggingLevel {
 	if slevel == "INFO" {
 		return INFO
 	}
-	if slevel == "WARNING" {
+	if slevel == "WARNING" || slevel == "WARN" {
 		return WARNING
 	}
 	if slevel == "ERROR" {
@@ -38,27 +39,36 @@ func DefaultLogger(level loggingLevel) *BadgerLogger {
 	return &BadgerLogger{level: level}
 }
 
+// SetLevel - changed by a config reload while logging
+func (l *BadgerLogger) SetLevel(level loggingLevel) {
+	atomic.StoreInt32((*int32)(&l.level), int32(level))
+}
+
+func (l *BadgerLogger) getLevel() loggingLevel {
+	return loggingLevel(atomic.LoadInt32((*int32)(&l.level)))
+}
+
 func (l *BadgerLogger) Errorf(f string, v ...interface{}) {
-	if l.level <= ERROR {
-		log.Printf("INFO: "+f, v...)
+	if l.getLevel() <= ERROR {
+		log.Printf("ERROR: "+f, v...)
 	}
 }
 
 func (l *BadgerLogger) Warningf(f string, v ...interface{}) {
-	if l.level <= WARNING {
+	if l.getLevel() <= WARNING {
 		log.Printf("WARN: "+f, v...)
 	}
 }
 
 func (l *BadgerLogger) Infof(f string, v ...interface{}) {
-	if l.level <= INFO {
+	if l.getLevel() <= INFO {
 		log.Printf("INFO: "+f, v...)
 
 	}
 }
 
 func (l *BadgerLogger) Debugf(f string, v ...interface{}) {
-	if l.level <= DEBUG {
+	if l.getLevel() <= DEBUG {
 		log.Printf("DEBUG: "+f, v...)
 	}
 }
@@ -1,24 +1,33 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
 	"github.com/samlotti/relKV/common"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+var errBucketNotFound = errors.New("bucket not found")
+
+// reservedKeys - names that cannot be used for buckets, used for routes
 var reservedKeys = map[string]bool{
 	"metrics": true,
 	"admin":   true,
 	"api":     true,
+	"status":  true,
 }
 
 type ServerState int
@@ -29,11 +38,13 @@ const Stopped ServerState = 2
 
 type BucketsDb struct {
 	listenAddrPort string
-	DbBucket       map[common.BucketName]*badger.DB
+	DbBucket       map[common.BucketName]*badger.DB // guarded by dbLock, buckets are opened and closed while running
+	inUse          map[common.BucketName]*bucketUse // guarded by dbLock, one for each open bucket
+	dbLock         sync.RWMutex
 	dbPath         string
 	allowCreate    bool
 	baseTableSize  int64
-	buckets        []common.BucketName
+	buckets        []common.BucketName // guarded by dbLock, created buckets are added while running
 	ServerState    ServerState
 	stopChan       chan os.Signal
 	authsecret     *AuthSecret
@@ -41,6 +52,36 @@ type BucketsDb struct {
 	logger         *BadgerLogger
 	version        string
 
+	// cancelled when the http server shuts down, ends the long running requests
+	serverCtx context.Context
+
+	// json access log and X-Request-ID
+	accessLog *accessLogger
+
+	// changes are recorded when AUDIT_LOG is set
+	auditLog     *AuditLog
+	auditLogPath string
+
+	// set when TLS_CERT and TLS_KEY are configured
+	certs *certReloader
+
+	// the settings changed by a config reload are guarded by configLock, see runtime()
+	configLock sync.RWMutex
+	reloadLock sync.Mutex
+
+	// the status checks that fail the status, the others are degraded
+	statusFailing map[string]bool
+
+	// max duration of searchKeys and getKeys
+	scanTimeouts *scanTimeouts
+
+	// rate limits of the data routes, nil if none
+	limits *throttle
+
+	// the settings at the start to report the changes, and the last reload
+	configValues map[string]string
+	lastReload   *common.ReloadStatus
+
 	Jobs []*common.ScpJob
 }
 
@@ -92,16 +133,25 @@ func (b *BucketsDb) openDBBuckets() {
 		panic(err)
 	}
 	for _, entry := range dirs {
-		if entry.IsDir() {
-			b.addBucket(common.BucketName(entry.Name()))
+		if !entry.IsDir() {
+			continue
 		}
+		// a name reserved by a later version must not stop the server
+		if !validateBucketName(entry.Name()) {
+			b.logger.Errorf("skipping bucket %s, the name is not valid or is reserved", entry.Name())
+			continue
+		}
+		b.addBucket(common.BucketName(entry.Name()))
 	}
 
+	b.dbLock.Lock()
 	b.DbBucket = make(map[common.BucketName]*badger.DB)
+	b.inUse = make(map[common.BucketName]*bucketUse)
+	b.dbLock.Unlock()
 	for _, bname := range b.buckets {
 		err := b.Open(common.BucketName(bname))
 		if err != nil {
-			fmt.Printf("error opening bucket:%s", err)
+			b.logger.Errorf("error opening bucket %s:%s", bname, err)
 			panic(err)
 		}
 	}
@@ -126,20 +176,124 @@ func (b *BucketsDb) Open(name common.BucketName) error {
 		return err
 	}
 
+	b.dbLock.Lock()
 	b.DbBucket[name] = db
+	b.inUse[name] = &bucketUse{closing: make(chan struct{})}
+	b.dbLock.Unlock()
 
 	return nil
 }
 
 func (b *BucketsDb) getDB(bucket string) (*badger.DB, error) {
+	b.dbLock.RLock()
+	defer b.dbLock.RUnlock()
 	if db, ok := b.DbBucket[common.BucketName(bucket)]; ok {
 		return db, nil
 	}
-	return nil, errors.New("bucket not found")
+	return nil, errBucketNotFound
+}
+
+// OpenBuckets - a copy of the open buckets
+func (b *BucketsDb) OpenBuckets() map[common.BucketName]*badger.DB {
+	b.dbLock.RLock()
+	defer b.dbLock.RUnlock()
+	dbs := make(map[common.BucketName]*badger.DB, len(b.DbBucket))
+	for name, db := range b.DbBucket {
+		dbs[name] = db
+	}
+	return dbs
+}
+
+// configuredBuckets - the buckets found at startup or created since, sorted. Some may be closed
+func (b *BucketsDb) configuredBuckets() []common.BucketName {
+	b.dbLock.RLock()
+	defer b.dbLock.RUnlock()
+	names := make([]common.BucketName, len(b.buckets))
+	copy(names, b.buckets)
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// CloseBucket - closes the database, the bucket can be opened again with create.
+// The new requests fail with bucket not found, the ones in progress are ended and waited for.
+func (b *BucketsDb) CloseBucket(name common.BucketName) error {
+	b.dbLock.Lock()
+	db, ok := b.DbBucket[name]
+	use := b.inUse[name]
+	delete(b.DbBucket, name)
+	delete(b.inUse, name)
+	b.dbLock.Unlock()
+
+	if !ok {
+		return errBucketNotFound
+	}
+
+	// ends the watches and scans
+	close(use.closing)
+	drained := make(chan struct{})
+	go func() {
+		use.requests.Wait()
+		close(drained)
+	}()
+	// the db cannot be closed under a txn or iterator in use, keeps waiting for the slow ones
+	for {
+		select {
+		case <-drained:
+			return db.Close()
+		case <-time.After(bucketDrainTimeout):
+			b.logger.Warningf("closing bucket %s, waiting for requests in progress", name)
+		}
+	}
+}
+
+// bucketDrainTimeout - the wait for the requests in progress before a warning when a bucket is closed
+const bucketDrainTimeout = 30 * time.Second
+
+// bucketUse - the requests in progress on an open bucket, closing is closed when the bucket is
+type bucketUse struct {
+	requests sync.WaitGroup
+	closing  chan struct{}
+}
+
+// useBucket - counts a request on the bucket, nil if it is not open. Call requests.Done when done
+func (b *BucketsDb) useBucket(name string) *bucketUse {
+	b.dbLock.RLock()
+	defer b.dbLock.RUnlock()
+	use, ok := b.inUse[common.BucketName(name)]
+	if !ok {
+		return nil
+	}
+	use.requests.Add(1)
+	return use
+}
+
+// bucketMiddleware - the request context of a bucket route ends when the bucket is closed,
+// CloseBucket waits for the request.
+func (b *BucketsDb) bucketMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		use := b.useBucket(mux.Vars(r)["bucket"])
+		if use == nil {
+			// not open, the handler reports it
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer use.requests.Done()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-use.closing:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func (b *BucketsDb) Close() {
-	for _, db := range b.DbBucket {
+	for _, db := range b.OpenBuckets() {
 		db.Close()
 	}
 }
@@ -151,31 +305,44 @@ func (b *BucketsDb) runGC() {
 			return
 		}
 
-		//b.logger.Warningf("Running gc loop")
-
-		for name, db := range BucketsInstance.DbBucket {
-			//b.logger.Warningf("Name: %s", name)
-			if err := db.RunValueLogGC(0.5); err != nil {
-				if err != badger.ErrNoRewrite {
-					log.Printf("error running gc on:%s", name)
-					log.Fatal(err)
-				} else {
-					atomic.AddInt64(&StatsInstance.bucketStats[common.BucketName(name)].numGCNR, 1)
-				}
-			} else {
-				atomic.AddInt64(&StatsInstance.bucketStats[common.BucketName(name)].numGC, 1)
+		for name, db := range b.OpenBuckets() {
+			if _, err := b.valueLogGC(name, db); err != nil {
+				// closed by the admin since, or a gc still running
+				b.logger.Errorf("error running gc on:%s %s", name, err)
 			}
 		}
 	}
 }
 
-// getListenAddr - returns as http://host:port
-func (b *BucketsDb) getListenAddr() string {
+// valueLogGC - one cycle of the value log gc, false if there was nothing to rewrite
+func (b *BucketsDb) valueLogGC(name common.BucketName, db *badger.DB) (bool, error) {
+	err := db.RunValueLogGC(0.5)
+	if err == badger.ErrNoRewrite {
+		atomic.AddInt64(&StatsInstance.bucketStat(name).numGCNR, 1)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	atomic.AddInt64(&StatsInstance.bucketStat(name).numGC, 1)
+	return true, nil
+}
+
+// getHostPort - returns as host:port
+func (b *BucketsDb) getHostPort() string {
 	hostport := b.listenAddrPort
 	if strings.HasPrefix(b.listenAddrPort, ":") {
 		hostport = "localhost" + hostport
 	}
-	return "http://" + hostport
+	return hostport
+}
+
+// getListenAddr - returns as http://host:port or https://host:port
+func (b *BucketsDb) getListenAddr() string {
+	if b.certs != nil {
+		return "https://" + b.getHostPort()
+	}
+	return "http://" + b.getHostPort()
 }
 
 func (b *BucketsDb) WaitTillStarted() {
@@ -183,11 +350,13 @@ func (b *BucketsDb) WaitTillStarted() {
 	for {
 		time.Sleep(100 * time.Millisecond)
 
-		_, err := http.Get(b.getListenAddr() + "/status")
+		// Only checks the port is open, the certificate may not be trusted by this host
+		conn, err := net.DialTimeout("tcp", b.getHostPort(), time.Second)
 		if err != nil {
-			fmt.Printf("err: %s\n", err)
+			b.logger.Debugf("waiting for the server: %s", err)
 			continue
 		}
+		conn.Close()
 
 		if b.ServerState == Running {
 			return
@@ -198,15 +367,38 @@ func (b *BucketsDb) WaitTillStarted() {
 	}
 }
 
-func (b *BucketsDb) addBucket(name common.BucketName) {
+// addBucket - registers the bucket and its stats, false if it already was
+func (b *BucketsDb) addBucket(name common.BucketName) bool {
 	if !validateBucketName(string(name)) {
 		panic(fmt.Sprintf("bad bucket name %s", name))
 	}
+	b.dbLock.Lock()
+	defer b.dbLock.Unlock()
 	for _, e := range b.buckets {
 		if e == name {
-			return
+			return false
 		}
 	}
-	b.buckets = append(b.buckets, common.BucketName(name))
 	StatsInstance.addBucket(name)
+	b.buckets = append(b.buckets, common.BucketName(name))
+	return true
+}
+
+// openBucket - opens a bucket created while running. It is registered with its stats
+// before the db is published to the requests, and removed again if it cannot be opened.
+func (b *BucketsDb) openBucket(name common.BucketName) error {
+	added := b.addBucket(name)
+	err := b.Open(name)
+	if err != nil && added {
+		b.dbLock.Lock()
+		for i, e := range b.buckets {
+			if e == name {
+				b.buckets = append(b.buckets[:i], b.buckets[i+1:]...)
+				break
+			}
+		}
+		b.dbLock.Unlock()
+		StatsInstance.removeBucket(name)
+	}
+	return err
 }
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"strings"
+)
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+// formatETag - the badger version of an item as a strong entity tag.
+func formatETag(version uint64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// etagMatches - true if the header lists the version. * matches any version.
+// accepts a comma separated list, weak tags are compared as strong ones.
+func etagMatches(header string, version uint64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		if strings.Trim(tag, "\"") == fmt.Sprint(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPreconditions - true if the request has If-Match or If-None-Match
+func hasPreconditions(r *http.Request) bool {
+	return len(r.Header.Get(HEADER_IF_MATCH)) > 0 || len(r.Header.Get(HEADER_IF_NONE_MATCH)) > 0
+}
+
+// checkPreconditions - evaluates If-Match / If-None-Match against the current item.
+// item is nil when the key does not exist.
+//
+//	If-Match: "v" <- the key must exist with that version
+//	If-None-Match: * <- create only
+//	If-None-Match: "v" <- the key must not be at that version
+func checkPreconditions(r *http.Request, item *badger.Item) error {
+	if ifMatch := r.Header.Get(HEADER_IF_MATCH); len(ifMatch) > 0 {
+		if item == nil || !etagMatches(ifMatch, item.Version()) {
+			return errPreconditionFailed
+		}
+	}
+	if ifNoneMatch := r.Header.Get(HEADER_IF_NONE_MATCH); len(ifNoneMatch) > 0 {
+		if item != nil && etagMatches(ifNoneMatch, item.Version()) {
+			return errPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// committedVersion - the version a write txn that read the key at readTs committed, 0 if deleted.
+// The txn read the key so no other write to it can commit in between, the first version after
+// readTs is its own. Open a read txn before the write so badger keeps the version until then.
+func committedVersion(db *badger.DB, key []byte, readTs uint64) uint64 {
+	var version uint64
+	_ = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.AllVersions = true
+		opts.PrefetchValues = false
+		opts.Prefix = key
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// the versions of a key are newest first
+		for it.Seek(key); it.Valid(); it.Next() {
+			item := it.Item()
+			if !bytes.Equal(item.Key(), key) || item.Version() <= readTs {
+				break
+			}
+			version = item.Version()
+			if item.IsDeletedOrExpired() {
+				version = 0
+			}
+		}
+		return nil
+	})
+	return version
+}
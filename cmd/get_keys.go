@@ -3,7 +3,6 @@ package cmd
 import (
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
 	. "github.com/samlotti/relKV/common"
@@ -22,33 +21,53 @@ func (b *BucketsDb) getKeys(writer http.ResponseWriter, request *http.Request) {
 	//fmt.Printf("bucket:%s\n", bucket)
 	bdb, err := b.getDB(bucket)
 	if err != nil {
-		SendError(writer, err.Error(), http.StatusBadRequest)
+		sendBucketError(writer, err)
 		return
 	}
 	db = bdb
 
+	ctx, cancel, err := b.scanContext(request)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
 	request.Body = http.MaxBytesReader(writer, request.Body, b.baseTableSize)
 
+	// Read before the stream starts, the error can still have a status
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		b.logger.Errorf("getKeys %s: %s", requestID(request), err)
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	keys := strings.Split(string(body), "\n")
+
 	writer.Header().Set("content-type", "application/json")
 	writer.Header().Set(RESP_HEADER_RELDB_FUNCTION, "getKeys")
 	writer.Write([]byte("[\n"))
 
+	needComma := false
 	err = db.View(func(txn *badger.Txn) error {
-
-		body, err := io.ReadAll(request.Body)
-		if err != nil {
-			return err
-		}
-
-		keys := strings.Split(string(body), "\n")
-
-		needComma := false
 		for _, key := range keys {
 
 			if len(key) == 0 {
 				continue
 			}
 
+			// The rest of the keys are not returned, the last entry has the error
+			if err := scanTruncated(ctx); err != nil {
+				kv := &KV{Error: err.Error()}
+				if needComma {
+					writer.Write([]byte(",\n"))
+				}
+				data, _ := json.Marshal(kv)
+				writer.Write([]byte("  "))
+				writer.Write(data)
+				return nil
+			}
+
 			kv := &KV{
 				Key:   key,
 				Value: "",
@@ -56,6 +75,9 @@ func (b *BucketsDb) getKeys(writer http.ResponseWriter, request *http.Request) {
 			}
 
 			item, err := txn.Get([]byte(key))
+			if err == nil && isHidden(item) {
+				err = badger.ErrKeyNotFound
+			}
 			if err == nil {
 
 				if isAlias(item) {
@@ -65,6 +87,8 @@ func (b *BucketsDb) getKeys(writer http.ResponseWriter, request *http.Request) {
 							return err
 						}
 
+						kv.TTL = getTTL(aliasParent)
+						kv.Version = aliasParent.Version()
 						err = aliasParent.Value(func(val []byte) error {
 							if b64 {
 								kv.Value = base64.StdEncoding.EncodeToString(val)
@@ -77,6 +101,8 @@ func (b *BucketsDb) getKeys(writer http.ResponseWriter, request *http.Request) {
 					})
 
 				} else {
+					kv.TTL = getTTL(item)
+					kv.Version = item.Version()
 					err = item.Value(func(val []byte) error {
 
 						if b64 {
@@ -95,27 +121,31 @@ func (b *BucketsDb) getKeys(writer http.ResponseWriter, request *http.Request) {
 				err = nil
 			}
 
-			if needComma {
-				writer.Write([]byte(",\n"))
-			}
-
 			data, err := json.Marshal(kv)
 			if err != nil {
-				fmt.Printf("Err:%s\n", err.Error())
 				return err
 			}
+			if needComma {
+				writer.Write([]byte(",\n"))
+			}
 			writer.Write([]byte("  "))
 			writer.Write(data)
 			needComma = true
 
 		}
-		return err
+		return nil
 
 	})
 
+	// little late for setting the status code, the last entry has the error
 	if err != nil {
-		fmt.Printf("Err:%s\n", err.Error())
-		SendError(writer, err.Error(), http.StatusInternalServerError)
+		b.logger.Errorf("getKeys %s: %s", requestID(request), err)
+		if needComma {
+			writer.Write([]byte(",\n"))
+		}
+		data, _ := json.Marshal(&KV{Error: err.Error()})
+		writer.Write([]byte("  "))
+		writer.Write(data)
 	}
 	writer.Write([]byte("\n]\n"))
 }
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"sync/atomic"
+)
+
+// batchWrite - applies a list of set and delete operations in a single transaction.
+// The body is a json list of BatchOp, values are base64 encoded if b64=1.
+// Each operation has the same alias checks as setKey, if any of them fail
+// nothing is written. Returns a BatchResult for each operation.
+func (b *BucketsDb) batchWrite(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	bucket := vars["bucket"]
+	b64 := getHeaderKeyBool(HEADER_B64_KEY, request)
+
+	writer.Header().Set(RESP_HEADER_RELDB_FUNCTION, "batchWrite")
+
+	db, err := b.getDB(bucket)
+	if err != nil {
+		sendBucketError(writer, err)
+		return
+	}
+
+	request.Body = http.MaxBytesReader(writer, request.Body, b.baseTableSize)
+
+	var ops []*BatchOp
+	if err := json.NewDecoder(request.Body).Decode(&ops); err != nil {
+		SendError(writer, "invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, op := range ops {
+		if op.Op == BATCH_OP_DELETE && !isAllowed(request, bucket, rightDelete) {
+			SendError(writer, "delete not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	results := make([]*BatchResult, len(ops))
+	values := make([][]byte, len(ops))
+	expires := make([]uint64, len(ops))
+
+	// Validate everything before starting the transaction
+	failed := -1
+	for i, op := range ops {
+		results[i] = &BatchResult{Op: op.Op, Key: op.Key}
+		if failed >= 0 {
+			continue
+		}
+
+		msg := ""
+		switch {
+		case len(op.Key) == 0:
+			msg = "key is required"
+		case !isKeyValid(op.Key):
+			msg = "key is has bad characters"
+		case op.Op != BATCH_OP_SET && op.Op != BATCH_OP_DELETE:
+			msg = fmt.Sprintf("unknown op: %s", op.Op)
+		case op.TTL < 0 || op.TTL > MAX_TTL_SECONDS:
+			msg = fmt.Sprintf("invalid ttl: %d, at most %d", op.TTL, MAX_TTL_SECONDS)
+		}
+
+		if len(msg) == 0 && op.Op == BATCH_OP_SET {
+			values[i] = []byte(op.Value)
+			if b64 {
+				values[i], err = base64.StdEncoding.DecodeString(op.Value)
+				if err != nil {
+					msg = "invalid base64 value: " + err.Error()
+				}
+			}
+			expires[i] = expiresAtTTL(op.TTL)
+		}
+
+		if len(msg) > 0 {
+			failed = i
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = msg
+		}
+	}
+	if failed >= 0 {
+		writeBatchResults(writer, http.StatusBadRequest, results, failed)
+		return
+	}
+
+	numWrites := 0
+	numDeletes := 0
+	// the aliases deleted with each key, for the audit
+	deletedAliases := make([][]string, len(ops))
+	// keeps the versions written until they are read for the results
+	guard := db.NewTransaction(false)
+	defer guard.Discard()
+	var readTs uint64
+	err = db.Update(func(txn *badger.Txn) error {
+		readTs = txn.ReadTs()
+		for i, op := range ops {
+			var err error
+			if op.Op == BATCH_OP_SET {
+				// aliases omitted keeps the current ones
+				err = setKeyTxn(txn, []byte(op.Key), values[i], op.Aliases, op.Aliases != nil, expires[i])
+				results[i].Status = http.StatusCreated
+				numWrites++
+			} else {
+				deletedAliases[i], err = deleteKeyTxn(txn, []byte(op.Key), op.Aliases)
+				if err == nil {
+					results[i].Deleted = len(deletedAliases[i]) + 1
+				}
+				results[i].Status = http.StatusOK
+				numDeletes++
+			}
+			if err != nil {
+				failed = i
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if kerr, ok := err.(*keyWriteError); ok {
+			status = kerr.status
+			if len(kerr.dupKey) > 0 {
+				writer.Header().Set(RESP_HEADER_DUPLICATE_ERROR, kerr.dupKey)
+				results[failed].DuplicateKey = kerr.dupKey
+			}
+		} else if err == badger.ErrTxnTooBig {
+			status = http.StatusRequestEntityTooLarge
+		} else if err == badger.ErrConflict {
+			status = http.StatusConflict
+		}
+
+		b.logger.Debugf("batch error:%s", err)
+		atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numError, 1)
+		atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).seqWriteError, 1)
+		StatsInstance.bucketStat(BucketName(bucket)).lastEMessage = err.Error()
+
+		if failed < 0 {
+			// Failed on commit, applies to all of them
+			for _, result := range results {
+				result.Status = status
+				result.Error = err.Error()
+			}
+		} else {
+			results[failed].Status = status
+			results[failed].Error = err.Error()
+		}
+		writeBatchResults(writer, status, results, failed)
+		return
+	}
+
+	atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numWrites, int64(numWrites))
+	atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numDelete, int64(numDeletes))
+	atomic.StoreInt64(&StatsInstance.bucketStat(BucketName(bucket)).seqWriteError, 0)
+
+	// Report the committed versions
+	for _, result := range results {
+		if result.Op == BATCH_OP_SET {
+			result.Version = committedVersion(db, []byte(result.Key), readTs)
+		}
+	}
+
+	if b.auditLog != nil {
+		for i, result := range results {
+			entry := &AuditEntry{Op: AUDIT_OP_DELETE, Bucket: bucket, Key: result.Key, Aliases: deletedAliases[i], Count: result.Deleted}
+			if result.Op == BATCH_OP_SET {
+				entry = &AuditEntry{Op: AUDIT_OP_SET, Bucket: bucket, Key: result.Key, Aliases: readAliases(db, []byte(result.Key)), Version: result.Version}
+			}
+			b.audit(request, entry)
+		}
+	}
+
+	writeBatchResults(writer, http.StatusOK, results, -1)
+}
+
+// writeBatchResults - sends the results. If an operation failed
+// the others are reported as not applied.
+func writeBatchResults(writer http.ResponseWriter, status int, results []*BatchResult, failed int) {
+	if failed >= 0 {
+		for i, result := range results {
+			if i == failed {
+				continue
+			}
+			result.Status = http.StatusFailedDependency
+			result.Deleted = 0
+			result.Error = "not applied"
+		}
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("content-type", "application/json")
+	if failed >= 0 {
+		writer.Header().Set(RESP_HEADER_ERROR_MSG, results[failed].Error)
+	}
+	writer.WriteHeader(status)
+	writer.Write(data)
+}
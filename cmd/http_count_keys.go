@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// countKeys - returns the number of keys in the bucket as json
+// parameters supported:
+//
+//	prefix, segments, start, end, start_ex, end_in <- the same selection as searchKeys
+//	group <- position of a key segment, 0 is the first. Counts the keys per value of the segment,
+//	         keys with fewer segments are only in the total count.
+func (b *BucketsDb) countKeys(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	bucket := vars["bucket"]
+
+	writer.Header().Set(RESP_HEADER_RELDB_FUNCTION, "countKeys")
+
+	db, err := b.getDB(bucket)
+	if err != nil {
+		sendBucketError(writer, err)
+		return
+	}
+
+	rng, err := newKeyRange(request)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group := -1
+	if g := getHeaderKey(HEADER_GROUP_KEY, request); g != "" {
+		group, err = strconv.Atoi(g)
+		if err != nil || group < 0 {
+			SendError(writer, fmt.Sprintf("invalid value for %s, expected a segment position found: %s", HEADER_GROUP_KEY, g), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result := &CountResult{Bucket: bucket}
+	if group >= 0 {
+		result.Groups = make(map[string]int)
+	}
+
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(rng.iteratorOptions(false))
+		defer it.Close()
+
+		for it.Seek(rng.seekKey()); it.Valid(); it.Next() {
+			item := it.Item()
+			if isHidden(item) {
+				continue
+			}
+			key := item.Key()
+			selected, done := rng.check(key)
+			if done {
+				break
+			}
+			if !selected {
+				continue
+			}
+
+			result.Count++
+			if group >= 0 {
+				if segment, ok := keySegment(string(key), group); ok {
+					result.Groups[segment]++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("content-type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(data)
+}
+
+// keySegment - the segment of the key at the position, false if the key has fewer segments.
+// Like segmentMatch only the last portion of a key with / is split.
+func keySegment(key string, pos int) (string, bool) {
+	segments := strings.SplitN(getFNameFromKey(key), HEADER_SEGMENT_SEPARATOR, pos+2)
+	if pos >= len(segments) {
+		return "", false
+	}
+	return segments[pos], true
+}
@@ -1,10 +1,8 @@
 package cmd
 
 import (
-	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/samlotti/relKV/common"
-	"log"
 	"net/http"
 )
 
@@ -15,21 +13,22 @@ func (b *BucketsDb) createBucket(writer http.ResponseWriter, request *http.Reque
 	// bucket = strings.TrimSpace(strings.ToLower(bucket))
 
 	if !validateBucketName(bucket) {
+		writer.Header().Set(common.RESP_HEADER_ERROR_CODE, common.ERROR_CODE_INVALID_BUCKET)
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if b.DbBucket[common.BucketName(bucket)] != nil {
+	if _, err := b.getDB(bucket); err == nil {
 		writer.WriteHeader(http.StatusCreated)
 		return
 	}
 
-	err := b.Open(common.BucketName(bucket))
+	err := b.openBucket(common.BucketName(bucket))
 	if err == nil {
-		b.addBucket(common.BucketName(bucket))
+		b.audit(request, &common.AuditEntry{Op: common.AUDIT_OP_CREATE_BUCKET, Bucket: bucket})
 		writer.WriteHeader(http.StatusCreated)
 	} else {
-		log.Println(fmt.Sprintf("error creating bucket:%s, %s", bucket, err))
+		b.logger.Errorf("error creating bucket:%s, %s", bucket, err)
 		SendError(writer, "error creating bucket", http.StatusInternalServerError)
 	}
 
@@ -22,7 +22,7 @@ func (b *BucketsDb) delKey(writer http.ResponseWriter, request *http.Request) {
 
 	bdb, err := b.getDB(bucket)
 	if err != nil {
-		SendError(writer, err.Error(), http.StatusBadRequest)
+		sendBucketError(writer, err)
 		return
 	}
 	db = bdb
@@ -35,44 +35,69 @@ func (b *BucketsDb) delKey(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if !isKeyValid(keyS) {
+		SendError(writer, "key is has bad characters", http.StatusBadRequest)
+		return
+	}
+
+	var deletedAliases []string
 	err = db.Update(func(txn *badger.Txn) error {
-		err := txn.Delete(key)
+		existing, err := txn.Get(key)
 		if err != nil {
-			return err
+			existing = nil
+		}
+		if isHidden(existing) {
+			return badger.ErrKeyNotFound
 		}
-		rec_deleted++
-
-		// Do the aliases
-		aliasesVal := request.Header.Get(HEADER_ALIAS_KEY)
-		if len(aliasesVal) > 0 {
-			aliases := strings.Split(aliasesVal, HEADER_ALIAS_SEPARATOR)
 
-			for _, alias := range aliases {
-				err = txn.Delete([]byte(alias))
+		if hasPreconditions(request) {
+			// the ETag of an alias is the one of its key, as on a get
+			if existing != nil && isAlias(existing) {
+				existing, err = aliasParent(txn, existing)
 				if err != nil {
-					rec_deleted = 0
-					txn.Discard()
 					return err
 				}
-				rec_deleted++
+			}
+			if err = checkPreconditions(request, existing); err != nil {
+				return err
 			}
 		}
 
-		return err
+		// Do the aliases
+		var aliases []string
+		aliasesVal := request.Header.Get(HEADER_ALIAS_KEY)
+		if len(aliasesVal) > 0 {
+			aliases = strings.Split(aliasesVal, HEADER_ALIAS_SEPARATOR)
+		}
+
+		deleted, err := deleteKeyTxn(txn, key, aliases)
+		if err != nil {
+			return err
+		}
+		deletedAliases = deleted
+		rec_deleted = len(deleted) + 1
+		return nil
 	})
 
 	writer.Header().Set("rec_deleted", fmt.Sprintf("%d", rec_deleted))
 
+	if err == badger.ErrConflict && hasPreconditions(request) {
+		err = errPreconditionFailed
+	}
+
 	if err != nil {
-		if err == badger.ErrKeyNotFound {
+		if err == errPreconditionFailed {
+			SendError(writer, err.Error(), http.StatusPreconditionFailed)
+		} else if err == badger.ErrKeyNotFound {
 			SendError(writer, badger.ErrKeyNotFound.Error(), http.StatusNotFound)
 		} else {
-			atomic.AddInt64(&StatsInstance.bucketStats[BucketName(bucket)].numError, 1)
-			StatsInstance.bucketStats[BucketName(bucket)].lastEMessage = err.Error()
+			atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numError, 1)
+			StatsInstance.bucketStat(BucketName(bucket)).lastEMessage = err.Error()
 			SendError(writer, err.Error(), http.StatusInternalServerError)
 		}
 	} else {
-		atomic.AddInt64(&StatsInstance.bucketStats[BucketName(bucket)].numDelete, 1)
+		atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numDelete, 1)
+		b.audit(request, &AuditEntry{Op: AUDIT_OP_DELETE, Bucket: bucket, Key: keyS, Aliases: deletedAliases, Count: rec_deleted})
 		writer.WriteHeader(http.StatusOK)
 	}
 }
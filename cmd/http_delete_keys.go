@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"sync/atomic"
+)
+
+// deleteKeysChunk - number of keys deleted per transaction
+const deleteKeysChunk = 500
+
+// deleteKeys - deletes the keys in the bucket selected the same way as searchKeys.
+// parameters supported:
+//
+//	prefix, segments, start, end, start_ex, end_in <- the selection, at least one is required
+//	explain <- dont delete, return headers showing how many keys would be deleted.
+//
+// Keys are deleted with their aliases in chunks of transactions, watchers see a del event for each.
+// Returns rec_selected, the keys matched and rec_deleted including the aliases.
+func (b *BucketsDb) deleteKeys(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	bucket := vars["bucket"]
+	explain := getHeaderKeyInt(HEADER_EXPLAIN_KEY, 0, request) == 1
+
+	writer.Header().Set(RESP_HEADER_RELDB_FUNCTION, "deleteKeys")
+
+	db, err := b.getDB(bucket)
+	if err != nil {
+		sendBucketError(writer, err)
+		return
+	}
+
+	rng, err := newKeyRange(request)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !rng.hasSelection() {
+		SendError(writer, "prefix, segments, start or end is required", http.StatusBadRequest)
+		return
+	}
+	// deleted in key order
+	rng.reverse = false
+
+	if explain {
+		selected, err := countRange(db, rng)
+		if err != nil {
+			SendError(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("ex_rows_selected", fmt.Sprint(selected))
+		writer.WriteHeader(http.StatusOK)
+		return
+	}
+
+	selected, deleted, err := deleteRange(db, rng)
+
+	atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numDelete, int64(selected))
+	writer.Header().Set("rec_selected", fmt.Sprint(selected))
+	writer.Header().Set("rec_deleted", fmt.Sprint(deleted))
+
+	if err != nil {
+		b.logger.Debugf("delete keys error:%s", err)
+		atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numError, 1)
+		StatsInstance.bucketStat(BucketName(bucket)).lastEMessage = err.Error()
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if deleted > 0 {
+		b.audit(request, &AuditEntry{Op: AUDIT_OP_DELETE_KEYS, Bucket: bucket, Key: string(rng.prefix), Count: deleted, Detail: describeRange(rng)})
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// countRange - the number of keys in the range.
+func countRange(db *badger.DB, rng *keyRange) (count int, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(rng.iteratorOptions(false))
+		defer it.Close()
+
+		for it.Seek(rng.seekKey()); it.Valid(); it.Next() {
+			item := it.Item()
+			if isHidden(item) {
+				continue
+			}
+			selected, done := rng.check(item.Key())
+			if done {
+				break
+			}
+			if !selected {
+				continue
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// deleteRange - deletes the keys in the range and their aliases, a chunk per transaction.
+// Returns the number of keys selected and the number of records deleted.
+func deleteRange(db *badger.DB, rng *keyRange) (selected int, deleted int, err error) {
+	// the start moves with each chunk, the caller keeps the range requested
+	next := *rng
+	rng = &next
+	for {
+		keys := make([][]byte, 0, deleteKeysChunk)
+		err = db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(rng.iteratorOptions(false))
+			defer it.Close()
+
+			for it.Seek(rng.seekKey()); it.Valid() && len(keys) < deleteKeysChunk; it.Next() {
+				item := it.Item()
+				if isHidden(item) {
+					continue
+				}
+				sel, done := rng.check(item.Key())
+				if done {
+					break
+				}
+				if sel {
+					keys = append(keys, item.KeyCopy(nil))
+				}
+			}
+			return nil
+		})
+		if err != nil || len(keys) == 0 {
+			return selected, deleted, err
+		}
+
+		chunkSelected, chunkDeleted := 0, 0
+		err = db.Update(func(txn *badger.Txn) error {
+			for _, key := range keys {
+				// May have gone as the alias of a key before it
+				if _, err := txn.Get(key); err == badger.ErrKeyNotFound {
+					continue
+				}
+				aliases, err := deleteKeyTxn(txn, key, nil)
+				if err != nil {
+					return err
+				}
+				chunkSelected++
+				chunkDeleted += len(aliases) + 1
+			}
+			return nil
+		})
+		if err != nil {
+			return selected, deleted, err
+		}
+		selected += chunkSelected
+		deleted += chunkDeleted
+
+		// Continue after the last key
+		rng.start = keys[len(keys)-1]
+		rng.startExclusive = true
+	}
+}
@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"fmt"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
 	"github.com/samlotti/relKV/common"
 	"net/http"
+	"strings"
 )
 
 func (b *BucketsDb) getKey(writer http.ResponseWriter, request *http.Request) {
@@ -19,7 +21,7 @@ func (b *BucketsDb) getKey(writer http.ResponseWriter, request *http.Request) {
 
 	bdb, err := b.getDB(bucket)
 	if err != nil {
-		SendError(writer, err.Error(), http.StatusBadRequest)
+		sendBucketError(writer, err)
 		return
 	}
 	db = bdb
@@ -28,6 +30,9 @@ func (b *BucketsDb) getKey(writer http.ResponseWriter, request *http.Request) {
 
 	err = db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
+		if err == nil && isHidden(item) {
+			err = badger.ErrKeyNotFound
+		}
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
 				SendError(writer, err.Error(), http.StatusNotFound)
@@ -43,11 +48,7 @@ func (b *BucketsDb) getKey(writer http.ResponseWriter, request *http.Request) {
 					return err
 				}
 
-				err = aliasParent.Value(func(val []byte) error {
-					writer.Write(val)
-					return nil
-				})
-				return err
+				return writeItem(writer, request, txn, aliasParent)
 			})
 			// ??
 			if err != nil {
@@ -56,10 +57,7 @@ func (b *BucketsDb) getKey(writer http.ResponseWriter, request *http.Request) {
 			}
 
 		} else {
-			return item.Value(func(val []byte) error {
-				writer.Write(val)
-				return nil
-			})
+			return writeItem(writer, request, txn, item)
 		}
 		return nil
 
@@ -69,3 +67,31 @@ func (b *BucketsDb) getKey(writer http.ResponseWriter, request *http.Request) {
 		SendError(writer, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// writeItem - writes the value with the ttl, ETag and aliases headers.
+// If-None-Match with the current version returns not modified.
+func writeItem(writer http.ResponseWriter, request *http.Request, txn *badger.Txn, item *badger.Item) error {
+	if ttl := getTTL(item); ttl > 0 {
+		writer.Header().Set(common.RESP_HEADER_TTL, fmt.Sprint(ttl))
+	}
+	aliases, err := getAliasIndex(txn, item.Key())
+	if err != nil {
+		return err
+	}
+	if len(aliases) > 0 {
+		writer.Header().Set(common.RESP_HEADER_ALIASES, strings.Join(aliases, common.HEADER_ALIAS_SEPARATOR))
+	}
+	writer.Header().Set(common.RESP_HEADER_ETAG, formatETag(item.Version()))
+
+	if ifNoneMatch := request.Header.Get(common.HEADER_IF_NONE_MATCH); len(ifNoneMatch) > 0 {
+		if etagMatches(ifNoneMatch, item.Version()) {
+			writer.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	return item.Value(func(val []byte) error {
+		writer.Write(val)
+		return nil
+	})
+}
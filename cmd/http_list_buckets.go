@@ -9,7 +9,11 @@ import (
 func (b *BucketsDb) listBuckets(writer http.ResponseWriter, request *http.Request) {
 	var buckets []*BucketData
 
-	for name := range b.DbBucket {
+	for name := range b.OpenBuckets() {
+		// only the buckets the token has access to
+		if !isAllowedAny(request, string(name)) {
+			continue
+		}
 		bk := &BucketData{
 			Name: string(name),
 		}
@@ -5,35 +5,44 @@ import (
 	"net/http"
 )
 
+// The route names are used to find the access right needed, see routeRights.
+// The auth and limits are read from the settings in use on each request, see runtime()
 func (b *BucketsDb) newHTTPRouter() *mux.Router {
 	router := mux.NewRouter()
 
-	router.HandleFunc("/status", b.status).Methods(http.MethodGet)
+	router.Use(b.accessLog.routeMiddleware, requestMetricsInstance.Middleware)
 
-	dataRouter := router.NewRoute().Subrouter()
+	router.HandleFunc("/status", b.status).Methods(http.MethodGet).Name("status")
+	router.HandleFunc("/api/livez", b.livez).Methods(http.MethodGet).Name("livez")
+	router.HandleFunc("/api/readyz", b.readyz).Methods(http.MethodGet).Name("readyz")
+	router.HandleFunc("/metrics", b.metrics).Methods(http.MethodGet).Name("metrics")
 
-	if value, ok := EnvironmentInstance.LookupEnv("SECRET"); ok && len(value) > 5 {
-		auth := NewAuthSecret(value)
-		dataRouter.Use(auth.Middleware)
-		b.authsecret = auth
-	}
+	// the auth and limits in use can change on a config reload
+	dataRouter := router.NewRoute().Subrouter()
+	dataRouter.Use(b.authMiddleware, b.throttleMiddleware, b.bucketMiddleware)
 
 	if b.allowCreate {
-		dataRouter.HandleFunc("/{bucket}", b.createBucket).Methods(http.MethodPut)
+		dataRouter.HandleFunc("/{bucket}", b.createBucket).Methods(http.MethodPut).Name("createBucket")
 	}
 
-	dataRouter.HandleFunc("/", b.listBuckets).Methods(http.MethodGet)
-	dataRouter.HandleFunc("/{bucket}", b.searchKeys).Methods(http.MethodGet)
+	dataRouter.HandleFunc("/", b.listBuckets).Methods(http.MethodGet).Name("listBuckets")
+	dataRouter.HandleFunc("/{bucket}", b.searchKeys).Methods(http.MethodGet).Name("searchKeys")
+	dataRouter.HandleFunc("/{bucket}", b.deleteKeys).Methods(http.MethodDelete).Name("deleteKeys")
 
 	// order is important
-	dataRouter.HandleFunc("/get/{bucket}", b.getKeys).Methods(http.MethodPost)
+	dataRouter.HandleFunc("/admin/orphans/{bucket}", b.orphans).Methods(http.MethodGet, http.MethodDelete).Name("orphans")
+	dataRouter.HandleFunc("/admin/audit/{bucket}", b.auditQuery).Methods(http.MethodGet).Name("audit")
+	dataRouter.HandleFunc("/get/{bucket}", b.getKeys).Methods(http.MethodPost).Name("getKeys")
+	dataRouter.HandleFunc("/api/batch/{bucket}", b.batchWrite).Methods(http.MethodPost).Name("batchWrite")
+	dataRouter.HandleFunc("/api/watch/{bucket}", b.watch).Methods(http.MethodGet).Name("watch")
+	dataRouter.HandleFunc("/api/count/{bucket}", b.countKeys).Methods(http.MethodGet).Name("countKeys")
 
-	dataRouter.HandleFunc("/{bucket}/{key:.*}", b.setKey).Methods(http.MethodPost)
+	dataRouter.HandleFunc("/{bucket}/{key:.*}", b.setKey).Methods(http.MethodPost).Name("setKey")
 
 	// Get a single entry
-	dataRouter.HandleFunc("/{bucket}/{key:.*}", b.getKey).Methods(http.MethodGet)
+	dataRouter.HandleFunc("/{bucket}/{key:.*}", b.getKey).Methods(http.MethodGet).Name("getKey")
 
-	dataRouter.HandleFunc("/{bucket}/{key:.*}", b.delKey).Methods(http.MethodDelete)
+	dataRouter.HandleFunc("/{bucket}/{key:.*}", b.delKey).Methods(http.MethodDelete).Name("delKey")
 
 	return router
 }
@@ -17,9 +17,15 @@ import (
 //   skip, max <- paging support
 //   segments <- :segments: in keyportion
 //   prefix <- limit to prefixes
+//   start, end <- key range, start_ex=1 / end_in=1 to change the inclusive defaults
+//   reverse <- iterate from the end
+//   cursor <- continue a scan, returned in the cursor trailer when max was reached
 //   values <- t/f  default is false
 //   b64 <- return values as base64
+//   with_aliases <- the aliases of each key, the key of each alias
 //   explain <- dont return data, return headers showing how many rows were read for the request.
+//   timeout <- seconds, up to SCAN_TIMEOUT_MAX_SECONDS. The stream ends with a truncated error entry
+//              and the cursor when the timeout is reached.
 
 func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
@@ -29,9 +35,22 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 	max := getHeaderKeyInt(HEADER_MAX_KEY, math.MaxInt, request)
 	getValues := getHeaderKeyBool(HEADER_VALUES_KEY, request)
 	b64 := getHeaderKeyBool(HEADER_B64_KEY, request)
-	segments := getSegments(getHeaderKey(HEADER_SEGMENT_KEY, request))
+	withAliases := getHeaderKeyBool(HEADER_WITH_ALIASES_KEY, request)
 	explain := getHeaderKeyInt(HEADER_EXPLAIN_KEY, 0, request) == 1
 
+	rng, err := newKeyRange(request)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, err := b.scanContext(request)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
 	ex_rows_read := 0
 	ex_rows_selected := 0
 	ex_rows_skipped := 0
@@ -40,7 +59,7 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 
 	bdb, err := b.getDB(bucket)
 	if err != nil {
-		SendError(writer, err.Error(), http.StatusBadRequest)
+		sendBucketError(writer, err)
 		return
 	}
 	db = bdb
@@ -49,44 +68,52 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 	writer.Header().Set(RESP_HEADER_RELDB_FUNCTION, "searchKeys")
 
 	if !explain {
+		// The cursor is only known at the end of the stream
+		writer.Header().Set("Trailer", RESP_HEADER_CURSOR)
 		writer.Write([]byte("[\n"))
 	}
 
 	rnum := 0
 	count := 0
+	var lastKey []byte
+	cursor := ""
 	err = db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		opts.PrefetchValues = getValues
-
-		it := txn.NewIterator(opts)
+		it := txn.NewIterator(rng.iteratorOptions(getValues))
 		defer it.Close()
 
-		var prefix []byte
+		for it.Seek(rng.seekKey()); it.Valid(); it.Next() {
+			// Stop when the client is gone or the time is up, the client can continue from the cursor
+			if err := scanTruncated(ctx); err != nil {
+				if lastKey != nil {
+					cursor = rng.cursor(lastKey)
+				}
+				return err
+			}
 
-		userPrefix := getHeaderKey(HEADER_PREFIX_KEY, request)
-		if userPrefix != "" {
-			prefix = append(prefix, []byte(userPrefix)...)
-		}
+			item := it.Item()
+			key := item.Key()
+			if isHidden(item) {
+				continue
+			}
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			// Additional selection
+			selected, done := rng.check(key)
+			if done {
+				break
+			}
 			ex_rows_read++
+			if !selected {
+				continue
+			}
 
-			item := it.Item()
-			key := item.Key()
 			keyStr := string(key)
 
 			kv := &KV{
-				Key:   keyStr,
-				Value: "",
-				Error: "",
-			}
-
-			// Additional selection
-			if segments != nil {
-				if !segmentMatch(keyStr, segments) {
-					continue
-				}
+				Key:     keyStr,
+				Value:   "",
+				Error:   "",
+				TTL:     getTTL(item),
+				Version: item.Version(),
 			}
 
 			// Resolve to the real value if alias!
@@ -99,6 +126,8 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 							return err
 						}
 
+						kv.TTL = getTTL(aliasParent)
+						kv.Version = aliasParent.Version()
 						err = aliasParent.Value(func(val []byte) error {
 							if b64 {
 								kv.Value = base64.StdEncoding.EncodeToString(val)
@@ -125,6 +154,10 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 
 			count += 1
 			if count > max {
+				// More rows, allow the client to continue from here
+				if lastKey != nil {
+					cursor = rng.cursor(lastKey)
+				}
 				return nil
 			}
 
@@ -150,6 +183,12 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 				}
 			}
 
+			if withAliases {
+				if err := setAliasInfo(txn, item, kv); err != nil {
+					return err
+				}
+			}
+
 			data, err := json.Marshal(kv)
 			if err != nil {
 				return err
@@ -159,6 +198,7 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 				writer.Write([]byte("  "))
 				writer.Write(data)
 			}
+			lastKey = item.KeyCopy(lastKey)
 
 		}
 		return nil
@@ -174,11 +214,19 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 		}
 
 		data, err := json.Marshal(kv)
-		if err != nil {
-			if !explain {
-				writer.Write(data)
+		if err == nil && !explain {
+			if ex_rows_selected > 0 {
+				writer.Write([]byte(",\n"))
 			}
+			writer.Write([]byte("  "))
+			writer.Write(data)
 		}
+		if explain {
+			writer.Header().Set(RESP_HEADER_ERROR_MSG, kv.Error)
+		}
+	}
+	if len(cursor) > 0 {
+		writer.Header().Set(RESP_HEADER_CURSOR, cursor)
 	}
 	if !explain {
 		writer.Write([]byte("\n"))
@@ -191,3 +239,16 @@ func (b *BucketsDb) searchKeys(writer http.ResponseWriter, request *http.Request
 
 	}
 }
+
+// setAliasInfo - the key an alias points to, or the aliases of a key
+func setAliasInfo(txn *badger.Txn, item *badger.Item, kv *KV) error {
+	if isAlias(item) {
+		return item.Value(func(val []byte) error {
+			kv.Alias = string(val)
+			return nil
+		})
+	}
+	aliases, err := getAliasIndex(txn, item.Key())
+	kv.Aliases = aliases
+	return err
+}
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"fmt"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/mux"
 	. "github.com/samlotti/relKV/common"
@@ -15,8 +14,11 @@ func (b *BucketsDb) setKey(writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	bucket := vars["bucket"]
 
+	// When the header is sent it replaces the aliases of the key, an empty value removes them all.
+	// Without the header the current aliases are kept.
 	aliasesVal := request.Header.Get(HEADER_ALIAS_KEY)
 	aliases := strings.Split(aliasesVal, HEADER_ALIAS_SEPARATOR)
+	replaceAliases := len(request.Header.Values(HEADER_ALIAS_KEY)) > 0
 
 	var db *badger.DB
 
@@ -30,7 +32,7 @@ func (b *BucketsDb) setKey(writer http.ResponseWriter, request *http.Request) {
 
 	bdb, err := b.getDB(bucket)
 	if err != nil {
-		SendError(writer, err.Error(), http.StatusBadRequest)
+		sendBucketError(writer, err)
 		return
 	}
 	db = bdb
@@ -39,12 +41,24 @@ func (b *BucketsDb) setKey(writer http.ResponseWriter, request *http.Request) {
 		SendError(writer, "key is has bad characters", http.StatusBadRequest)
 		return
 	}
+
+	// Aliases written in the same request expire with the key
+	expiresAt, err := getExpiresAt(request)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
 	request.Body = http.MaxBytesReader(writer, request.Body, b.baseTableSize)
 
 	status := http.StatusCreated
 	dupKey := ""
 	// log.Printf("set key: %s", keyS)
+	// keeps the version written until it is read for the ETag
+	guard := db.NewTransaction(false)
+	defer guard.Discard()
+	var readTs uint64
 	err = db.Update(func(txn *badger.Txn) error {
+		readTs = txn.ReadTs()
 		bodyBytes, err := io.ReadAll(request.Body)
 		if err != nil {
 			return err
@@ -52,72 +66,39 @@ func (b *BucketsDb) setKey(writer http.ResponseWriter, request *http.Request) {
 
 		existing, err := txn.Get(key)
 		if err != nil {
-		} else {
-			if isAlias(existing) {
-				// This is no good
-				status = http.StatusBadRequest
-				dupKey = string(key)
-				err = fmt.Errorf("current key is an aliase, cannot update alias directly")
-				return err
-			}
-		}
-
-		e := badger.NewEntry(key, bodyBytes)
-		err = txn.SetEntry(e)
-
-		if err != nil {
-			txn.Discard()
-			return err
+			existing = nil
 		}
 
-		if len(aliasesVal) > 0 {
-			for _, alias := range aliases {
-
-				item, err := txn.Get([]byte(alias))
-				if err == nil {
-					if isAlias(item) {
-						currentAliasValue := ""
-						err = item.Value(func(val []byte) error {
-							currentAliasValue = string(val)
-							return nil
-						})
-						if err != nil {
-							txn.Discard()
-							return err
-						}
-						if currentAliasValue != string(key) {
-							status = http.StatusBadRequest
-							dupKey = alias
-							txn.Discard()
-							return fmt.Errorf("alias duplicate key")
-						}
-					} else {
-						// Not an alias
-						status = http.StatusBadRequest
-						dupKey = alias
-						txn.Discard()
-						return fmt.Errorf("alias tried to overrite regular key")
-					}
-				}
-
-				e := badger.NewEntry([]byte(alias), key).WithMeta(BADGER_FLAG_ALIAS)
-				err = txn.SetEntry(e)
-				if err != nil {
-					txn.Discard()
-					return err
-				}
+		// an alias key is rejected by setKeyTxn
+		if !isAlias(existing) {
+			if err = checkPreconditions(request, existing); err != nil {
+				status = http.StatusPreconditionFailed
+				return err
 			}
 		}
 
-		return nil
+		err = setKeyTxn(txn, key, bodyBytes, aliases, replaceAliases, expiresAt)
+		if kerr, ok := err.(*keyWriteError); ok {
+			status = kerr.status
+			dupKey = kerr.dupKey
+		}
+		return err
 	})
 
-	if err != nil {
+	if err == badger.ErrConflict && hasPreconditions(request) {
+		// Another write committed after the version was checked
+		status = http.StatusPreconditionFailed
+		err = errPreconditionFailed
+	}
+
+	if err != nil && status == http.StatusPreconditionFailed {
+		SendError(writer, err.Error(), status)
+	} else if err != nil {
 		b.logger.Debugf("error:%s", err)
 
-		atomic.AddInt64(&StatsInstance.bucketStats[BucketName(bucket)].numError, 1)
-		atomic.AddInt64(&StatsInstance.bucketStats[BucketName(bucket)].seqWriteError, 1)
-		StatsInstance.bucketStats[BucketName(bucket)].lastEMessage = err.Error()
+		atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numError, 1)
+		atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).seqWriteError, 1)
+		StatsInstance.bucketStat(BucketName(bucket)).lastEMessage = err.Error()
 		if len(dupKey) > 0 {
 			writer.Header().Set(RESP_HEADER_DUPLICATE_ERROR, dupKey)
 		}
@@ -128,8 +109,13 @@ func (b *BucketsDb) setKey(writer http.ResponseWriter, request *http.Request) {
 		}
 
 	} else {
-		atomic.AddInt64(&StatsInstance.bucketStats[BucketName(bucket)].numWrites, 1)
-		atomic.StoreInt64(&StatsInstance.bucketStats[BucketName(bucket)].seqWriteError, 0)
+		atomic.AddInt64(&StatsInstance.bucketStat(BucketName(bucket)).numWrites, 1)
+		atomic.StoreInt64(&StatsInstance.bucketStat(BucketName(bucket)).seqWriteError, 0)
+		version := committedVersion(db, key, readTs)
+		if b.auditLog != nil {
+			b.audit(request, &AuditEntry{Op: AUDIT_OP_SET, Bucket: bucket, Key: keyS, Aliases: readAliases(db, key), Version: version})
+		}
+		writer.Header().Set(RESP_HEADER_ETAG, formatETag(version))
 		writer.WriteHeader(status)
 	}
 
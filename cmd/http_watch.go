@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// watchKeepAlive - a comment is sent when idle so proxies keep the connection open
+const watchKeepAlive = 15 * time.Second
+
+// watchBufferSize - changes queued for a client, a client that falls further behind is disconnected
+const watchBufferSize = 1000
+
+// watchFlushEvery - events of a catch up written before they are flushed
+const watchFlushEvery = 100
+
+// watchConfirmInterval - until the first change arrives, how often to look for a commit missed while subscribing
+const watchConfirmInterval = time.Second
+
+var errWatchOverflow = errors.New("client too slow, reconnect with Last-Event-ID")
+
+// watch - streams the changes to keys in the bucket as Server-Sent Events.
+// parameters supported:
+//
+//	prefix <- limit to keys with the prefix
+//	values <- include the value in set events, the key for an alias
+//	b64 <- values as base64
+//	since <- also send the changes after this version, Last-Event-ID is used on a reconnect
+//	timeout <- seconds, the max duration of the catch up like a search
+//
+// Each event has the version as its id, the event type set or del and a ChangeEvent as the data.
+func (b *BucketsDb) watch(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	bucket := vars["bucket"]
+	getValues := getHeaderKeyBool(HEADER_VALUES_KEY, request)
+	b64 := getHeaderKeyBool(HEADER_B64_KEY, request)
+
+	var prefix []byte
+	if p := getHeaderKey(HEADER_PREFIX_KEY, request); p != "" {
+		prefix = []byte(p)
+	}
+
+	writer.Header().Set(RESP_HEADER_RELDB_FUNCTION, "watch")
+
+	db, err := b.getDB(bucket)
+	if err != nil {
+		sendBucketError(writer, err)
+		return
+	}
+
+	since := getHeaderKey(HEADER_SINCE_KEY, request)
+	if lastId := request.Header.Get(HEADER_LAST_EVENT_ID); lastId != "" {
+		since = lastId
+	}
+	var sinceVersion uint64
+	if since != "" {
+		sinceVersion, err = strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			SendError(writer, fmt.Sprintf("invalid value for %s, expected a version found: %s", HEADER_SINCE_KEY, since), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// limits each catch up like a search
+	timeout, err := b.scanTimeout(request)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		SendError(writer, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	if b.serverCtx != nil {
+		go func() {
+			select {
+			case <-b.serverCtx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	// Subscribe before the catch up so nothing is missed in between. Badger does not tell when the
+	// subscription is active, but the commit versions follow each other: the first change received
+	// shows if a commit was made before, it is then read by a catch up.
+	changes := make(chan *pb.KV, watchBufferSize)
+	subErr := make(chan error, 1)
+	go func() {
+		first := true
+		subErr <- db.Subscribe(ctx, func(list *badger.KVList) error {
+			for _, kv := range list.Kv {
+				if first {
+					first = false
+					// without a key, the version of the first change
+					if !queueChange(changes, &pb.KV{Version: kv.Version}) {
+						return errWatchOverflow
+					}
+				}
+				if !bytes.HasPrefix(kv.Key, prefix) || isHiddenKey(kv.Key) {
+					continue
+				}
+				if !queueChange(changes, kv) {
+					return errWatchOverflow
+				}
+			}
+			return nil
+		}, []pb.Match{{Prefix: nil}})
+	}()
+
+	// The changes up to this version are read by the catch up, the later ones by the subscription
+	caughtUp := lastCommit(db)
+
+	writer.Header().Set("content-type", "text/event-stream")
+	writer.Header().Set("cache-control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte(": watching " + bucket + "\n\n"))
+	flusher.Flush()
+
+	if since != "" {
+		caughtUp, err = b.watchCatchUp(ctx, timeout, writer, db, prefix, sinceVersion, getValues, b64)
+		if err != nil {
+			writeWatchError(writer, err)
+			return
+		}
+		flusher.Flush()
+	}
+
+	// The commits missed while subscribing, from the version of the last one read
+	catchUpMissed := func() error {
+		var err error
+		caughtUp, err = b.watchCatchUp(ctx, timeout, writer, db, prefix, caughtUp, getValues, b64)
+		if err != nil {
+			writeWatchError(writer, err)
+		}
+		flusher.Flush()
+		return err
+	}
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	confirm := time.NewTicker(watchConfirmInterval)
+	defer confirm.Stop()
+	confirmed := false
+
+	send := func(kv *pb.KV) error {
+		if kv.Version <= caughtUp || isHiddenKey(kv.Key) {
+			return nil
+		}
+		var meta byte
+		if len(kv.Meta) > 0 {
+			meta = kv.Meta[0]
+		}
+		event := &ChangeEvent{
+			Op:      WATCH_EVENT_SET,
+			Key:     string(kv.Key),
+			Version: kv.Version,
+			Alias:   meta&BADGER_FLAG_ALIAS == BADGER_FLAG_ALIAS,
+		}
+		// The user meta of the entry, a delete has no flag
+		if meta&(BADGER_FLAG_VALUE|BADGER_FLAG_ALIAS) == 0 {
+			event.Op = WATCH_EVENT_DELETE
+		} else if getValues {
+			event.Value = encodeValue(kv.Value, b64)
+		}
+		return writeWatchEvent(writer, event)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-subErr:
+			if err != nil && ctx.Err() == nil {
+				writeWatchError(writer, err)
+			}
+			return
+		case <-keepAlive.C:
+			writer.Write([]byte(": ping\n\n"))
+			flusher.Flush()
+		case <-confirm.C:
+			// No change received yet, a commit may have been made before the subscription was active
+			if !confirmed && lastCommit(db) > caughtUp {
+				if catchUpMissed() != nil {
+					return
+				}
+			}
+		case kv := <-changes:
+			if kv.Key == nil {
+				confirmed = true
+				confirm.Stop()
+				if kv.Version > caughtUp+1 && catchUpMissed() != nil {
+					return
+				}
+				continue
+			}
+			if err := send(kv); err != nil {
+				return
+			}
+			// Send anything else already queued before flushing
+			if len(changes) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// watchCatchUp - streams the latest change of each key with a version after since, in key order.
+// The events have no id, the read version is sent as the id once done: a client that reconnects
+// during the catch up starts it again. Deletes are only known until badger compacts them.
+// Returns the read version of the scan.
+func (b *BucketsDb) watchCatchUp(ctx context.Context, timeout time.Duration, writer http.ResponseWriter, db *badger.DB, prefix []byte, since uint64, getValues bool, b64 bool) (uint64, error) {
+	var readTs uint64
+	flusher, _ := writer.(http.Flusher)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := db.View(func(txn *badger.Txn) error {
+		readTs = txn.ReadTs()
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.AllVersions = true
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var lastKey []byte
+		sent := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := scanTruncated(ctx); err != nil {
+				return err
+			}
+			item := it.Item()
+			// The first version of each key is the latest
+			if lastKey != nil && bytes.Equal(item.Key(), lastKey) {
+				continue
+			}
+			lastKey = item.KeyCopy(lastKey)
+
+			if item.Version() <= since || isHiddenKey(item.Key()) {
+				continue
+			}
+
+			event := &ChangeEvent{
+				Op:      WATCH_EVENT_SET,
+				Key:     string(item.Key()),
+				Version: item.Version(),
+				Alias:   isAlias(item),
+			}
+			if item.IsDeletedOrExpired() {
+				event.Op = WATCH_EVENT_DELETE
+			} else if getValues {
+				err := item.Value(func(val []byte) error {
+					event.Value = encodeValue(val, b64)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if err := writeWatchData(writer, event); err != nil {
+				return err
+			}
+			if sent++; sent%watchFlushEvery == 0 && flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	_, err = fmt.Fprintf(writer, "id: %d\n\n", readTs)
+	return readTs, err
+}
+
+// queueChange - never blocks the publisher, it holds up all the writes
+func queueChange(changes chan *pb.KV, kv *pb.KV) bool {
+	select {
+	case changes <- kv:
+		return true
+	default:
+		return false
+	}
+}
+
+// lastCommit - the version of the last commit, the read version of a new transaction
+func lastCommit(db *badger.DB) uint64 {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	return txn.ReadTs()
+}
+
+// badgerInternalPrefix - badger publishes its own transaction markers with this prefix
+var badgerInternalPrefix = []byte("!badger!")
+
+// isHiddenKey - the internal entries start with 0, not valid in a client key
+func isHiddenKey(key []byte) bool {
+	return (len(key) > 0 && key[0] == 0) || bytes.HasPrefix(key, badgerInternalPrefix)
+}
+
+func encodeValue(val []byte, b64 bool) string {
+	if b64 {
+		return base64.StdEncoding.EncodeToString(val)
+	}
+	return string(val)
+}
+
+func writeWatchEvent(writer http.ResponseWriter, event *ChangeEvent) error {
+	if _, err := fmt.Fprintf(writer, "id: %d\n", event.Version); err != nil {
+		return err
+	}
+	return writeWatchData(writer, event)
+}
+
+// writeWatchData - the event without an id, the last event id of the client is kept
+func writeWatchData(writer http.ResponseWriter, event *ChangeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Op, data)
+	return err
+}
+
+// writeWatchError - the stream has ended, the client can reconnect with Last-Event-ID
+func writeWatchError(writer http.ResponseWriter, err error) {
+	data, _ := json.Marshal(&KV{Error: err.Error()})
+	fmt.Fprintf(writer, "event: error\ndata: %s\n\n", data)
+	if flusher, ok := writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	. "github.com/samlotti/relKV/common"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Inspector - a bucket opened read-only to look inside it while the server is stopped
+type Inspector struct {
+	Bucket string
+	db     *badger.DB
+}
+
+// OpenInspector - opens the bucket under DB_PATH read-only.
+// Fails if the server is running, it holds the lock of the directory.
+func OpenInspector(bucket string) (*Inspector, error) {
+	dbPath := EnvironmentInstance.GetEnv("DB_PATH", "")
+	if len(dbPath) == 0 {
+		return nil, fmt.Errorf("DB_PATH empty or not specified")
+	}
+	if !validateBucketName(bucket) {
+		return nil, fmt.Errorf("invalid bucket name: %s", bucket)
+	}
+	dir := filepath.Join(dbPath, bucket)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("bucket not found: %s", dir)
+	}
+
+	opts := badger.DefaultOptions(dir)
+	opts = opts.WithReadOnly(true)
+	opts = opts.WithLogger(DefaultLogger(ERROR))
+	db, err := badger.Open(opts)
+	if err != nil {
+		if strings.Contains(err.Error(), "Cannot acquire directory lock") {
+			return nil, fmt.Errorf("bucket %s is in use, stop the server first", bucket)
+		}
+		return nil, err
+	}
+	return &Inspector{Bucket: bucket, db: db}, nil
+}
+
+func (i *Inspector) Close() error {
+	return i.db.Close()
+}
+
+// inspectKV - the key with its ttl, version and alias information, no value
+func inspectKV(txn *badger.Txn, item *badger.Item) (*KV, error) {
+	kv := &KV{Key: string(item.Key()), TTL: getTTL(item), Version: item.Version()}
+	return kv, setAliasInfo(txn, item, kv)
+}
+
+// Keys - calls fn for the keys starting with the prefix, max 0 = all.
+// Aliases have the key they point to, even if it is missing.
+func (i *Inspector) Keys(prefix string, max int, fn func(kv *KV) error) error {
+	return i.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		count := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if isHidden(item) {
+				continue
+			}
+			if max > 0 && count >= max {
+				return nil
+			}
+			count++
+			kv, err := inspectKV(txn, item)
+			if err != nil {
+				return err
+			}
+			if err := fn(kv); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get - the key with its value, for an alias the value of the key it points to
+func (i *Inspector) Get(key string) (*KV, error) {
+	var kv *KV
+	err := i.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == nil && isHidden(item) {
+			err = badger.ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if kv, err = inspectKV(txn, item); err != nil {
+			return err
+		}
+
+		if isAlias(item) {
+			target, err := txn.Get([]byte(kv.Alias))
+			if err == badger.ErrKeyNotFound {
+				kv.Error = "orphaned alias, key not found: " + kv.Alias
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			item = target
+		}
+		val, err := item.ValueCopy(nil)
+		kv.Value = string(val)
+		return err
+	})
+	return kv, err
+}
+
+// Count - the keys, aliases and hidden entries starting with the prefix
+func (i *Inspector) Count(prefix string) (*InspectCount, error) {
+	count := &InspectCount{Bucket: i.Bucket, Prefix: prefix}
+	err := i.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			switch {
+			case isHidden(item):
+				count.Hidden++
+			case isAlias(item):
+				count.Aliases++
+			default:
+				count.Keys++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Versions - the versions of the key not yet removed by a compaction, newest first
+func (i *Inspector) Versions(key string) ([]*KeyVersion, error) {
+	versions := make([]*KeyVersion, 0)
+	err := i.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.AllVersions = true
+		opts.Prefix = []byte(key)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek([]byte(key)); it.Valid(); it.Next() {
+			item := it.Item()
+			if !bytes.Equal(item.Key(), []byte(key)) {
+				break
+			}
+			versions = append(versions, &KeyVersion{
+				Version:   item.Version(),
+				Deleted:   item.IsDeletedOrExpired(),
+				ExpiresAt: item.ExpiresAt(),
+				Alias:     isAlias(item),
+				Size:      item.EstimatedSize(),
+			})
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// Info - the levels and tables of the LSM tree and the value log files
+func (i *Inspector) Info() (*InspectInfo, error) {
+	info := &InspectInfo{Bucket: i.Bucket, MaxVersion: i.db.MaxVersion()}
+	info.LsmSize, info.VlogSize = i.db.Size()
+
+	for _, level := range i.db.Levels() {
+		info.Levels = append(info.Levels, &InspectLevel{
+			Level:      level.Level,
+			Tables:     level.NumTables,
+			Size:       level.Size,
+			TargetSize: level.TargetSize,
+			StaleSize:  level.StaleDatSize,
+		})
+	}
+
+	tables := i.db.Tables()
+	sort.Slice(tables, func(a, b int) bool {
+		if tables[a].Level != tables[b].Level {
+			return tables[a].Level < tables[b].Level
+		}
+		return bytes.Compare(tables[a].Left, tables[b].Left) < 0
+	})
+	for _, table := range tables {
+		info.Tables = append(info.Tables, &InspectTable{
+			ID:         table.ID,
+			Level:      table.Level,
+			Left:       string(badgerKey(table.Left)),
+			Right:      string(badgerKey(table.Right)),
+			Keys:       table.KeyCount,
+			Size:       table.OnDiskSize,
+			StaleSize:  table.StaleDataSize,
+			MaxVersion: table.MaxVersion,
+		})
+	}
+
+	files, err := filepath.Glob(filepath.Join(i.db.Opts().ValueDir, "*.vlog"))
+	if err != nil {
+		return info, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return info, err
+		}
+		info.VlogFiles = append(info.VlogFiles, &InspectFile{Name: filepath.Base(file), Size: stat.Size()})
+	}
+	return info, nil
+}
+
+// badgerKey - the key of a table bound, badger adds the version in the last 8 bytes
+func badgerKey(key []byte) []byte {
+	if len(key) <= 8 {
+		return key
+	}
+	return key[:len(key)-8]
+}
+
+// Orphans - the aliases that point to a missing key, nothing is deleted
+func (i *Inspector) Orphans() (*OrphanReport, error) {
+	return findOrphans(i.Bucket, i.db, false)
+}
@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtVerifier - checks bearer tokens signed with the HMAC secret or the public key.
+// The bucket rights come from a claim with the same grants as the ACL_FILE:
+//
+//	"relkv": [ { "buckets": "ctl_*", "rights": "r" } ]
+type jwtVerifier struct {
+	hmacSecret []byte
+	publicKey  crypto.PublicKey // *rsa.PublicKey or *ecdsa.PublicKey
+	claim      string
+	issuer     string
+	audience   string
+	leeway     time.Duration
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type jwtClaims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"` // a string or a list
+	Exp *float64        `json:"exp"`
+	Nbf *float64        `json:"nbf"`
+}
+
+// newJWTVerifierFromEnv - nil if JWT_HMAC_SECRET and JWT_PUBLIC_KEY are not set
+func newJWTVerifierFromEnv() (*jwtVerifier, error) {
+	secret := EnvironmentInstance.GetEnv("JWT_HMAC_SECRET", "")
+	keyFile := EnvironmentInstance.GetEnv("JWT_PUBLIC_KEY", "")
+	if len(secret) == 0 && len(keyFile) == 0 {
+		return nil, nil
+	}
+
+	v := &jwtVerifier{
+		claim:    EnvironmentInstance.GetEnv("JWT_CLAIM", "relkv"),
+		issuer:   EnvironmentInstance.GetEnv("JWT_ISSUER", ""),
+		audience: EnvironmentInstance.GetEnv("JWT_AUDIENCE", ""),
+		leeway:   time.Duration(EnvironmentInstance.GetInt("JWT_LEEWAY_SECONDS", 30)) * time.Second,
+	}
+	if len(secret) > 0 {
+		if len(secret) < 32 {
+			return nil, errors.New("JWT_HMAC_SECRET should be at least 32 characters")
+		}
+		v.hmacSecret = []byte(secret)
+	}
+	if len(keyFile) > 0 {
+		key, err := loadPublicKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey = key
+	}
+	return v, nil
+}
+
+// loadPublicKey - an RSA or ECDSA public key or certificate in pem format
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWT_PUBLIC_KEY: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("JWT_PUBLIC_KEY: no pem data found")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_PUBLIC_KEY: %w", err)
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("JWT_PUBLIC_KEY: %w", err)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, errors.New("JWT_PUBLIC_KEY: only RSA and ECDSA keys are supported")
+}
+
+// verify - checks the signature and the claims, returns the token with the grants from the claim
+func (v *jwtVerifier) verify(token string) (*aclToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid token")
+	}
+
+	header := &jwtHeader{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	if err = v.verifySignature(header.Alg, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	// Only trusted once the signature is checked
+	claims := &jwtClaims{}
+	if err = decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if claims.Exp == nil {
+		return nil, errors.New("token has no exp")
+	}
+	if now.After(time.Unix(int64(*claims.Exp), 0).Add(v.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Add(v.leeway).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if len(v.issuer) > 0 && claims.Iss != v.issuer {
+		return nil, errors.New("token issuer not accepted")
+	}
+	if len(v.audience) > 0 && !audienceContains(claims.Aud, v.audience) {
+		return nil, errors.New("token audience not accepted")
+	}
+
+	grants := make(map[string]json.RawMessage)
+	if err = decodeJWTPart(parts[1], &grants); err != nil {
+		return nil, err
+	}
+	t := &aclToken{Name: "jwt:" + claims.Sub}
+	if raw, ok := grants[v.claim]; ok {
+		if err = json.Unmarshal(raw, &t.Grants); err != nil {
+			return nil, fmt.Errorf("invalid %s claim", v.claim)
+		}
+		if err = validateGrants(t.Grants); err != nil {
+			return nil, fmt.Errorf("%s claim %w", v.claim, err)
+		}
+	}
+	return t, nil
+}
+
+// verifySignature - the algorithm must match the configured key
+func (v *jwtVerifier) verifySignature(alg string, signed []byte, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg: %s", alg)
+	}
+	var hashFunc crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hashFunc = crypto.SHA256
+	case "384":
+		hashFunc = crypto.SHA384
+	case "512":
+		hashFunc = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg: %s", alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		if v.hmacSecret == nil {
+			return fmt.Errorf("unsupported alg: %s", alg)
+		}
+		mac := hmac.New(newHash(hashFunc), v.hmacSecret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "RS":
+		key, ok := v.publicKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("unsupported alg: %s", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hashFunc, digest(hashFunc, signed), sig); err != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "ES":
+		key, ok := v.publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("unsupported alg: %s", alg)
+		}
+		// ES256 is P-256, ES384 P-384 and ES512 P-521
+		curveAlg := map[int]crypto.Hash{256: crypto.SHA256, 384: crypto.SHA384, 521: crypto.SHA512}
+		if curveAlg[key.Curve.Params().BitSize] != hashFunc {
+			return fmt.Errorf("unsupported alg: %s", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest(hashFunc, signed), r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg: %s", alg)
+}
+
+func newHash(h crypto.Hash) func() hash.Hash {
+	switch h {
+	case crypto.SHA384:
+		return sha512.New384
+	case crypto.SHA512:
+		return sha512.New
+	}
+	return sha256.New
+}
+
+func digest(h crypto.Hash, data []byte) []byte {
+	d := newHash(h)()
+	d.Write(data)
+	return d.Sum(nil)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("invalid token")
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+// audienceContains - aud is a string or a list of strings
+func audienceContains(aud json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == audience
+	}
+	var list []string
+	if json.Unmarshal(aud, &list) == nil {
+		for _, a := range list {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
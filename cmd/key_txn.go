@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+)
+
+// keyWriteError - a write rejected by one of the key / alias checks.
+// status is the http status to return, dupKey the offending key if any.
+type keyWriteError struct {
+	status int
+	dupKey string
+	msg    string
+}
+
+func (e *keyWriteError) Error() string {
+	return e.msg
+}
+
+// aliasIndexKey - the hidden entry that lists the aliases of a primary key.
+func aliasIndexKey(key []byte) []byte {
+	return append([]byte(ALIAS_INDEX_PREFIX), key...)
+}
+
+// getAliasIndex - the aliases recorded for the primary key, nil if none.
+func getAliasIndex(txn *badger.Txn, key []byte) ([]string, error) {
+	item, err := txn.Get(aliasIndexKey(key))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases []string
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &aliases)
+	})
+	return aliases, err
+}
+
+// setAliasIndex - records the aliases of the primary key, removes the entry if there are none.
+func setAliasIndex(txn *badger.Txn, key []byte, aliases []string, expiresAt uint64) error {
+	if len(aliases) == 0 {
+		return txn.Delete(aliasIndexKey(key))
+	}
+	data, err := json.Marshal(aliases)
+	if err != nil {
+		return err
+	}
+	e := badger.NewEntry(aliasIndexKey(key), data).WithMeta(BADGER_FLAG_ALIAS_INDEX)
+	e.ExpiresAt = expiresAt
+	return txn.SetEntry(e)
+}
+
+// readAliases - the aliases of the key after a write, nil if none.
+func readAliases(db *badger.DB, key []byte) []string {
+	var aliases []string
+	_ = db.View(func(txn *badger.Txn) error {
+		var err error
+		aliases, err = getAliasIndex(txn, key)
+		return err
+	})
+	return aliases
+}
+
+// aliasTarget - the primary key of an alias entry, nil if the key is not an alias.
+func aliasTarget(txn *badger.Txn, alias []byte) ([]byte, error) {
+	item, err := txn.Get(alias)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isAlias(item) {
+		return nil, nil
+	}
+	return item.ValueCopy(nil)
+}
+
+// aliasParent - the item of the key the alias points to, nil if it is gone
+func aliasParent(txn *badger.Txn, alias *badger.Item) (*badger.Item, error) {
+	target, err := alias.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := txn.Get(target)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	return parent, err
+}
+
+// setKeyTxn - writes the key and its aliases within the transaction.
+// Checks that the key is not an alias and that the aliases do not belong to
+// another key or overwrite a regular key.
+// If replaceAliases is true the aliases become the full set for the key and the
+// aliases no longer listed are deleted, otherwise they are added to the current set.
+func setKeyTxn(txn *badger.Txn, key []byte, value []byte, aliases []string, replaceAliases bool, expiresAt uint64) error {
+	existing, err := txn.Get(key)
+	if err == nil && isAlias(existing) {
+		return &keyWriteError{
+			status: http.StatusBadRequest,
+			dupKey: string(key),
+			msg:    "current key is an aliase, cannot update alias directly",
+		}
+	}
+
+	current, err := getAliasIndex(txn, key)
+	if err != nil {
+		return err
+	}
+
+	newSet := make([]string, 0, len(current)+len(aliases))
+	seen := make(map[string]bool)
+	if !replaceAliases {
+		for _, alias := range current {
+			seen[alias] = true
+			newSet = append(newSet, alias)
+		}
+	}
+	for _, alias := range aliases {
+		if len(alias) == 0 || seen[alias] {
+			continue
+		}
+		if !isKeyValid(alias) {
+			return &keyWriteError{status: http.StatusBadRequest, dupKey: alias, msg: "alias has bad characters"}
+		}
+		seen[alias] = true
+		newSet = append(newSet, alias)
+	}
+
+	// Drop the aliases that are no longer wanted
+	for _, alias := range current {
+		if seen[alias] {
+			continue
+		}
+		target, err := aliasTarget(txn, []byte(alias))
+		if err != nil {
+			return err
+		}
+		if string(target) == string(key) {
+			if err = txn.Delete([]byte(alias)); err != nil {
+				return err
+			}
+		}
+	}
+
+	e := badger.NewEntry(key, value).WithMeta(BADGER_FLAG_VALUE)
+	e.ExpiresAt = expiresAt
+	err = txn.SetEntry(e)
+	if err != nil {
+		return err
+	}
+
+	// Written again so they expire with the key
+	for _, alias := range newSet {
+		item, err := txn.Get([]byte(alias))
+		if err == nil {
+			if isAlias(item) {
+				currentAliasValue := ""
+				err = item.Value(func(val []byte) error {
+					currentAliasValue = string(val)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				if currentAliasValue != string(key) {
+					return &keyWriteError{status: http.StatusBadRequest, dupKey: alias, msg: "alias duplicate key"}
+				}
+			} else {
+				// Not an alias
+				return &keyWriteError{status: http.StatusBadRequest, dupKey: alias, msg: "alias tried to overrite regular key"}
+			}
+		}
+
+		e := badger.NewEntry([]byte(alias), key).WithMeta(BADGER_FLAG_ALIAS)
+		e.ExpiresAt = expiresAt
+		err = txn.SetEntry(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(newSet) == 0 && current == nil {
+		return nil
+	}
+	return setAliasIndex(txn, key, newSet, expiresAt)
+}
+
+// deleteKeyTxn - deletes the key within the transaction.
+// For a primary key its recorded aliases and the given aliases are deleted as well.
+// Deleting an alias removes it from the aliases of its primary key.
+// returns the aliases deleted with the key, the records deleted are one more.
+func deleteKeyTxn(txn *badger.Txn, key []byte, aliases []string) ([]string, error) {
+	target, err := aliasTarget(txn, key)
+	if err != nil {
+		return nil, err
+	}
+	if target != nil {
+		if err = deleteAliasTxn(txn, target, string(key)); err != nil {
+			return nil, err
+		}
+	}
+
+	err = txn.Delete(key)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+
+	current, err := getAliasIndex(txn, key)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, alias := range current {
+		if seen[alias] {
+			continue
+		}
+		seen[alias] = true
+
+		// Only if it was not taken over by another key
+		owner, err := aliasTarget(txn, []byte(alias))
+		if err != nil {
+			return nil, err
+		}
+		if string(owner) != string(key) {
+			continue
+		}
+		if err = txn.Delete([]byte(alias)); err != nil {
+			return nil, fmt.Errorf("error deleting alias %s: %w", alias, err)
+		}
+		deleted = append(deleted, alias)
+	}
+	if current != nil {
+		if err = txn.Delete(aliasIndexKey(key)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Aliases specified by the caller, keys written before the aliases were recorded
+	for _, alias := range aliases {
+		if len(alias) == 0 || seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		err = txn.Delete([]byte(alias))
+		if err != nil {
+			return nil, fmt.Errorf("error deleting alias %s: %w", alias, err)
+		}
+		deleted = append(deleted, alias)
+	}
+	return deleted, nil
+}
+
+// deleteAliasTxn - removes an alias from the recorded aliases of the primary key.
+func deleteAliasTxn(txn *badger.Txn, key []byte, alias string) error {
+	current, err := getAliasIndex(txn, key)
+	if err != nil || current == nil {
+		return err
+	}
+
+	remaining := make([]string, 0, len(current))
+	for _, a := range current {
+		if a != alias {
+			remaining = append(remaining, a)
+		}
+	}
+	if len(remaining) == len(current) {
+		return nil
+	}
+
+	var expiresAt uint64
+	if item, err := txn.Get(key); err == nil {
+		expiresAt = item.ExpiresAt()
+	}
+	return setAliasIndex(txn, key, remaining, expiresAt)
+}
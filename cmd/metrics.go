@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/samlotti/relKV/common"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets - upper bounds in seconds of the request latency histograms
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram - counts of observations per bucket, the last count is +Inf
+type histogram struct {
+	counts []uint64
+	sum    uint64 // float64 bits
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// requestMetrics - latency per route and request count per route and status code
+type requestMetrics struct {
+	lock      sync.Mutex
+	latencies map[string]*histogram // route
+	requests  map[[2]string]uint64  // route, code
+}
+
+var requestMetricsInstance = &requestMetrics{}
+
+// init - starts the counts again, called on server start with the stats
+func (m *requestMetrics) init() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.latencies = make(map[string]*histogram)
+	m.requests = make(map[[2]string]uint64)
+}
+
+func (m *requestMetrics) record(route string, code int, dur time.Duration) {
+	m.lock.Lock()
+	h, ok := m.latencies[route]
+	if !ok {
+		h = newHistogram()
+		m.latencies[route] = h
+	}
+	m.requests[[2]string{route, strconv.Itoa(code)}]++
+	m.lock.Unlock()
+
+	h.observe(dur.Seconds())
+}
+
+// statusWriter - keeps the status code and size of the response for the metrics and access log
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush - the watch stream flushes each event
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware - records the latency of each request by the route name
+func (m *requestMetrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		route := "other"
+		if current := mux.CurrentRoute(r); current != nil && len(current.GetName()) > 0 {
+			route = current.GetName()
+		}
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		m.record(route, sw.code, time.Since(start))
+	})
+}
+
+// metricsWriter - writes the prometheus text format
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (w *metricsWriter) header(name string, help string, typ string) {
+	w.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ))
+}
+
+// sample - labels are name, value pairs
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i] + "=\"" + escapeLabel(labels[i+1]) + "\"")
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// unixSeconds - 0 for a time not set
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+func scpStatusName(status common.ScpStatus) string {
+	switch status {
+	case common.ScpRunning:
+		return "running"
+	case common.ScpComplete:
+		return "complete"
+	case common.ScpError:
+		return "error"
+	}
+	return "pending"
+}
+
+// metrics - the stats in the prometheus text format, not secured like /status
+func (b *BucketsDb) metrics(writer http.ResponseWriter, request *http.Request) {
+	w := &metricsWriter{}
+
+	w.header("relkv_start_time_seconds", "Start time of the server in unix seconds.", "gauge")
+	w.sample("relkv_start_time_seconds", unixSeconds(StatsInstance.serverStart))
+
+	keys := StatsInstance.bucketNames()
+	counter := func(name string, help string, value func(s *BucketStats) int64) {
+		w.header(name, help, "counter")
+		for _, key := range keys {
+			w.sample(name, float64(value(StatsInstance.bucketStat(key))), "bucket", string(key))
+		}
+	}
+	gauge := func(name string, help string, value func(s *BucketStats) int64) {
+		w.header(name, help, "gauge")
+		for _, key := range keys {
+			w.sample(name, float64(value(StatsInstance.bucketStat(key))), "bucket", string(key))
+		}
+	}
+
+	counter("relkv_writes_total", "Keys written.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.numWrites) })
+	counter("relkv_deletes_total", "Keys deleted.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.numDelete) })
+	counter("relkv_write_errors_total", "Failed writes.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.numError) })
+	gauge("relkv_sequential_write_errors", "Failed writes in a row, reset by a successful write.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.seqWriteError) })
+	counter("relkv_gc_cycles_total", "Value log garbage collection cycles.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.numGC) })
+	counter("relkv_gc_no_rewrite_total", "Value log garbage collection cycles without a rewrite.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.numGCNR) })
+	gauge("relkv_orphan_aliases", "Orphaned aliases found by the last scan.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.numOrphans) })
+	counter("relkv_orphan_aliases_deleted_total", "Orphaned aliases deleted.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.numOrphansDeleted) })
+	gauge("relkv_orphan_last_scan_timestamp_seconds", "Last orphan scan in unix seconds, 0 = not scanned.", func(s *BucketStats) int64 { return atomic.LoadInt64(&s.lastOrphanScan) })
+
+	w.header("relkv_lsm_size_bytes", "Size of the LSM tree.", "gauge")
+	vlogs := &metricsWriter{}
+	for _, key := range keys {
+		db, err := b.getDB(string(key))
+		if err != nil {
+			continue
+		}
+		lsm, vlog := db.Size()
+		w.sample("relkv_lsm_size_bytes", float64(lsm), "bucket", string(key))
+		vlogs.sample("relkv_vlog_size_bytes", float64(vlog), "bucket", string(key))
+	}
+	w.header("relkv_vlog_size_bytes", "Size of the value log.", "gauge")
+	w.Write(vlogs.Bytes())
+
+	w.header("relkv_backup_last_start_timestamp_seconds", "Start of the last backup in unix seconds.", "gauge")
+	success := &metricsWriter{}
+	for _, key := range keys {
+		bstat := StatsInstance.Backup(key)
+		if bstat == nil {
+			continue
+		}
+		lastStart := 0.0
+		if bstat.LastStart != StatsInstance.serverStart {
+			lastStart = unixSeconds(bstat.LastStart)
+		}
+		w.sample("relkv_backup_last_start_timestamp_seconds", lastStart, "bucket", string(key))
+		success.sample("relkv_backup_last_success_timestamp_seconds", unixSeconds(bstat.LastSuccess), "bucket", string(key))
+	}
+	w.header("relkv_backup_last_success_timestamp_seconds", "End of the last successful backup in unix seconds, 0 = none.", "gauge")
+	w.Write(success.Bytes())
+
+	w.header("relkv_scp_jobs", "Scp jobs to the remote by bucket and state.", "gauge")
+	jobs := make(map[[2]string]int)
+	for _, job := range b.Jobs {
+		jobs[[2]string{string(job.BucketName), scpStatusName(job.Status)}]++
+	}
+	jobKeys := make([][2]string, 0, len(jobs))
+	for k := range jobs {
+		jobKeys = append(jobKeys, k)
+	}
+	sort.Slice(jobKeys, func(i, j int) bool {
+		return jobKeys[i][0] < jobKeys[j][0] || (jobKeys[i][0] == jobKeys[j][0] && jobKeys[i][1] < jobKeys[j][1])
+	})
+	for _, k := range jobKeys {
+		w.sample("relkv_scp_jobs", float64(jobs[k]), "bucket", k[0], "state", k[1])
+	}
+
+	w.header("relkv_throttled_requests_total", "Requests refused with 429 by scope (token or bucket), name and reason (rate or inflight).", "counter")
+	for _, stat := range StatsInstance.throttleStats() {
+		w.sample("relkv_throttled_requests_total", float64(stat.Count), "scope", stat.Scope, "name", stat.Name, "reason", stat.Reason)
+	}
+
+	requestMetricsInstance.write(w)
+
+	writer.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(w.Bytes())
+}
+
+// write - the request counts and latency histograms
+func (m *requestMetrics) write(w *metricsWriter) {
+	m.lock.Lock()
+	requests := make([][2]string, 0, len(m.requests))
+	counts := make(map[[2]string]uint64)
+	for k, v := range m.requests {
+		requests = append(requests, k)
+		counts[k] = v
+	}
+	routes := make([]string, 0, len(m.latencies))
+	latencies := make(map[string]*histogram)
+	for route, h := range m.latencies {
+		routes = append(routes, route)
+		latencies[route] = h
+	}
+	m.lock.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i][0] < requests[j][0] || (requests[i][0] == requests[j][0] && requests[i][1] < requests[j][1])
+	})
+	sort.Strings(routes)
+
+	w.header("relkv_http_requests_total", "Http requests by route and status code.", "counter")
+	for _, k := range requests {
+		w.sample("relkv_http_requests_total", float64(counts[k]), "route", k[0], "code", k[1])
+	}
+
+	name := "relkv_http_request_duration_seconds"
+	w.header(name, "Http request latency by route.", "histogram")
+	for _, route := range routes {
+		h := latencies[route]
+		cumulative := uint64(0)
+		for i, le := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			w.sample(name+"_bucket", float64(cumulative), "route", route, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(latencyBuckets)])
+		w.sample(name+"_bucket", float64(cumulative), "route", route, "le", "+Inf")
+		w.sample(name+"_sum", math.Float64frombits(atomic.LoadUint64(&h.sum)), "route", route)
+		w.sample(name+"_count", float64(cumulative), "route", route)
+	}
+}
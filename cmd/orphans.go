@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// maxOrphanReportKeys - limit of keys listed in the report, the counts are always complete
+const maxOrphanReportKeys = 1000
+
+// orphanDeleteChunk - number of aliases deleted per transaction
+const orphanDeleteChunk = 1000
+
+// findOrphans - scans the bucket for aliases that point to a missing key.
+// If remove is true they are deleted.
+func findOrphans(bucket string, db *badger.DB, remove bool) (*OrphanReport, error) {
+	report := &OrphanReport{Bucket: bucket, Keys: make([]string, 0)}
+	var orphans [][]byte
+
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if !isAlias(item) {
+				continue
+			}
+			report.Scanned++
+
+			target, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			_, err = txn.Get(target)
+			if err == nil {
+				continue
+			}
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			report.Orphans++
+			if len(report.Keys) < maxOrphanReportKeys {
+				report.Keys = append(report.Keys, string(item.Key()))
+			}
+			if remove {
+				orphans = append(orphans, item.KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for len(orphans) > 0 {
+		n := orphanDeleteChunk
+		if n > len(orphans) {
+			n = len(orphans)
+		}
+		deleted, err := deleteOrphans(db, orphans[:n])
+		report.Deleted += deleted
+		if err != nil {
+			return report, err
+		}
+		orphans = orphans[n:]
+	}
+
+	return report, nil
+}
+
+// deleteOrphans - deletes the aliases if they are still orphaned, returns the number deleted.
+// The key may have been written again since the scan.
+func deleteOrphans(db *badger.DB, aliases [][]byte) (int, error) {
+	deleted := 0
+	err := db.Update(func(txn *badger.Txn) error {
+		for _, alias := range aliases {
+			target, err := aliasTarget(txn, alias)
+			if err != nil {
+				return err
+			}
+			if target == nil {
+				continue
+			}
+			if _, err = txn.Get(target); err != badger.ErrKeyNotFound {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err = txn.Delete(alias); err != nil {
+				return err
+			}
+			// an alias list left behind would bring the alias back if the key is written again
+			if err = txn.Delete(aliasIndexKey(target)); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// sweepOrphans - runs findOrphans for the bucket and records the result in the stats
+func (b *BucketsDb) sweepOrphans(bucket BucketName, db *badger.DB, remove bool) (*OrphanReport, error) {
+	report, err := findOrphans(string(bucket), db, remove)
+
+	bstat := StatsInstance.bucketStat(bucket)
+	atomic.StoreInt64(&bstat.numOrphans, int64(report.Orphans-report.Deleted))
+	atomic.AddInt64(&bstat.numOrphansDeleted, int64(report.Deleted))
+	atomic.StoreInt64(&bstat.lastOrphanScan, time.Now().Unix())
+
+	if err != nil {
+		b.logger.Errorf("orphan scan of %s failed:%s", bucket, err)
+	} else if report.Orphans > 0 {
+		b.logger.Infof("orphan scan of %s found:%d deleted:%d", bucket, report.Orphans, report.Deleted)
+	}
+	return report, err
+}
+
+// runOrphanSweep - scans the buckets for orphaned aliases every ORPHAN_SWEEP_MINUTES.
+// They are only deleted if ORPHAN_SWEEP_DELETE is set, otherwise they are counted.
+func (b *BucketsDb) runOrphanSweep() {
+	minutes := EnvironmentInstance.GetInt("ORPHAN_SWEEP_MINUTES", 60)
+	if minutes <= 0 {
+		log.Println("orphan sweep disabled, ORPHAN_SWEEP_MINUTES is 0")
+		return
+	}
+	remove := EnvironmentInstance.GetBoolEnv("ORPHAN_SWEEP_DELETE")
+
+	for {
+		time.Sleep(time.Duration(minutes) * time.Minute)
+		if b.ServerState == Stopped {
+			return
+		}
+
+		for name, db := range b.OpenBuckets() {
+			b.sweepOrphans(name, db, remove)
+		}
+	}
+}
+
+// orphans - admin endpoint to scan a bucket for orphaned aliases.
+// GET reports them, DELETE removes them.
+func (b *BucketsDb) orphans(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	bucket := vars["bucket"]
+
+	writer.Header().Set(RESP_HEADER_RELDB_FUNCTION, "orphans")
+
+	db, err := b.getDB(bucket)
+	if err != nil {
+		sendBucketError(writer, err)
+		return
+	}
+
+	report, err := b.sweepOrphans(BucketName(bucket), db, request.Method == http.MethodDelete)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("content-type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(data)
+}
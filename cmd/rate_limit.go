@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	. "github.com/samlotti/relKV/common"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Scopes and reasons of the throttle counts
+const (
+	throttleScopeToken     = "token"
+	throttleScopeBucket    = "bucket"
+	throttleReasonRate     = "rate"
+	throttleReasonInFlight = "inflight"
+
+	// the names counted for the callers not authenticated and the buckets not open,
+	// keeps the stats and metrics from growing with each address or name
+	throttleNameAnonymous = "anonymous"
+	throttleNameUnknown   = "unknown"
+)
+
+// limitState - the token bucket and requests in progress of one token or bucket
+type limitState struct {
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+// limiter - a token bucket refilled at rate per second up to burst, and a maximum of requests in progress.
+// A rate or maxInFlight of 0 is no limit.
+type limiter struct {
+	scope       string
+	rate        float64
+	burst       float64
+	maxInFlight int
+
+	lock      sync.Mutex
+	states    map[string]*limitState
+	lastSweep time.Time
+}
+
+// newLimiter - nil if there is no limit, the burst defaults to one second of requests
+func newLimiter(scope string, rate float64, burst int, maxInFlight int) (*limiter, error) {
+	if rate < 0 || burst < 0 || maxInFlight < 0 {
+		return nil, fmt.Errorf("invalid %s limit, the values cannot be negative", scope)
+	}
+	if rate == 0 && maxInFlight == 0 {
+		return nil, nil
+	}
+	l := &limiter{scope: scope, rate: rate, burst: float64(burst), maxInFlight: maxInFlight, states: make(map[string]*limitState)}
+	if l.burst == 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	return l, nil
+}
+
+// acquire - takes a token and an in flight slot, when refused returns the reason and the time to wait.
+// release must be called when the request is done if acquired.
+func (l *limiter) acquire(key string, now time.Time) (string, time.Duration) {
+	return l.take(key, now, true)
+}
+
+// acquireStream - takes a token only, a stream is open for long and does not hold an in flight slot.
+// Nothing to release.
+func (l *limiter) acquireStream(key string, now time.Time) (string, time.Duration) {
+	return l.take(key, now, false)
+}
+
+func (l *limiter) take(key string, now time.Time, hold bool) (string, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.sweep(now)
+
+	state, ok := l.states[key]
+	if !ok {
+		state = &limitState{tokens: l.burst, last: now}
+		l.states[key] = state
+	}
+
+	if hold && l.maxInFlight > 0 && state.inFlight >= l.maxInFlight {
+		return throttleReasonInFlight, time.Second
+	}
+
+	if l.rate > 0 {
+		state.tokens = math.Min(l.burst, state.tokens+now.Sub(state.last).Seconds()*l.rate)
+		state.last = now
+		if state.tokens < 1 {
+			return throttleReasonRate, time.Duration((1 - state.tokens) / l.rate * float64(time.Second))
+		}
+		state.tokens--
+	}
+	if hold {
+		state.inFlight++
+	}
+	return "", 0
+}
+
+// refillPeriod - the time to refill an empty token bucket
+func (l *limiter) refillPeriod() time.Duration {
+	return time.Duration(l.burst / l.rate * float64(time.Second))
+}
+
+// sweep - once per refill period removes the states idle for longer, they are full again.
+// Keeps the states of the addresses and tokens seen once from staying forever.
+func (l *limiter) sweep(now time.Time) {
+	if l.rate == 0 {
+		return
+	}
+	period := l.refillPeriod()
+	if now.Sub(l.lastSweep) < period {
+		return
+	}
+	l.lastSweep = now
+	for key, state := range l.states {
+		if state.inFlight == 0 && now.Sub(state.last) >= period {
+			delete(l.states, key)
+		}
+	}
+}
+
+// release - the request is done, refund gives the token back when the request was not run
+func (l *limiter) release(key string, refund bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	state, ok := l.states[key]
+	if !ok {
+		return
+	}
+	state.inFlight--
+	if refund && l.rate > 0 {
+		state.tokens = math.Min(l.burst, state.tokens+1)
+	}
+	// full and idle, no need to keep it
+	if state.inFlight == 0 && (l.rate == 0 || state.tokens >= l.burst) {
+		delete(l.states, key)
+	}
+}
+
+// refund - gives back the token of a stream that was not run
+func (l *limiter) refund(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if state, ok := l.states[key]; ok && l.rate > 0 {
+		state.tokens = math.Min(l.burst, state.tokens+1)
+	}
+}
+
+// throttle - the limits per token and per bucket applied to the data routes
+type throttle struct {
+	token  *limiter
+	bucket *limiter
+}
+
+// newThrottleFromEnv - nil if no limit is configured.
+//
+//	RATE_LIMIT_TOKEN, RATE_LIMIT_BUCKET <- requests per second
+//	RATE_BURST_TOKEN, RATE_BURST_BUCKET <- requests allowed at once above the rate
+//	MAX_INFLIGHT_TOKEN, MAX_INFLIGHT_BUCKET <- requests in progress
+func newThrottleFromEnv() (*throttle, error) {
+	token, err := newLimiter(throttleScopeToken,
+		EnvironmentInstance.GetFloat("RATE_LIMIT_TOKEN", 0),
+		EnvironmentInstance.GetInt("RATE_BURST_TOKEN", 0),
+		EnvironmentInstance.GetInt("MAX_INFLIGHT_TOKEN", 0))
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := newLimiter(throttleScopeBucket,
+		EnvironmentInstance.GetFloat("RATE_LIMIT_BUCKET", 0),
+		EnvironmentInstance.GetInt("RATE_BURST_BUCKET", 0),
+		EnvironmentInstance.GetInt("MAX_INFLIGHT_BUCKET", 0))
+	if err != nil {
+		return nil, err
+	}
+	if token == nil && bucket == nil {
+		return nil, nil
+	}
+	return &throttle{token: token, bucket: bucket}, nil
+}
+
+// tokenKey - the name of the token, the client address if not authenticated
+func tokenKey(r *http.Request) string {
+	if id := getIdentity(r); id != nil {
+		return id.name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// bucketKey - the bucket name if open, the buckets not open share one limit
+func bucketKey(bucket string) string {
+	if _, err := BucketsInstance.getDB(bucket); err != nil {
+		return throttleNameUnknown
+	}
+	return bucket
+}
+
+// throttleStatNames - the token and bucket names the refused request is counted under
+func throttleStatNames(r *http.Request, bucket string) (string, string) {
+	token := throttleNameAnonymous
+	if id := getIdentity(r); id != nil {
+		token = id.name
+	}
+	return token, bucketKey(bucket)
+}
+
+// throttleMiddleware - applies the limits in use, runs after the auth middleware
+func (b *BucketsDb) throttleMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limits := b.runtime().limits; limits != nil {
+			limits.Middleware(next).ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware - 429 with Retry-After when a limit is reached.
+// The watch streams are only rate limited, they would hold an in flight slot for as long as open.
+func (t *throttle) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		tkey := tokenKey(r)
+		bucket := mux.Vars(r)["bucket"]
+		stream := false
+		if route := mux.CurrentRoute(r); route != nil {
+			stream = route.GetName() == "watch"
+		}
+		acquire := func(l *limiter, key string) (string, time.Duration) {
+			if stream {
+				return l.acquireStream(key, now)
+			}
+			return l.acquire(key, now)
+		}
+		release := func(l *limiter, key string, refund bool) {
+			if stream {
+				if refund {
+					l.refund(key)
+				}
+				return
+			}
+			l.release(key, refund)
+		}
+
+		if t.token != nil {
+			if reason, wait := acquire(t.token, tkey); len(reason) > 0 {
+				name, _ := throttleStatNames(r, bucket)
+				StatsInstance.addThrottled(throttleScopeToken, name, reason)
+				sendThrottled(w, fmt.Sprintf("too many requests for %s", tkey), wait)
+				return
+			}
+		}
+		if t.bucket != nil && len(bucket) > 0 {
+			bkey := bucketKey(bucket)
+			if reason, wait := acquire(t.bucket, bkey); len(reason) > 0 {
+				if t.token != nil {
+					release(t.token, tkey, true)
+				}
+				StatsInstance.addThrottled(throttleScopeBucket, bkey, reason)
+				sendThrottled(w, fmt.Sprintf("too many requests for bucket %s", bucket), wait)
+				return
+			}
+			defer release(t.bucket, bkey, false)
+		}
+		if t.token != nil {
+			defer release(t.token, tkey, false)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sendThrottled - Retry-After is in whole seconds, at least 1
+func sendThrottled(w http.ResponseWriter, msg string, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set(RESP_HEADER_RETRY_AFTER, strconv.Itoa(secs))
+	SendError(w, msg, http.StatusTooManyRequests)
+}
@@ -0,0 +1,384 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	. "github.com/samlotti/relKV/common"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reload triggers
+const (
+	reloadTriggerSignal = "sighup"
+	reloadTriggerFile   = "file"
+)
+
+// reloadKeys - the settings applied by a reload
+var reloadKeys = []string{
+	"LOG_LEVEL",
+	"SECRET", "ACL_FILE", "AUTH_MODE", "AUTH_SKEW_SECONDS",
+	"JWT_HMAC_SECRET", "JWT_PUBLIC_KEY", "JWT_CLAIM", "JWT_ISSUER", "JWT_AUDIENCE", "JWT_LEEWAY_SECONDS",
+	"BK_HOURS",
+	"BK_SCP_HOST", "BK_SCP_DIR", "BK_SCP_UNAME", "BK_SCP_UPWD", "BK_SCP_PATH_TO_KEY", "BK_SCP_SUFFIX_DAY", "BK_SCP_SUFFIX_HOUR", "BK_ZIP",
+	"RATE_LIMIT_TOKEN", "RATE_BURST_TOKEN", "MAX_INFLIGHT_TOKEN", "RATE_LIMIT_BUCKET", "RATE_BURST_BUCKET", "MAX_INFLIGHT_BUCKET",
+	"SCAN_TIMEOUT_SECONDS", "SCAN_TIMEOUT_MAX_SECONDS",
+	"STATUS_FAILING",
+}
+
+// restartKeys - the settings only read at the start, a change is reported by the reload
+var restartKeys = []string{
+	"HTTP_HOST", "DB_PATH", "BUCKETS", "ALLOW_CREATE_DB", "NOBACKUP", "BK_PATH", "BLOOM_FALSE_PERCENTAGE",
+	"LOG_FILE", "ACCESS_LOG", "AUDIT_LOG", "CMD_UNIX_SOCKET", "CONFIG_WATCH",
+	"TLS_CERT", "TLS_KEY", "TLS_CLIENT_CA",
+}
+
+// reloadValueKinds - checked before the reload, reading a bad value would stop the server
+var reloadValueKinds = map[string]string{
+	"LOG_LEVEL":                "level",
+	"AUTH_SKEW_SECONDS":        "int",
+	"JWT_LEEWAY_SECONDS":       "int",
+	"BK_HOURS":                 "ints",
+	"BK_SCP_SUFFIX_DAY":        "bool",
+	"BK_SCP_SUFFIX_HOUR":       "bool",
+	"BK_ZIP":                   "bool",
+	"RATE_LIMIT_TOKEN":         "float",
+	"RATE_BURST_TOKEN":         "int",
+	"MAX_INFLIGHT_TOKEN":       "int",
+	"RATE_LIMIT_BUCKET":        "float",
+	"RATE_BURST_BUCKET":        "int",
+	"MAX_INFLIGHT_BUCKET":      "int",
+	"SCAN_TIMEOUT_SECONDS":     "int",
+	"SCAN_TIMEOUT_MAX_SECONDS": "int",
+}
+
+// runtimeConfig - the settings used by the requests that can change on a reload
+type runtimeConfig struct {
+	logLevel      loggingLevel
+	auth          *AuthSecret // nil = no authentication
+	limits        *throttle   // nil = no limits
+	scanTimeouts  *scanTimeouts
+	statusFailing map[string]bool
+}
+
+var reloadHooksLock sync.Mutex
+var reloadHooks []func()
+
+// AddReloadHook - fn is called after a successful reload to read its settings again,
+// the values of reloadValueKinds are already checked.
+func AddReloadHook(fn func()) {
+	reloadHooksLock.Lock()
+	defer reloadHooksLock.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+}
+
+// loadRuntimeConfig - reads the settings, nothing is changed on an error
+func loadRuntimeConfig() (*runtimeConfig, error) {
+	cfg := &runtimeConfig{}
+
+	level := EnvironmentInstance.GetEnv("LOG_LEVEL", "INFO")
+	if err := checkValue("LOG_LEVEL", "level", level); err != nil {
+		return nil, err
+	}
+	cfg.logLevel = convertLogLevel(level)
+
+	var err error
+	if cfg.statusFailing, err = loadStatusFailing(); err != nil {
+		return nil, err
+	}
+	if cfg.scanTimeouts, err = loadScanTimeouts(); err != nil {
+		return nil, err
+	}
+	if cfg.limits, err = newThrottleFromEnv(); err != nil {
+		return nil, err
+	}
+
+	secret, ok := EnvironmentInstance.LookupEnv("SECRET")
+	if !ok || len(secret) <= 5 {
+		secret = ""
+	}
+	aclFile := EnvironmentInstance.GetEnv("ACL_FILE", "")
+	jwt, err := newJWTVerifierFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) > 0 || len(aclFile) > 0 || jwt != nil {
+		auth := NewAuthSecret(secret)
+		auth.SetJWT(jwt)
+		mode := EnvironmentInstance.GetEnv("AUTH_MODE", authModeToken)
+		skew := time.Duration(EnvironmentInstance.GetInt("AUTH_SKEW_SECONDS", 300)) * time.Second
+		if err := auth.SetMode(mode, skew); err != nil {
+			return nil, err
+		}
+		if len(aclFile) > 0 {
+			if err := auth.LoadACL(aclFile); err != nil {
+				return nil, err
+			}
+		}
+		cfg.auth = auth
+	}
+	return cfg, nil
+}
+
+// runtime - the settings in use
+func (b *BucketsDb) runtime() *runtimeConfig {
+	b.configLock.RLock()
+	defer b.configLock.RUnlock()
+	return &runtimeConfig{
+		logLevel:      b.logger.getLevel(),
+		auth:          b.authsecret,
+		limits:        b.limits,
+		scanTimeouts:  b.scanTimeouts,
+		statusFailing: b.statusFailing,
+	}
+}
+
+// applyConfig - the next requests use the settings, the used nonces are kept
+func (b *BucketsDb) applyConfig(cfg *runtimeConfig) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	if b.authsecret != nil && cfg.auth != nil {
+		cfg.auth.keepNonces(b.authsecret)
+	}
+	b.authsecret = cfg.auth
+	b.limits = cfg.limits
+	b.scanTimeouts = cfg.scanTimeouts
+	b.statusFailing = cfg.statusFailing
+	if b.logger != nil {
+		b.logger.SetLevel(cfg.logLevel)
+	}
+}
+
+// checkValues - the values of reloadValueKinds and NOBACKUP, the ints are required when backups are enabled
+func checkValues(values map[string]string) error {
+	nobackup := strings.TrimSpace(values["NOBACKUP"])
+	if len(nobackup) == 0 {
+		nobackup = "f"
+	}
+	noBackup, err := strconv.ParseBool(nobackup)
+	if err != nil {
+		return fmt.Errorf("invalid value for NOBACKUP found %s", nobackup)
+	}
+
+	for key, kind := range reloadValueKinds {
+		val := values[key]
+		if kind == "ints" && !noBackup && len(strings.TrimSpace(val)) == 0 {
+			return fmt.Errorf("%s not defined in Environment", key)
+		}
+		if err := checkValue(key, kind, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkValue - the same parsing as the Environment getters, without stopping the server
+func checkValue(key string, kind string, val string) error {
+	val = strings.TrimSpace(val)
+	if len(val) == 0 {
+		return nil
+	}
+	var err error
+	switch kind {
+	case "int":
+		_, err = strconv.Atoi(val)
+	case "float":
+		_, err = strconv.ParseFloat(val, 64)
+	case "bool":
+		_, err = strconv.ParseBool(val)
+	case "ints":
+		for _, part := range strings.Split(val, ",") {
+			if _, err = strconv.Atoi(strings.TrimSpace(part)); err != nil {
+				break
+			}
+		}
+	case "level":
+		switch val {
+		case "DEBUG", "INFO", "WARNING", "WARN", "ERROR":
+		default:
+			err = errors.New("expected DEBUG, INFO, WARNING or ERROR")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for %s found %s", key, val)
+	}
+	return nil
+}
+
+// snapshotConfig - the values of the settings to find the changes on a reload
+func snapshotConfig() map[string]string {
+	values := make(map[string]string)
+	for _, key := range append(append([]string{}, reloadKeys...), restartKeys...) {
+		values[key] = EnvironmentInstance.GetEnv(key, "")
+	}
+	return values
+}
+
+// changedKeys - the keys with a different value, in the order of keys
+func changedKeys(keys []string, before map[string]string, after map[string]string) []string {
+	var changed []string
+	for _, key := range keys {
+		if before[key] != after[key] {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// reloadConfig - reads the .env file again and applies the settings that can change at runtime.
+// On an error the settings in use are kept.
+func (b *BucketsDb) reloadConfig(trigger string) *ReloadStatus {
+	b.reloadLock.Lock()
+	defer b.reloadLock.Unlock()
+
+	status := &ReloadStatus{Time: time.Now(), Trigger: trigger}
+	err := b.doReload(status)
+	if err != nil {
+		status.Error = err.Error()
+		b.logger.Errorf("config not reloaded (%s), %s", trigger, err)
+	} else {
+		status.Ok = true
+		b.logger.Infof("config reloaded (%s), applied: %s, restart required: %s", trigger,
+			strings.Join(status.Applied, ","), strings.Join(status.RestartRequired, ","))
+	}
+
+	b.configLock.Lock()
+	b.lastReload = status
+	b.configLock.Unlock()
+	return status
+}
+
+func (b *BucketsDb) doReload(status *ReloadStatus) error {
+	if len(EnvironmentInstance.envFile) > 0 {
+		if err := EnvReload(); err != nil {
+			return err
+		}
+	}
+	checked := map[string]string{"NOBACKUP": EnvironmentInstance.GetEnv("NOBACKUP", "")}
+	for key := range reloadValueKinds {
+		checked[key] = EnvironmentInstance.GetEnv(key, "")
+	}
+	if err := checkValues(checked); err != nil {
+		return err
+	}
+
+	cfg, err := loadRuntimeConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.auth == nil && b.runtime().auth != nil {
+		return errors.New("authentication cannot be turned off by a reload, restart required")
+	}
+
+	if b.certs != nil {
+		if err := b.certs.reload(); err != nil {
+			return err
+		}
+	}
+
+	values := snapshotConfig()
+	status.Applied = changedKeys(reloadKeys, b.configValues, values)
+	status.RestartRequired = changedKeys(restartKeys, b.configValues, values)
+
+	b.applyConfig(cfg)
+
+	reloadHooksLock.Lock()
+	hooks := append([]func(){}, reloadHooks...)
+	reloadHooksLock.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	// restart keys are compared to the values at the start
+	for _, key := range reloadKeys {
+		b.configValues[key] = values[key]
+	}
+	return nil
+}
+
+// lastReloadStatus - nil if not reloaded since the start
+func (b *BucketsDb) lastReloadStatus() *ReloadStatus {
+	b.configLock.RLock()
+	defer b.configLock.RUnlock()
+	return b.lastReload
+}
+
+// watchConfig - reloads on SIGHUP, and when the .env file changes if CONFIG_WATCH=1, until the context is done
+func (b *BucketsDb) watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var fileEvents chan fsnotify.Event
+	if EnvironmentInstance.GetBoolEnv("CONFIG_WATCH") && len(EnvironmentInstance.envFile) > 0 {
+		events, err := watchFile(ctx, EnvironmentInstance.envFile)
+		if err != nil {
+			b.logger.Errorf("CONFIG_WATCH: %s", err)
+		}
+		fileEvents = events
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				b.reloadConfig(reloadTriggerSignal)
+			case <-fileEvents:
+				b.reloadConfig(reloadTriggerFile)
+			}
+		}
+	}()
+}
+
+// watchFile - the changes of the file until the context is done.
+// The directory is watched, editors often replace the file.
+func watchFile(ctx context.Context, file string) (chan fsnotify.Event, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	events := make(chan fsnotify.Event, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != file || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				select {
+				case events <- event:
+				default:
+					// a reload is already waiting
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/dgraph-io/badger/v3"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+)
+
+// keyRange - the selection of keys for a scan
+//
+//	prefix <- limit to prefixes
+//	start, end <- key range, start is inclusive and end exclusive by default
+//	start_ex=1 <- start is exclusive
+//	end_in=1 <- end is inclusive
+//	reverse=1 <- iterate from the end of the range
+//	segments <- :segments: in keyportion
+type keyRange struct {
+	prefix         []byte
+	start          []byte
+	startExclusive bool
+	end            []byte
+	endInclusive   bool
+	reverse        bool
+	segments       []string
+}
+
+// scanCursor - the state needed to continue a scan after the last returned key
+type scanCursor struct {
+	LastKey        []byte   `json:"k"`
+	Prefix         []byte   `json:"p,omitempty"`
+	Start          []byte   `json:"s,omitempty"`
+	StartExclusive bool     `json:"sx,omitempty"`
+	End            []byte   `json:"e,omitempty"`
+	EndInclusive   bool     `json:"ei,omitempty"`
+	Reverse        bool     `json:"r,omitempty"`
+	Segments       []string `json:"sg,omitempty"`
+}
+
+// newKeyRange - the range from the request options, or from the cursor if one is given.
+func newKeyRange(r *http.Request) (*keyRange, error) {
+	if cursor := getHeaderKey(HEADER_CURSOR_KEY, r); cursor != "" {
+		return keyRangeFromCursor(cursor)
+	}
+
+	k := &keyRange{
+		startExclusive: getHeaderKeyBool(HEADER_START_EXCLUSIVE_KEY, r),
+		endInclusive:   getHeaderKeyBool(HEADER_END_INCLUSIVE_KEY, r),
+		reverse:        getHeaderKeyBool(HEADER_REVERSE_KEY, r),
+		segments:       getSegments(getHeaderKey(HEADER_SEGMENT_KEY, r)),
+	}
+	if prefix := getHeaderKey(HEADER_PREFIX_KEY, r); prefix != "" {
+		k.prefix = []byte(prefix)
+	}
+	if start := getHeaderKey(HEADER_START_KEY, r); start != "" {
+		k.start = []byte(start)
+	}
+	if end := getHeaderKey(HEADER_END_KEY, r); end != "" {
+		k.end = []byte(end)
+	}
+	return k, nil
+}
+
+// cursor - an opaque token to continue the scan after lastKey
+func (k *keyRange) cursor(lastKey []byte) string {
+	data, _ := json.Marshal(&scanCursor{
+		LastKey:        lastKey,
+		Prefix:         k.prefix,
+		Start:          k.start,
+		StartExclusive: k.startExclusive,
+		End:            k.end,
+		EndInclusive:   k.endInclusive,
+		Reverse:        k.reverse,
+		Segments:       k.segments,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// keyRangeFromCursor - restores the range of the original request, moved past the last key.
+func keyRangeFromCursor(cursor string) (*keyRange, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	c := &scanCursor{}
+	if err = json.Unmarshal(data, c); err != nil || len(c.LastKey) == 0 {
+		return nil, errors.New("invalid cursor")
+	}
+
+	k := &keyRange{
+		prefix:         c.Prefix,
+		start:          c.Start,
+		startExclusive: c.StartExclusive,
+		end:            c.End,
+		endInclusive:   c.EndInclusive,
+		reverse:        c.Reverse,
+		segments:       c.Segments,
+	}
+	if !k.reverse {
+		k.start = c.LastKey
+		k.startExclusive = true
+	} else {
+		k.end = c.LastKey
+		k.endInclusive = false
+	}
+	return k, nil
+}
+
+// hasSelection - false if the range is the whole bucket
+func (k *keyRange) hasSelection() bool {
+	return len(k.prefix) > 0 || k.start != nil || k.end != nil || k.segments != nil
+}
+
+func (k *keyRange) iteratorOptions(values bool) badger.IteratorOptions {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = values
+	opts.Reverse = k.reverse
+	// reverse seeks past the prefix, the keys after it are skipped by check
+	if !k.reverse {
+		opts.Prefix = k.prefix
+	}
+	return opts
+}
+
+// seekKey - where the iterator is positioned first.
+// Reverse iteration seeks to the largest key <= seekKey, nil is the last key.
+func (k *keyRange) seekKey() []byte {
+	if !k.reverse {
+		seek := k.prefix
+		if k.start != nil && bytes.Compare(k.start, seek) > 0 {
+			seek = k.start
+		}
+		return seek
+	}
+
+	var seek []byte
+	if len(k.prefix) > 0 {
+		// past all keys with the prefix, nil if there is no key after them
+		seek = prefixSuccessor(k.prefix)
+	}
+	if k.end != nil && (seek == nil || bytes.Compare(k.end, seek) < 0) {
+		seek = k.end
+	}
+	return seek
+}
+
+// prefixSuccessor - the first key after all the keys with the prefix, nil if the prefix is all 0xFF
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xFF {
+			next := append([]byte{}, prefix[:i+1]...)
+			next[i]++
+			return next
+		}
+	}
+	return nil
+}
+
+// check - is the key from the iterator in the range.
+// done is true once the iterator has moved past the range.
+func (k *keyRange) check(key []byte) (selected bool, done bool) {
+	if len(k.prefix) > 0 && !bytes.HasPrefix(key, k.prefix) {
+		// reverse starts at the key after the prefix
+		if k.reverse && bytes.Compare(key, k.prefix) > 0 {
+			return false, false
+		}
+		return false, true
+	}
+
+	afterEnd := false
+	if k.end != nil {
+		c := bytes.Compare(key, k.end)
+		afterEnd = c > 0 || (c == 0 && !k.endInclusive)
+	}
+	beforeStart := false
+	if k.start != nil {
+		c := bytes.Compare(key, k.start)
+		beforeStart = c < 0 || (c == 0 && k.startExclusive)
+	}
+
+	if !k.reverse {
+		if afterEnd {
+			return false, true
+		}
+		if beforeStart {
+			return false, false
+		}
+	} else {
+		if beforeStart {
+			return false, true
+		}
+		if afterEnd {
+			return false, false
+		}
+	}
+
+	if k.segments != nil && !segmentMatch(string(key), k.segments) {
+		return false, false
+	}
+	return true, false
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// scanTimeouts - the max duration of a scan, the timeout header can change it up to max.
+// 0 = no limit
+type scanTimeouts struct {
+	dflt time.Duration
+	max  time.Duration
+}
+
+// loadScanTimeouts - SCAN_TIMEOUT_SECONDS (default 0, opt-in) and SCAN_TIMEOUT_MAX_SECONDS (default 300)
+func loadScanTimeouts() (*scanTimeouts, error) {
+	dflt := EnvironmentInstance.GetInt("SCAN_TIMEOUT_SECONDS", 0)
+	max := EnvironmentInstance.GetInt("SCAN_TIMEOUT_MAX_SECONDS", 300)
+	if dflt < 0 || max < 0 {
+		return nil, errors.New("invalid SCAN_TIMEOUT_SECONDS or SCAN_TIMEOUT_MAX_SECONDS, cannot be negative")
+	}
+	t := &scanTimeouts{dflt: time.Duration(dflt) * time.Second, max: time.Duration(max) * time.Second}
+	if t.max > 0 && t.dflt > t.max {
+		t.dflt = t.max
+	}
+	return t, nil
+}
+
+// timeout - the duration for the request, the timeout header in seconds is capped to the max
+func (t *scanTimeouts) timeout(r *http.Request) (time.Duration, error) {
+	val := getHeaderKey(HEADER_TIMEOUT_KEY, r)
+	if len(val) == 0 {
+		return t.dflt, nil
+	}
+	secs, err := strconv.Atoi(val)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("invalid value for %s, expected seconds > 0 found: %s", HEADER_TIMEOUT_KEY, val)
+	}
+	timeout := time.Duration(secs) * time.Second
+	if t.max > 0 && timeout > t.max {
+		timeout = t.max
+	}
+	return timeout, nil
+}
+
+// scanTimeout - the timeout of a scan of the request, 0 = no limit
+func (b *BucketsDb) scanTimeout(r *http.Request) (time.Duration, error) {
+	if timeouts := b.runtime().scanTimeouts; timeouts != nil {
+		return timeouts.timeout(r)
+	}
+	return 0, nil
+}
+
+// scanContext - ends when the client goes away or the timeout is reached, call cancel when done
+func (b *BucketsDb) scanContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout, err := b.scanTimeout(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if timeout == 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+// scanTruncated - the error ending the stream of a scan stopped early, nil if the scan can go on
+func scanTruncated(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return errors.New("scan truncated: timeout")
+	}
+	return errors.New("scan truncated: request cancelled")
+}
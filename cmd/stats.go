@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/samlotti/relKV/common"
 	"net/http"
-	"sync/atomic"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,6 +16,7 @@ type BackupData struct {
 	LastStart   time.Time
 	LastEnd     time.Time
 	LastMessage string
+	LastSuccess time.Time // end of the last backup that completed, zero if none
 }
 
 type BucketStats struct {
@@ -24,31 +27,49 @@ type BucketStats struct {
 	numGC         int64
 	numGCNR       int64
 	lastEMessage  string // the last error message
+
+	numOrphans        int64 // orphaned aliases remaining after the last scan
+	numOrphansDeleted int64
+	lastOrphanScan    int64 // unix time, 0 = not scanned
 }
 
 type Stats struct {
-	serverStart   time.Time
-	Backups       map[common.BucketName]*BackupData
-	bucketStats   map[common.BucketName]*BucketStats
+	serverStart time.Time
+
+	bucketLock  sync.RWMutex // guards the maps, buckets are added while running
+	backups     map[common.BucketName]*BackupData
+	bucketStats map[common.BucketName]*BucketStats
+
 	LastBKRunLoop time.Time
 	LastBKStart   time.Time
+
+	throttleLock sync.Mutex
+	throttled    map[[3]string]int64 // scope, name, reason
 }
 
 var StatsInstance = &Stats{}
 
 func (s *Stats) init() {
 	s.serverStart = time.Now()
-	s.Backups = make(map[common.BucketName]*BackupData)
+	s.bucketLock.Lock()
+	s.backups = make(map[common.BucketName]*BackupData)
 	s.bucketStats = make(map[common.BucketName]*BucketStats)
+	s.bucketLock.Unlock()
+	s.throttleLock.Lock()
+	s.throttled = make(map[[3]string]int64)
+	s.throttleLock.Unlock()
 
-	for _, bucket := range BucketsInstance.buckets {
+	for _, bucket := range BucketsInstance.configuredBuckets() {
 		s.addBucket(bucket)
 	}
+	requestMetricsInstance.init()
 }
 
 func (s *Stats) addBucket(bucket common.BucketName) {
+	s.bucketLock.Lock()
+	defer s.bucketLock.Unlock()
 
-	s.Backups[bucket] = &BackupData{
+	s.backups[bucket] = &BackupData{
 		Status:      "",
 		LastStart:   s.serverStart,
 		LastEnd:     s.serverStart,
@@ -64,116 +85,145 @@ func (s *Stats) addBucket(bucket common.BucketName) {
 	}
 }
 
+// removeBucket - the stats of a bucket that could not be opened
+func (s *Stats) removeBucket(bucket common.BucketName) {
+	s.bucketLock.Lock()
+	defer s.bucketLock.Unlock()
+	delete(s.backups, bucket)
+	delete(s.bucketStats, bucket)
+}
+
+// bucketStat - the counters of the bucket, nil if unknown
+func (s *Stats) bucketStat(bucket common.BucketName) *BucketStats {
+	s.bucketLock.RLock()
+	defer s.bucketLock.RUnlock()
+	return s.bucketStats[bucket]
+}
+
+// Backup - the backup status of the bucket, nil if unknown
+func (s *Stats) Backup(bucket common.BucketName) *BackupData {
+	s.bucketLock.RLock()
+	defer s.bucketLock.RUnlock()
+	return s.backups[bucket]
+}
+
+// bucketNames - the buckets with stats, sorted
+func (s *Stats) bucketNames() []common.BucketName {
+	s.bucketLock.RLock()
+	defer s.bucketLock.RUnlock()
+	return sortBucketKeys(s.bucketStats)
+}
+
+// addThrottled - a request refused by a limit
+func (s *Stats) addThrottled(scope string, name string, reason string) {
+	s.throttleLock.Lock()
+	defer s.throttleLock.Unlock()
+	s.throttled[[3]string{scope, name, reason}]++
+}
+
+// throttleStats - the refused requests sorted by scope, name and reason
+func (s *Stats) throttleStats() []*common.ThrottleStat {
+	s.throttleLock.Lock()
+	defer s.throttleLock.Unlock()
+	stats := make([]*common.ThrottleStat, 0, len(s.throttled))
+	for k, count := range s.throttled {
+		stats = append(stats, &common.ThrottleStat{Scope: k[0], Name: k[1], Reason: k[2], Count: count})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Scope != b.Scope {
+			return a.Scope < b.Scope
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Reason < b.Reason
+	})
+	return stats
+}
+
 func (b *BucketsDb) status(writer http.ResponseWriter, request *http.Request) {
-	hasErrors := false
+	report := b.collectStatus()
+	code := http.StatusOK
+	if report.Status == common.STATUS_FAILING {
+		code = http.StatusInternalServerError
+	}
+	if wantsJSON(request) {
+		writeJSON(writer, code, report)
+		return
+	}
+
 	w := bytes.Buffer{}
 	w.Write([]byte("<html><body style='background: darkgray'><pre>"))
-	w.Write([]byte(fmt.Sprintf("relKv %s\n", BucketsInstance.version)))
-	w.Write([]byte(fmt.Sprintf("Start: %s\n", StatsInstance.serverStart.Format(time.RFC822))))
-	dur := time.Now().Sub(StatsInstance.serverStart)
-	w.Write([]byte(fmt.Sprintf("Uptime: %s\n", dur.String())))
-	w.Write([]byte(fmt.Sprintf("Current time: %s\n\n", time.Now().Format(time.RFC822))))
+	w.Write([]byte(fmt.Sprintf("relKv %s\n", report.Version)))
+	w.Write([]byte(fmt.Sprintf("Start: %s\n", report.Start.Format(time.RFC822))))
+	w.Write([]byte(fmt.Sprintf("Uptime: %s\n", report.Uptime)))
+	w.Write([]byte(fmt.Sprintf("Current time: %s\n", time.Now().Format(time.RFC822))))
+	if reload := report.Reload; reload != nil {
+		result := "ok"
+		if !reload.Ok {
+			result = "error: " + reload.Error
+		}
+		w.Write([]byte(fmt.Sprintf("Config reload: %s (%s) %s\n", reload.Time.Format(time.RFC822), reload.Trigger, result)))
+		if len(reload.RestartRequired) > 0 {
+			w.Write([]byte(fmt.Sprintf("** restart required for: %s\n", strings.Join(reload.RestartRequired, ", "))))
+		}
+	}
+	w.Write([]byte("\n"))
 	w.Write([]byte("===================================\n\n"))
 
-	var hourGrace = time.Duration(EnvironmentInstance.GetBackupGraceHours()) * time.Hour
-
-	if EnvironmentInstance.GetBoolEnv("NOBACKUP") {
+	if !report.BackupsEnabled {
 		w.Write([]byte("backupsInstance\n"))
 		w.Write([]byte(fmt.Sprintf("** backupsInstance are not enabled\n")))
 	} else {
-		w.Write([]byte(fmt.Sprintf("backupsInstance - Running at hours: %s\n", EnvironmentInstance.GetEnv("BK_HOURS", "?"))))
-		w.Write([]byte(fmt.Sprintf("Age for backup before its considered failed: %s\n", hourGrace)))
+		w.Write([]byte(fmt.Sprintf("backupsInstance - Running at hours: %s\n", report.BackupHours)))
+		w.Write([]byte(fmt.Sprintf("Age for backup before its considered failed: %s\n", time.Duration(report.BackupGraceHours)*time.Hour)))
 
 		w.Write([]byte(fmt.Sprintf("last check loop -  %s\n", StatsInstance.LastBKRunLoop.Format(time.RFC822))))
 		w.Write([]byte(fmt.Sprintf("last start      -  %s\n\n", StatsInstance.LastBKStart.Format(time.RFC822))))
 
 		w.Write([]byte(fmt.Sprintf("%-20s %-15s %-25s %-25s %s\n", "name", "status", "duration", "lastRun", "last message")))
-		keys := sortBucketKeys(StatsInstance.bucketStats)
-		for _, bucket := range keys {
-			bstat := StatsInstance.Backups[bucket]
-
-			dur := time.Now().Sub(bstat.LastStart)
-			if dur > hourGrace {
-				hasErrors = true
-				w.Write([]byte(fmt.Sprintf("%-25s: error: backup has not been run\n", bucket)))
+		for _, backup := range report.Backups {
+			bucket := common.BucketName(backup.Bucket)
+			if check := findCheck(report, checkBackupStale, bucket); check != nil {
+				w.Write([]byte(fmt.Sprintf("%-25s: %s: %s\n", bucket, checkLevelName(check), check.Message)))
 			}
-			dur = bstat.LastEnd.Sub(bstat.LastStart)
-			if bstat.Status == "running" {
-				dur = time.Now().Sub(bstat.LastStart)
-			}
-			smsg := bstat.Status
-			if bstat.LastStart == StatsInstance.serverStart {
+			smsg := backup.Status
+			lastRun := report.Start
+			if backup.LastStart == nil {
 				smsg = "Not run"
+			} else {
+				lastRun = *backup.LastStart
 			}
-			w.Write([]byte(fmt.Sprintf("%-20s %-15s %-25s %-25s %s\n", bucket, smsg, dur.String(), bstat.LastStart.Format(time.RFC822), bstat.LastMessage)))
-			//if len(bstat.LastMessage) > 0 {
-			//	hasErrors = true
-			//}
-			// zipping file is a valid message
-			if len(bstat.LastMessage) > 0 &&
-				bstat.LastMessage != "Creating backup" &&
-				bstat.LastMessage != "Zipping file" {
-				hasErrors = true
-			}
+			w.Write([]byte(fmt.Sprintf("%-20s %-15s %-25s %-25s %s\n", bucket, smsg, backup.Duration, lastRun.Format(time.RFC822), backup.Message)))
 		}
-		//
-		//w.Write([]byte(fmt.Sprintf("%-20s %-15s %-25s %-25s %s\n", "name", "status", "duration", "lastRun", "last message")))
-		//keys = sortBucketKeys(StatsInstance.bucketStats)
-		//for _, bucket := range keys {
-		//	bstat := StatsInstance.Scps[bucket]
-		//
-		//	dur := time.Now().Sub(bstat.LastStart)
-		//	if dur > 24*time.Hour {
-		//		hasErrors = true
-		//		w.Write([]byte(fmt.Sprintf("%-25s: error: backup has not been run\n", bucket)))
-		//	}
-		//	dur = bstat.LastEnd.Sub(bstat.LastStart)
-		//	smsg := bstat.Status
-		//	if bstat.LastStart == StatsInstance.serverStart {
-		//		smsg = "Not run"
-		//	}
-		//	w.Write([]byte(fmt.Sprintf("%-20s %-15s %-25s %-25s %s\n", bucket, smsg, dur.String(), bstat.LastStart.Format(time.RFC822), bstat.LastMessage)))
-		//	if len(bstat.LastMessage) > 0 {
-		//		hasErrors = true
-		//	}
-		//}
-
-		if len(b.Jobs) > 0 {
+
+		if len(report.ScpJobs) > 0 {
 			w.Write([]byte("\n\n===================================\n"))
 			w.Write([]byte("Scp jobs to remote\n"))
-			// if common.ScpEnvInstance.IsEnabled() {
 			w.Write([]byte(fmt.Sprintf("%-20s %-15s %-25s %-25s %-25s %s\n", "bucket", "status", "duration", "next Send", "last Send", "message")))
-			for _, job := range b.Jobs {
-				dur = job.LastEnd.Sub(job.LastStart)
-				nextSend := job.NextSend.Format(time.RFC822)
-				lastSend := job.LastStart.Format(time.RFC822)
-				smsg := ""
-				switch job.Status {
-				case common.ScpError:
-					smsg = "Error"
-				case common.ScpRunning:
-					smsg = "Running"
-					dur = time.Now().Sub(job.LastStart)
+			for _, job := range report.ScpJobs {
+				nextSend := ""
+				if job.NextSend != nil {
+					nextSend = job.NextSend.Format(time.RFC822)
+				}
+				lastSend := ""
+				if job.LastStart != nil {
+					lastSend = job.LastStart.Format(time.RFC822)
+				}
+				if job.Status == "running" {
 					lastSend = "running"
-				case common.ScpPending:
-					smsg = "Pending"
-				case common.ScpComplete:
+				}
+				smsg := strings.ToUpper(job.Status[:1]) + job.Status[1:]
+				if job.Status == "complete" {
 					smsg = "Completed"
-					nextSend = ""
 				}
 
-				w.Write([]byte(fmt.Sprintf("%-20s %-15s %-25s %-25s %-25s %s\n", job.BucketName, smsg, dur.String(), nextSend, lastSend, job.Message)))
+				w.Write([]byte(fmt.Sprintf("%-20s %-15s %-25s %-25s %-25s %s\n", job.Bucket, smsg, job.Duration, nextSend, lastSend, job.Message)))
 
-				// zipping file is a valid message
-				if len(job.Message) > 0 {
-					hasErrors = true
+				if check := findCheck(report, checkScpStale, common.BucketName(job.Bucket)); check != nil {
+					w.Write([]byte(fmt.Sprintf("%-25s: %s: %s\n", job.Bucket, checkLevelName(check), check.Message)))
 				}
-
-				if time.Now().Sub(job.LastStart) > hourGrace {
-					hasErrors = true
-					w.Write([]byte(fmt.Sprintf("%-25s: error: backup has not been run\n", job.BucketName)))
-				}
-
 			}
 		}
 
@@ -182,36 +232,40 @@ func (b *BucketsDb) status(writer http.ResponseWriter, request *http.Request) {
 
 	w.Write([]byte("\nWrites\n"))
 	w.Write([]byte(fmt.Sprintf("%-20s %15s  %15s  %15s  %15s   %s\n", "name", "#Delete", "#Write", "#WriteErr", "Current Errors", "last error message")))
-
-	keys := sortBucketKeys(StatsInstance.bucketStats)
-	for _, key := range keys {
-		bstat := StatsInstance.bucketStats[key]
-		numDelete := atomic.LoadInt64(&bstat.numDelete)
-		numError := atomic.LoadInt64(&bstat.numError)
-		seqWriteError := atomic.LoadInt64(&bstat.seqWriteError)
-		numWrites := atomic.LoadInt64(&bstat.numWrites)
-
-		w.Write([]byte(fmt.Sprintf("%-20s %15d  %15d  %15d  %15d   %s\n", key, numDelete, numWrites, numError, seqWriteError, bstat.lastEMessage)))
-		if seqWriteError > 10 {
-			hasErrors = true
-		}
+	for _, bucket := range report.Buckets {
+		w.Write([]byte(fmt.Sprintf("%-20s %15d  %15d  %15d  %15d   %s\n", bucket.Name, bucket.Deletes, bucket.Writes, bucket.WriteErrors, bucket.SeqWriteErrors, bucket.LastError)))
 	}
 
 	w.Write([]byte(fmt.Sprintf("\n")))
-	if hasErrors {
+	switch report.Status {
+	case common.STATUS_FAILING:
 		w.Write([]byte(fmt.Sprintf("there were some errors listed above\n")))
+	case common.STATUS_DEGRADED:
+		w.Write([]byte(fmt.Sprintf("degraded, there were some warnings listed above\n")))
 	}
 
 	w.Write([]byte("\nGarbage Collection Cycles\n"))
 	w.Write([]byte(fmt.Sprintf("%-20s %15s %15s\n", "name", "#Cycles", "No rewrite")))
+	for _, bucket := range report.Buckets {
+		w.Write([]byte(fmt.Sprintf("%-20s %15d %15d\n", bucket.Name, bucket.GCCycles, bucket.GCNoRewrite)))
+	}
 
-	keys = sortBucketKeys(StatsInstance.bucketStats)
-	for _, key := range keys {
-		bstat := StatsInstance.bucketStats[key]
-		numCycles := atomic.LoadInt64(&bstat.numGC)
-		NRnumCycles := atomic.LoadInt64(&bstat.numGCNR)
+	w.Write([]byte("\nOrphaned aliases\n"))
+	w.Write([]byte(fmt.Sprintf("%-20s %15s %15s   %s\n", "name", "#Orphans", "#Deleted", "last scan")))
+	for _, bucket := range report.Buckets {
+		lastScan := "Not run"
+		if bucket.LastOrphanScan != nil {
+			lastScan = bucket.LastOrphanScan.Format(time.RFC822)
+		}
+		w.Write([]byte(fmt.Sprintf("%-20s %15d %15d   %s\n", bucket.Name, bucket.Orphans, bucket.OrphansDeleted, lastScan)))
+	}
 
-		w.Write([]byte(fmt.Sprintf("%-20s %15d %15d\n", key, numCycles, NRnumCycles)))
+	if len(report.Throttled) > 0 {
+		w.Write([]byte("\nThrottled requests (429)\n"))
+		w.Write([]byte(fmt.Sprintf("%-8s %-20s %-10s %15s\n", "scope", "name", "reason", "#Requests")))
+		for _, stat := range report.Throttled {
+			w.Write([]byte(fmt.Sprintf("%-8s %-20s %-10s %15d\n", stat.Scope, stat.Name, stat.Reason, stat.Count)))
+		}
 	}
 
 	w.Write([]byte("\nMemory related\n"))
@@ -220,11 +274,15 @@ func (b *BucketsDb) status(writer http.ResponseWriter, request *http.Request) {
 	// w.Write([]byte(fmt.Sprintf("BK_ZIP=%t  true will zip the file\n", EnvironmentInstance.GetBoolEnv("BK_ZIP"))))
 
 	w.Write([]byte("</pre></body></html>"))
-	if !hasErrors {
-		writer.WriteHeader(http.StatusOK)
-	} else {
-		writer.WriteHeader(http.StatusInternalServerError)
-	}
+	writer.WriteHeader(code)
 	writer.Write(w.Bytes())
 
 }
+
+// checkLevelName - error for failing checks, warning for degraded
+func checkLevelName(check *common.StatusCheck) string {
+	if check.Level == common.STATUS_FAILING {
+		return "error"
+	}
+	return "warning"
+}
@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The conditions checked by /status, STATUS_FAILING lists the ones that fail the status,
+// the others only make it degraded.
+const (
+	checkBackupStale = "backup_stale" // no backup started within BACKUP_GRACE_HOURS
+	checkBackupError = "backup_error" // the last backup failed
+	checkScpError    = "scp_error"    // the last copy to the remote failed
+	checkScpStale    = "scp_stale"    // no copy to the remote within BACKUP_GRACE_HOURS
+	checkWriteErrors = "write_errors" // more than 10 failed writes in a row
+)
+
+var allStatusChecks = []string{checkBackupStale, checkBackupError, checkScpError, checkScpStale, checkWriteErrors}
+
+// loadStatusFailing - the checks from STATUS_FAILING, all of them if not set
+func loadStatusFailing() (map[string]bool, error) {
+	failing := make(map[string]bool)
+	names := EnvironmentInstance.GetEnv("STATUS_FAILING", strings.Join(allStatusChecks, ","))
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		known := false
+		for _, check := range allStatusChecks {
+			known = known || check == name
+		}
+		if !known {
+			return nil, fmt.Errorf("invalid STATUS_FAILING check: %s, expected any of %s", name, strings.Join(allStatusChecks, ","))
+		}
+		failing[name] = true
+	}
+	return failing, nil
+}
+
+func serverStateName(state ServerState) string {
+	switch state {
+	case Running:
+		return "running"
+	case Stopped:
+		return "stopped"
+	}
+	return "starting"
+}
+
+// timeOrNil - nil for a time not set
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// addCheck - the level comes from STATUS_FAILING
+func (b *BucketsDb) addCheck(report *StatusReport, name string, bucket BucketName, message string) {
+	check := &StatusCheck{Name: name, Bucket: string(bucket), Level: STATUS_DEGRADED, Message: message}
+	if b.runtime().statusFailing[name] {
+		check.Level = STATUS_FAILING
+	}
+	report.Checks = append(report.Checks, check)
+	if check.Level == STATUS_FAILING || report.Status == STATUS_OK {
+		report.Status = check.Level
+	}
+}
+
+// findCheck - nil if the check was not found for the bucket
+func findCheck(report *StatusReport, name string, bucket BucketName) *StatusCheck {
+	for _, check := range report.Checks {
+		if check.Name == name && check.Bucket == string(bucket) {
+			return check
+		}
+	}
+	return nil
+}
+
+// collectStatus - the data shown by /status and the checks
+func (b *BucketsDb) collectStatus() *StatusReport {
+	now := time.Now()
+	hourGrace := time.Duration(EnvironmentInstance.GetBackupGraceHours()) * time.Hour
+
+	report := &StatusReport{
+		Version:          b.version,
+		Status:           STATUS_OK,
+		State:            serverStateName(b.ServerState),
+		Start:            StatsInstance.serverStart,
+		Uptime:           now.Sub(StatsInstance.serverStart).String(),
+		BackupsEnabled:   !EnvironmentInstance.GetBoolEnv("NOBACKUP"),
+		BackupGraceHours: int(hourGrace / time.Hour),
+		Checks:           make([]*StatusCheck, 0),
+		Buckets:          make([]*BucketStatus, 0),
+	}
+
+	keys := StatsInstance.bucketNames()
+	if report.BackupsEnabled {
+		report.BackupHours = EnvironmentInstance.GetEnv("BK_HOURS", "?")
+
+		for _, bucket := range keys {
+			bstat := StatsInstance.Backup(bucket)
+			backup := &BackupStatus{Bucket: string(bucket), Status: bstat.Status, Message: bstat.LastMessage}
+			report.Backups = append(report.Backups, backup)
+
+			if now.Sub(bstat.LastStart) > hourGrace {
+				b.addCheck(report, checkBackupStale, bucket, "backup has not been run")
+			}
+
+			dur := bstat.LastEnd.Sub(bstat.LastStart)
+			if bstat.Status == "running" {
+				dur = now.Sub(bstat.LastStart)
+			}
+			backup.Duration = dur.String()
+			if bstat.LastStart != StatsInstance.serverStart {
+				backup.LastStart = timeOrNil(bstat.LastStart)
+				backup.LastEnd = timeOrNil(bstat.LastEnd)
+			}
+			backup.LastSuccess = timeOrNil(bstat.LastSuccess)
+
+			// zipping file is a valid message
+			if len(bstat.LastMessage) > 0 &&
+				bstat.LastMessage != "Creating backup" &&
+				bstat.LastMessage != "Zipping file" {
+				b.addCheck(report, checkBackupError, bucket, bstat.LastMessage)
+			}
+		}
+
+		for _, job := range b.Jobs {
+			scp := &ScpJobStatus{
+				Bucket:    string(job.BucketName),
+				Status:    scpStatusName(job.Status),
+				NextSend:  timeOrNil(job.NextSend),
+				LastStart: timeOrNil(job.LastStart),
+				Message:   job.Message,
+			}
+			dur := job.LastEnd.Sub(job.LastStart)
+			switch job.Status {
+			case ScpRunning:
+				dur = now.Sub(job.LastStart)
+			case ScpComplete:
+				scp.NextSend = nil
+			}
+			scp.Duration = dur.String()
+			report.ScpJobs = append(report.ScpJobs, scp)
+
+			if len(job.Message) > 0 {
+				b.addCheck(report, checkScpError, job.BucketName, job.Message)
+			}
+			if now.Sub(job.LastStart) > hourGrace {
+				b.addCheck(report, checkScpStale, job.BucketName, "backup has not been run")
+			}
+		}
+	}
+
+	for _, key := range keys {
+		bstat := StatsInstance.bucketStat(key)
+		bucket := &BucketStatus{
+			Name:           string(key),
+			Writes:         atomic.LoadInt64(&bstat.numWrites),
+			Deletes:        atomic.LoadInt64(&bstat.numDelete),
+			WriteErrors:    atomic.LoadInt64(&bstat.numError),
+			SeqWriteErrors: atomic.LoadInt64(&bstat.seqWriteError),
+			LastError:      bstat.lastEMessage,
+			GCCycles:       atomic.LoadInt64(&bstat.numGC),
+			GCNoRewrite:    atomic.LoadInt64(&bstat.numGCNR),
+			Orphans:        atomic.LoadInt64(&bstat.numOrphans),
+			OrphansDeleted: atomic.LoadInt64(&bstat.numOrphansDeleted),
+		}
+		if t := atomic.LoadInt64(&bstat.lastOrphanScan); t > 0 {
+			bucket.LastOrphanScan = timeOrNil(time.Unix(t, 0))
+		}
+		if db, err := b.getDB(string(key)); err == nil && !db.IsClosed() {
+			bucket.Open = true
+			bucket.LsmSize, bucket.VlogSize = db.Size()
+		}
+		report.Buckets = append(report.Buckets, bucket)
+
+		if bucket.SeqWriteErrors > 10 {
+			b.addCheck(report, checkWriteErrors, key, fmt.Sprintf("%d failed writes in a row", bucket.SeqWriteErrors))
+		}
+	}
+
+	report.Throttled = StatsInstance.throttleStats()
+	report.Reload = b.lastReloadStatus()
+
+	return report
+}
+
+// wantsJSON - format=json or an Accept header for json
+func wantsJSON(r *http.Request) bool {
+	return getHeaderKey(HEADER_FORMAT_KEY, r) == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(writer http.ResponseWriter, code int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		SendError(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("content-type", "application/json")
+	writer.WriteHeader(code)
+	writer.Write(data)
+}
+
+// livez - the process and http server are up
+func (b *BucketsDb) livez(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, &ProbeResult{Status: STATUS_OK})
+}
+
+// readyz - the server is running and all the buckets found or created are open, 503 if not
+func (b *BucketsDb) readyz(writer http.ResponseWriter, request *http.Request) {
+	result := &ProbeResult{Status: STATUS_OK}
+	if b.ServerState != Running {
+		result.Errors = append(result.Errors, "server is "+serverStateName(b.ServerState))
+	}
+	// a closed bucket is no longer in the open buckets
+	for _, name := range b.configuredBuckets() {
+		if db, err := b.getDB(string(name)); err != nil || db.IsClosed() {
+			result.Errors = append(result.Errors, fmt.Sprintf("bucket %s is not open", name))
+		}
+	}
+
+	code := http.StatusOK
+	if len(result.Errors) > 0 {
+		result.Status = STATUS_FAILING
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(writer, code, result)
+}
@@ -1,18 +1,28 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/samlotti/relKV/client"
 	. "github.com/samlotti/relKV/common"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func assertHeader(t *testing.T, resp *http.Response, hkey string, hval string) {
@@ -28,31 +38,18 @@ func AddAuth(token string, req *http.Request) {
 }
 
 func HttpCreateBucket(bname string, token string) *http.Response {
-	var payload []byte
-	req, err := http.NewRequest(http.MethodPut, BucketsInstance.getListenAddr()+"/"+bname, bytes.NewBuffer(payload))
-
-	AddAuth(token, req)
-
-	if err != nil {
-		panic(err)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	return resp
+	c, rec := recordingClient(token, nil)
+	return rec.response(c.CreateBucket(context.Background(), bname))
 }
 
 func HttpStatus(token string) *http.Response {
 	var payload []byte
 	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/status", bytes.NewBuffer(payload))
 
-	AddAuth(token, req)
-
 	if err != nil {
 		panic(err)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := testClient(token).Do(req)
 	if err != nil {
 		panic(err)
 	}
@@ -60,63 +57,44 @@ func HttpStatus(token string) *http.Response {
 }
 
 func HttpSetKey(data *TestSetKeyData, token string) *http.Response {
-	req, err := http.NewRequest(http.MethodPost, BucketsInstance.getListenAddr()+"/"+data.bucket+"/"+data.key, bytes.NewBuffer(data.data))
-	if err != nil {
-		panic(err)
-	}
-	AddAuth(token, req)
-	data.SetAliasHeader(req)
-
-	fmt.Printf("%v\n", req)
-
-	if err != nil {
-		panic(err)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		panic(err)
+	opts := &client.SetOptions{TTL: int64(data.ttl)}
+	if len(data.aliases) > 0 {
+		opts.Aliases = data.aliases
 	}
-	fmt.Printf("resp:%v\n", resp)
-	return resp
+	// the preconditions as sent by the test
+	c, rec := recordingClient(token, data.headers)
+	_, err := c.Set(context.Background(), data.bucket, data.key, data.data, opts)
+	return rec.response(err)
 }
 
 func HttpDeleteKey(data *TestDeleteData, token string) *http.Response {
-	var payload []byte
-	req, err := http.NewRequest(http.MethodDelete, BucketsInstance.getListenAddr()+"/"+data.bucket+"/"+data.key, bytes.NewBuffer(payload))
-	AddAuth(token, req)
-	data.SetAliasHeader(req)
-
-	if err != nil {
-		panic(err)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	return resp
+	c, rec := recordingClient(token, data.headers)
+	_, err := c.Delete(context.Background(), data.bucket, data.key, &client.DeleteOptions{Aliases: data.aliases})
+	return rec.response(err)
 }
 
 func HttpSearch(sk *TestSearchData, token string) *http.Response {
-	var payload []byte
-	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/"+sk.bucket, bytes.NewBuffer(payload))
-	AddAuth(token, req)
-	sk.setHeaders(req)
-
-	if err != nil {
-		panic(err)
+	// explain and a timeout that is not a number are not in the options
+	headers := map[string]string{}
+	if sk.explain {
+		headers[HEADER_EXPLAIN_KEY] = "1"
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		panic(err)
+	if len(sk.timeout) > 0 {
+		headers[HEADER_TIMEOUT_KEY] = sk.timeout
 	}
-	return resp
-
+	c, rec := recordingClient(token, headers)
+	_, _, err := c.Search(context.Background(), sk.bucket, sk.options())
+	return rec.response(err)
 }
 
 type SearchResponseEntry struct {
-	Key   string `json:"key"`
-	Data  string `json:"value,omitempty"`
-	Error string `json:"error,omitempty"`
+	Key     string   `json:"key"`
+	Data    string   `json:"value,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	TTL     int64    `json:"ttl,omitempty"`
+	Version uint64   `json:"version,omitempty"`
+	Alias   string   `json:"alias,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
 }
 
 func SearchResponseEntryFromResponse(resp *http.Response) []SearchResponseEntry {
@@ -141,6 +119,8 @@ func startTestServer(testenv string) {
 
 	// Create a bucket not in the Environment list
 	os.Mkdir("../test/data/testbucket", os.ModePerm)
+	// Not a valid bucket name, skipped when the buckets are opened
+	os.Mkdir("../test/data/Not Valid", os.ModePerm)
 
 	if len(testenv) == 0 {
 		EnvironmentInstance.envFile = "../test/test.env"
@@ -154,6 +134,15 @@ func startTestServer(testenv string) {
 	BucketsInstance.WaitTillStarted()
 
 }
+
+// testSecret - the secret of the running server, a reload can swap it
+func testSecret() string {
+	if auth := BucketsInstance.runtime().auth; auth != nil {
+		return auth.secret
+	}
+	return ""
+}
+
 func stopTestServer() {
 	BucketsInstance.shutDownServer()
 	fmt.Printf("Server shut down\n")
@@ -164,6 +153,8 @@ type TestSetKeyData struct {
 	key     string
 	data    []byte
 	aliases []string
+	ttl     int
+	headers map[string]string
 }
 
 func NewTestSetKeyData(bucket string, key string, data []byte) *TestSetKeyData {
@@ -178,12 +169,6 @@ func (tk *TestSetKeyData) AddAlias(alias string) {
 	tk.aliases = append(tk.aliases, alias)
 }
 
-func (tk *TestSetKeyData) SetAliasHeader(req *http.Request) {
-	if len(tk.aliases) > 0 {
-		req.Header.Set(HEADER_ALIAS_KEY, strings.Join(tk.aliases, HEADER_ALIAS_SEPARATOR))
-	}
-}
-
 type TestSearchData struct {
 	bucket   string
 	prefix   string
@@ -193,6 +178,14 @@ type TestSearchData struct {
 	explain  bool
 	b64      bool
 	segments []string
+	start    string
+	end      string
+	startEx  bool
+	endIn    bool
+	reverse  bool
+	cursor   string
+	timeout  string
+	aliases  bool
 }
 
 func (d *TestSearchData) setHeaders(req *http.Request) {
@@ -217,9 +210,52 @@ func (d *TestSearchData) setHeaders(req *http.Request) {
 	if len(d.segments) > 0 {
 		req.Header.Set(HEADER_SEGMENT_KEY, strings.Join(d.segments, HEADER_SEGMENT_SEPARATOR))
 	}
+	if len(d.start) > 0 {
+		req.Header.Set(HEADER_START_KEY, d.start)
+	}
+	if len(d.end) > 0 {
+		req.Header.Set(HEADER_END_KEY, d.end)
+	}
+	if d.startEx {
+		req.Header.Set(HEADER_START_EXCLUSIVE_KEY, "1")
+	}
+	if d.endIn {
+		req.Header.Set(HEADER_END_INCLUSIVE_KEY, "1")
+	}
+	if d.reverse {
+		req.Header.Set(HEADER_REVERSE_KEY, "1")
+	}
+	if len(d.cursor) > 0 {
+		req.Header.Set(HEADER_CURSOR_KEY, d.cursor)
+	}
+	if len(d.timeout) > 0 {
+		req.Header.Set(HEADER_TIMEOUT_KEY, d.timeout)
+	}
+	if d.aliases {
+		req.Header.Set(HEADER_WITH_ALIASES_KEY, "1")
+	}
 
 }
 
+// options - the search as sent by the client
+func (d *TestSearchData) options() *client.SearchOptions {
+	return &client.SearchOptions{
+		Prefix:         d.prefix,
+		Segments:       d.segments,
+		Start:          d.start,
+		End:            d.end,
+		StartExclusive: d.startEx,
+		EndInclusive:   d.endIn,
+		Reverse:        d.reverse,
+		Skip:           d.skip,
+		Max:            d.max,
+		Cursor:         d.cursor,
+		Values:         d.values,
+		B64:            d.b64,
+		WithAliases:    d.aliases,
+	}
+}
+
 func (d *TestSearchData) addSegment(segment string) {
 	d.segments = append(d.segments, segment)
 }
@@ -250,19 +286,9 @@ func decodeB64(data string) string {
 }
 
 func HttpListBuckets(token string) *http.Response {
-	var payload []byte
-	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/", bytes.NewBuffer(payload))
-	AddAuth(token, req)
-
-	if err != nil {
-		panic(err)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	return resp
-
+	c, rec := recordingClient(token, nil)
+	_, err := c.ListBuckets(context.Background())
+	return rec.response(err)
 }
 
 func ListBucketResponseEntryFromResponse(resp *http.Response) []BucketData {
@@ -278,19 +304,9 @@ func ListBucketResponseEntryFromResponse(resp *http.Response) []BucketData {
 }
 
 func HttpGetKeyValue(bucket string, key string, token string) *http.Response {
-	var payload []byte
-	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/"+bucket+"/"+key, bytes.NewBuffer(payload))
-	AddAuth(token, req)
-
-	if err != nil {
-		panic(err)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	return resp
-
+	c, rec := recordingClient(token, nil)
+	_, err := c.Get(context.Background(), bucket, key)
+	return rec.response(err)
 }
 
 func ResponseBodyAsString(resp *http.Response) string {
@@ -304,6 +320,7 @@ type TestDeleteData struct {
 	bucket  string
 	key     string
 	aliases []string
+	headers map[string]string
 }
 
 func NewTestDeleteData(bucket string, key string) *TestDeleteData {
@@ -317,24 +334,12 @@ func (tk *TestDeleteData) AddAlias(alias string) {
 	tk.aliases = append(tk.aliases, alias)
 }
 
-func (tk *TestDeleteData) SetAliasHeader(req *http.Request) {
-	if len(tk.aliases) > 0 {
-		req.Header.Set(HEADER_ALIAS_KEY, strings.Join(tk.aliases, HEADER_ALIAS_SEPARATOR))
-	}
-}
-
 type TestGetKeysData struct {
 	bucket string
 	keys   []string
 	b64    bool
 }
 
-func (d *TestGetKeysData) setHeaders(req *http.Request) {
-	if d.b64 {
-		req.Header.Set(HEADER_B64_KEY, "1")
-	}
-}
-
 func (d *TestGetKeysData) addKey(key string) {
 	d.keys = append(d.keys, key)
 }
@@ -346,24 +351,337 @@ func NewTestGetKeysData(bucket string) *TestGetKeysData {
 }
 
 func HttpGetKeys(sk *TestGetKeysData, secret string) *http.Response {
-	var payload []byte
-	var buf = bytes.NewBuffer(payload)
-	for _, key := range sk.keys {
-		buf.Write([]byte(key))
-		buf.Write([]byte("\n"))
+	c, rec := recordingClient(secret, nil)
+	_, err := c.GetKeys(context.Background(), sk.bucket, sk.keys, sk.b64)
+	return rec.response(err)
+}
+
+func HttpBatch(bucket string, ops []*BatchOp, b64 bool, token string) *http.Response {
+	c, rec := recordingClient(token, nil)
+	_, err := c.Batch(context.Background(), bucket, ops, b64)
+	return rec.response(err)
+}
+
+func BatchResultsFromResponse(resp *http.Response) []BatchResult {
+	var result []BatchResult
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &result); err != nil {
+		fmt.Println("Can not unmarshal JSON")
 	}
+	return result
+}
 
-	req, err := http.NewRequest(http.MethodPost, BucketsInstance.getListenAddr()+"/get/"+sk.bucket, buf)
-	AddAuth(secret, req)
+func searchKeysOf(rdata []SearchResponseEntry) []string {
+	keys := make([]string, 0)
+	for _, entry := range rdata {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func HttpOrphans(bucket string, method string, token string) *http.Response {
+	req, err := http.NewRequest(method, BucketsInstance.getListenAddr()+"/admin/orphans/"+bucket, nil)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := testClient(token).Do(req)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func OrphanReportFromResponse(resp *http.Response) *OrphanReport {
+	result := &OrphanReport{}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, result); err != nil {
+		fmt.Println("Can not unmarshal JSON")
+	}
+	return result
+}
+
+// TestWatch - an open watch stream, the events are read in the background
+type TestWatch struct {
+	resp   *http.Response
+	events chan *TestWatchEvent
+}
+
+type TestWatchEvent struct {
+	id    string
+	event string
+	data  ChangeEvent
+}
+
+func HttpWatch(bucket string, params string, headers map[string]string, token string) *TestWatch {
+	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/api/watch/"+bucket+params, nil)
+	if err != nil {
+		panic(err)
+	}
+	for hkey, hval := range headers {
+		req.Header.Set(hkey, hval)
+	}
+	resp, err := testClient(token).Do(req)
+	if err != nil {
+		panic(err)
+	}
+
+	w := &TestWatch{resp: resp, events: make(chan *TestWatchEvent, 100)}
+	go func() {
+		defer close(w.events)
+		scanner := bufio.NewScanner(resp.Body)
+		event := &TestWatchEvent{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				event.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(line[6:]), &event.data)
+			case line == "" && event.event != "":
+				w.events <- event
+				event = &TestWatchEvent{}
+			}
+		}
+	}()
+	return w
+}
+
+// next - the next event, nil if none arrives in time
+func (w *TestWatch) next() *TestWatchEvent {
+	select {
+	case event := <-w.events:
+		return event
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+}
+
+func (w *TestWatch) Close() {
+	w.resp.Body.Close()
+}
+
+func HttpDeleteKeys(sk *TestSearchData, token string) *http.Response {
+	req, err := http.NewRequest(http.MethodDelete, BucketsInstance.getListenAddr()+"/"+sk.bucket, nil)
+	if err != nil {
+		panic(err)
+	}
+	sk.setHeaders(req)
+	resp, err := testClient(token).Do(req)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func HttpCountKeys(sk *TestSearchData, group string, token string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/api/count/"+sk.bucket, nil)
+	if err != nil {
+		panic(err)
+	}
 	sk.setHeaders(req)
+	if len(group) > 0 {
+		req.Header.Set(HEADER_GROUP_KEY, group)
+	}
+	resp, err := testClient(token).Do(req)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func CountResultFromResponse(resp *http.Response) *CountResult {
+	result := &CountResult{}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, result); err != nil {
+		fmt.Println("Can not unmarshal JSON")
+	}
+	return result
+}
 
+// HttpSigned - a request signed with the token, ts 0 is now
+func HttpSigned(method string, uri string, body []byte, keyName string, token string, ts int64, nonce string) *http.Response {
+	req, err := http.NewRequest(method, BucketsInstance.getListenAddr()+uri, bytes.NewBuffer(body))
 	if err != nil {
 		panic(err)
 	}
+	if ts == 0 {
+		ts = time.Now().Unix()
+	}
+	req.Header.Set(HEADER_SIGN_KEY, keyName)
+	req.Header.Set(HEADER_SIGN_TS, strconv.FormatInt(ts, 10))
+	req.Header.Set(HEADER_SIGN_NONCE, nonce)
+	req.Header.Set(HEADER_SIGN_SIG, SignRequest(token, method, req.URL.RequestURI(), ts, nonce, body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+// MakeJWT - signs the claims, key is the hmac secret, *rsa.PrivateKey or *ecdsa.PrivateKey
+func MakeJWT(alg string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hashFunc := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(newHash(hashFunc), k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, hashFunc, digest(hashFunc, []byte(signed)))
+		if err != nil {
+			panic(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest(hashFunc, []byte(signed)))
+		if err != nil {
+			panic(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func HttpBearer(method string, uri string, body []byte, bearer string) *http.Response {
+	req, err := http.NewRequest(method, BucketsInstance.getListenAddr()+uri, bytes.NewBuffer(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set(HEADER_AUTHORIZATION, "Bearer "+bearer)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		panic(err)
 	}
 	return resp
+}
+
+func HttpMetrics() *http.Response {
+	resp, err := http.Get(BucketsInstance.getListenAddr() + "/metrics")
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func HttpGetPath(path string) *http.Response {
+	resp, err := http.Get(BucketsInstance.getListenAddr() + path)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func StatusReportFromResponse(resp *http.Response) *StatusReport {
+	result := &StatusReport{}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, result); err != nil {
+		fmt.Println("Can not unmarshal JSON")
+	}
+	return result
+}
+
+func HttpAudit(bucket string, params string, token string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/admin/audit/"+bucket+params, nil)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := testClient(token).Do(req)
+	if err != nil {
+		panic(err)
+	}
+	return resp
+}
+
+func AuditEntriesFromResponse(resp *http.Response) []*AuditEntry {
+	var result []*AuditEntry
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &result); err != nil {
+		fmt.Println("Can not unmarshal JSON")
+	}
+	return result
+}
+
+// adminConn - a connection to the admin protocol, without the unix socket
+type adminConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newAdminConn() *adminConn {
+	client, server := net.Pipe()
+	go handleCommands(server)
+	return &adminConn{conn: client, reader: bufio.NewReader(client)}
+}
+
+func (a *adminConn) send(line string) *AdminReply {
+	a.conn.Write([]byte(line + "\n"))
+	data, err := a.reader.ReadBytes('\n')
+	if err != nil {
+		panic(err)
+	}
+	reply := &AdminReply{}
+	if err := json.Unmarshal(data, reply); err != nil {
+		panic(err)
+	}
+	return reply
+}
+
+// testClient - the requests of the tests are sent with the client package
+func testClient(token string) *client.Client {
+	return client.New(BucketsInstance.getListenAddr(), token)
+}
+
+// testRecorder - keeps the last response with its body, the helpers return it to check the
+// status and headers of a call of the client. The headers are added to the requests.
+type testRecorder struct {
+	headers map[string]string
+	resp    *http.Response
+}
+
+func (r *testRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for hkey, hval := range r.headers {
+		req.Header.Set(hkey, hval)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// the trailer is set once the body is read
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	kept := *resp
+	kept.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.resp = &kept
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// response - the response of the call, err is only a failure when nothing was received
+func (r *testRecorder) response(err error) *http.Response {
+	if r.resp == nil {
+		panic(err)
+	}
+	return r.resp
+}
 
+// recordingClient - the client of testClient with its responses kept
+func recordingClient(token string, headers map[string]string) (*client.Client, *testRecorder) {
+	rec := &testRecorder{headers: headers}
+	c := testClient(token)
+	c.SetHTTPClient(&http.Client{Transport: rec})
+	return c, rec
 }
@@ -1,13 +1,26 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"github.com/samlotti/relKV/client"
 	. "github.com/samlotti/relKV/common"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestCreateBucket(t *testing.T) {
@@ -28,7 +41,10 @@ func TestCreateBucket(t *testing.T) {
 	assert.Nil(t, err)
 
 	// Should have a StatsInstance entry!
-	assert.NotNil(t, StatsInstance.bucketStats["sample"])
+	assert.NotNil(t, StatsInstance.bucketStat("sample"))
+	assert.NotNil(t, StatsInstance.Backup("sample"))
+	assert.Contains(t, StatsInstance.bucketNames(), BucketName("sample"))
+	assert.Contains(t, BucketsInstance.configuredBuckets(), BucketName("sample"))
 
 	stopTestServer()
 }
@@ -71,6 +87,15 @@ func TestCreateBucketBad(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, http.StatusCreated, resp.StatusCode)
 
+	// The routes added later are under /api, existing buckets can have these names
+	for _, name := range []string{"get", "batch", "watch", "count"} {
+		resp = HttpCreateBucket(name, BucketsInstance.authsecret.secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	_, err := BucketsInstance.getDB("Not Valid")
+	assert.NotNil(t, err)
+
 	stopTestServer()
 }
 
@@ -401,7 +426,8 @@ func Test_Delete1(t *testing.T) {
 	stopTestServer()
 }
 
-func Test_Delete12_dont_delete_aliases(t *testing.T) {
+// Test_Delete12_cascade_aliases - the recorded aliases are deleted without the header
+func Test_Delete12_cascade_aliases(t *testing.T) {
 	startTestServer("")
 
 	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
@@ -435,14 +461,14 @@ func Test_Delete12_dont_delete_aliases(t *testing.T) {
 	defer resp.Body.Close()
 	ResponseBodyAsString(resp)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assertHeader(t, resp, "rec_deleted", "1")
+	assertHeader(t, resp, "rec_deleted", "3")
 
 	// Get not found entry
 	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 	defer resp.Body.Close()
 
-	// Still not found. But takes space in DB
+	// Deleted with the key
 	resp = HttpGetKeyValue("b1", "p2:p1:g1", BucketsInstance.authsecret.secret)
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 	defer resp.Body.Close()
@@ -983,6 +1009,2226 @@ func Test_PostData_wrong_bucket(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 	assertHeader(t, resp, RESP_HEADER_ERROR_MSG, "bucket not found")
+	assertHeader(t, resp, RESP_HEADER_ERROR_CODE, ERROR_CODE_BUCKET_NOT_FOUND)
+
+	stopTestServer()
+}
+
+func Test_PostData_ttl(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	data := NewTestSetKeyData("b1", "g1", []byte("{game1}"))
+	data.AddAlias("p1:p2:g1")
+	data.ttl = 100
+	resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	data = NewTestSetKeyData("b1", "g2", []byte("{game2}"))
+	data.AddAlias("p1:p3:g2")
+	data.ttl = 1
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	data = NewTestSetKeyData("b1", "g3", []byte("{game3}"))
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Remaining ttl reported on the key and the alias
+	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	ttl := stringToInt(resp.Header.Get(RESP_HEADER_TTL))
+	assert.True(t, ttl > 90 && ttl <= 100)
+
+	resp = HttpGetKeyValue("b1", "p1:p2:g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	ttl = stringToInt(resp.Header.Get(RESP_HEADER_TTL))
+	assert.True(t, ttl > 90 && ttl <= 100)
+
+	resp = HttpGetKeyValue("b1", "g3", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_TTL, "")
+
+	// Let g2 expire
+	time.Sleep(2100 * time.Millisecond)
+
+	resp = HttpGetKeyValue("b1", "g2", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "p1:p3:g2", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	sk := NewTestSearchData("b1")
+	sk.values = true
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	rdata := SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, 3, len(rdata))
+	assert.Equal(t, "g1", rdata[0].Key)
+	assert.True(t, rdata[0].TTL > 90)
+	assert.Equal(t, "g3", rdata[1].Key)
+	assert.Equal(t, int64(0), rdata[1].TTL)
+	assert.Equal(t, "p1:p2:g1", rdata[2].Key)
+	assert.True(t, rdata[2].TTL > 90)
+
+	gk := NewTestGetKeysData("b1")
+	gk.addKey("p1:p2:g1")
+	resp = HttpGetKeys(gk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	rdata = SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, 1, len(rdata))
+	assert.True(t, rdata[0].TTL > 90)
+
+	// Bad ttl
+	req, _ := http.NewRequest(http.MethodPost, BucketsInstance.getListenAddr()+"/b1/g4?ttl=abc", strings.NewReader("x"))
+	resp, err := testClient(BucketsInstance.authsecret.secret).Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// ttl above the max would overflow the expiry
+	data = NewTestSetKeyData("b1", "g4", []byte("x"))
+	data.ttl = 10000000000
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = HttpBatch("b1", []*BatchOp{{Op: BATCH_OP_SET, Key: "g4", Value: "x", TTL: 10000000000}}, false, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	results := BatchResultsFromResponse(resp)
+	assert.Contains(t, results[0].Error, "invalid ttl")
+
+	resp = HttpGetKeyValue("b1", "g4", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_PostData_etag(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	// Create only
+	data := NewTestSetKeyData("b1", "g1", []byte("{game1}"))
+	data.AddAlias("p1:p2:g1")
+	data.headers = map[string]string{HEADER_IF_NONE_MATCH: "*"}
+	resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag1 := resp.Header.Get(RESP_HEADER_ETAG)
+	assert.NotEqual(t, "", etag1)
+
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	// Get returns the same version, also through the alias
+	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, RESP_HEADER_ETAG, etag1)
+
+	resp = HttpGetKeyValue("b1", "p1:p2:g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, RESP_HEADER_ETAG, etag1)
+
+	// Update with the current version
+	data = NewTestSetKeyData("b1", "g1", []byte("{game1b}"))
+	data.headers = map[string]string{HEADER_IF_MATCH: etag1}
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag2 := resp.Header.Get(RESP_HEADER_ETAG)
+	assert.NotEqual(t, etag1, etag2)
+
+	// Stale version
+	data = NewTestSetKeyData("b1", "g1", []byte("{game1c}"))
+	data.headers = map[string]string{HEADER_IF_MATCH: etag1}
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, "{game1b}", ResponseBodyAsString(resp))
+
+	// If-Match on a missing key
+	data = NewTestSetKeyData("b1", "g2", []byte("{game2}"))
+	data.headers = map[string]string{HEADER_IF_MATCH: etag2}
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	// Versions in the search and getKeys results
+	sk := NewTestSearchData("b1")
+	sk.values = true
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	rdata := SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, 2, len(rdata))
+	assert.Equal(t, etag2, formatETag(rdata[0].Version))
+	assert.Equal(t, etag2, formatETag(rdata[1].Version))
+
+	gk := NewTestGetKeysData("b1")
+	gk.addKey("g1")
+	resp = HttpGetKeys(gk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	rdata = SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, etag2, formatETag(rdata[0].Version))
+
+	// Not modified
+	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/b1/g1", nil)
+	assert.Nil(t, err)
+	req.Header.Set(HEADER_IF_NONE_MATCH, etag2)
+	resp, err = testClient(BucketsInstance.authsecret.secret).Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// Delete of an alias with the ETag it returned, the one of its key.
+	// The key is written alone so the alias entry keeps an older version.
+	db, _ := BucketsInstance.getDB("b1")
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte("g3"), []byte("{game3}")).WithMeta(BADGER_FLAG_VALUE))
+	})
+	assert.Nil(t, err)
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte("p1:p2:g3"), []byte("g3")).WithMeta(BADGER_FLAG_ALIAS))
+	})
+	assert.Nil(t, err)
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte("g3"), []byte("{game3b}")).WithMeta(BADGER_FLAG_VALUE))
+	})
+	assert.Nil(t, err)
+
+	resp = HttpGetKeyValue("b1", "p1:p2:g3", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	etag3 := resp.Header.Get(RESP_HEADER_ETAG)
+
+	td := NewTestDeleteData("b1", "p1:p2:g3")
+	td.headers = map[string]string{HEADER_IF_MATCH: etag1}
+	resp = HttpDeleteKey(td, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	td.headers = map[string]string{HEADER_IF_MATCH: etag3}
+	resp = HttpDeleteKey(td, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "p1:p2:g3", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Delete with a stale version
+	td = NewTestDeleteData("b1", "g1")
+	td.headers = map[string]string{HEADER_IF_MATCH: etag1}
+	resp = HttpDeleteKey(td, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	assertHeader(t, resp, "rec_deleted", "0")
+
+	td.headers = map[string]string{HEADER_IF_MATCH: etag2}
+	resp = HttpDeleteKey(td, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_Batch(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	data := NewTestSetKeyData("b1", "g0", []byte("{game0}"))
+	data.AddAlias("p1:p2:g0")
+	resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	ops := []*BatchOp{
+		{Op: BATCH_OP_SET, Key: "g1", Value: "{game1}", Aliases: []string{"p1:p2:g1", "p2:p1:g1"}},
+		{Op: BATCH_OP_SET, Key: "g2", Value: "{game2}", Aliases: []string{"p1:p3:g2"}},
+		{Op: BATCH_OP_DELETE, Key: "g0", Aliases: []string{"p1:p2:g0"}},
+	}
+	resp = HttpBatch("b1", ops, false, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	results := BatchResultsFromResponse(resp)
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, http.StatusCreated, results[0].Status)
+	assert.NotEqual(t, uint64(0), results[0].Version)
+	assert.Equal(t, http.StatusCreated, results[1].Status)
+	assert.Equal(t, http.StatusOK, results[2].Status)
+	assert.Equal(t, 2, results[2].Deleted)
+
+	sk := NewTestSearchData("b1")
+	sk.values = true
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	rdata := SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, 5, len(rdata))
+	assert.Equal(t, "g1", rdata[0].Key)
+	assert.Equal(t, "g2", rdata[1].Key)
+	assert.Equal(t, "p1:p2:g1", rdata[2].Key)
+	assert.Equal(t, "{game1}", rdata[2].Data)
+
+	// Duplicate alias in the last op, nothing is written
+	ops = []*BatchOp{
+		{Op: BATCH_OP_SET, Key: "g3", Value: "{game3}", Aliases: []string{"p1:p4:g3"}},
+		{Op: BATCH_OP_DELETE, Key: "g2", Aliases: []string{"p1:p3:g2"}},
+		{Op: BATCH_OP_SET, Key: "g4", Value: "{game4}", Aliases: []string{"p1:p2:g1"}},
+	}
+	resp = HttpBatch("b1", ops, false, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_DUPLICATE_ERROR, "p1:p2:g1")
+	results = BatchResultsFromResponse(resp)
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, http.StatusFailedDependency, results[0].Status)
+	assert.Equal(t, http.StatusFailedDependency, results[1].Status)
+	assert.Equal(t, http.StatusBadRequest, results[2].Status)
+	assert.Equal(t, "p1:p2:g1", results[2].DuplicateKey)
+
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	rdata = SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, 5, len(rdata))
+
+	// Validation, b64 values
+	ops = []*BatchOp{
+		{Op: BATCH_OP_SET, Key: "g5", Value: "e2dhbWU1fQ=="},
+		{Op: "bad", Key: "g6"},
+	}
+	resp = HttpBatch("b1", ops, true, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	results = BatchResultsFromResponse(resp)
+	assert.Equal(t, http.StatusFailedDependency, results[0].Status)
+	assert.Equal(t, "unknown op: bad", results[1].Error)
+
+	resp = HttpBatch("b1", ops[:1], true, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "g5", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, "{game5}", ResponseBodyAsString(resp))
+
+	// Bad bucket
+	resp = HttpBatch("b1x", ops, false, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_Search_range(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	for i := 1; i <= 5; i++ {
+		data := NewTestSetKeyData("b1", fmt.Sprintf("g%d", i), []byte(fmt.Sprintf("{game%d}", i)))
+		data.AddAlias(fmt.Sprintf("p1:p%d:g%d", i+1, i))
+		resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	search := func(sk *TestSearchData) []string {
+		resp := HttpSearch(sk, BucketsInstance.authsecret.secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return searchKeysOf(SearchResponseEntryFromResponse(resp))
+	}
+
+	// start inclusive, end exclusive
+	sk := NewTestSearchData("b1")
+	sk.start = "g2"
+	sk.end = "g4"
+	assert.Equal(t, []string{"g2", "g3"}, search(sk))
+
+	sk.startEx = true
+	sk.endIn = true
+	assert.Equal(t, []string{"g3", "g4"}, search(sk))
+
+	// reverse
+	sk = NewTestSearchData("b1")
+	sk.reverse = true
+	sk.max = 3
+	assert.Equal(t, []string{"p1:p6:g5", "p1:p5:g4", "p1:p4:g3"}, search(sk))
+
+	sk = NewTestSearchData("b1")
+	sk.reverse = true
+	sk.prefix = "g"
+	sk.max = 2
+	assert.Equal(t, []string{"g5", "g4"}, search(sk))
+
+	sk = NewTestSearchData("b1")
+	sk.reverse = true
+	sk.start = "g2"
+	sk.end = "g4"
+	assert.Equal(t, []string{"g3", "g2"}, search(sk))
+
+	sk.startEx = true
+	sk.endIn = true
+	assert.Equal(t, []string{"g4", "g3"}, search(sk))
+
+	// prefix and range, range past the prefix
+	sk = NewTestSearchData("b1")
+	sk.prefix = "g"
+	sk.start = "g4"
+	sk.end = "z"
+	assert.Equal(t, []string{"g4", "g5"}, search(sk))
+
+	sk.reverse = true
+	assert.Equal(t, []string{"g5", "g4"}, search(sk))
+
+	// with segments and values
+	sk = NewTestSearchData("b1")
+	sk.prefix = "p1"
+	sk.addSegment("p3")
+	sk.reverse = true
+	sk.values = true
+	resp := HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	rdata := SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, 1, len(rdata))
+	assert.Equal(t, "p1:p3:g2", rdata[0].Key)
+	assert.Equal(t, "{game2}", rdata[0].Data)
+
+	sk.explain = true
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, 5, stringToInt(resp.Header.Get("ex_row_read")))
+	assert.Equal(t, 1, stringToInt(resp.Header.Get("ex_rows_selected")))
+
+	// empty range
+	sk = NewTestSearchData("b1")
+	sk.start = "g4"
+	sk.end = "g2"
+	assert.Equal(t, []string{}, search(sk))
+
+	// reverse from the keys continued with 0xFF, the key after the prefix is skipped
+	HttpCreateBucket("b2", BucketsInstance.authsecret.secret)
+	for _, key := range []string{"h1", "h\xff\xff", "i"} {
+		resp := HttpSetKey(NewTestSetKeyData("b2", key, []byte("{"+key+"}")), BucketsInstance.authsecret.secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	sk = NewTestSearchData("b2")
+	sk.prefix = "h"
+	sk.reverse = true
+	sk.values = true
+	sk.b64 = true
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	rdata = SearchResponseEntryFromResponse(resp)
+	if assert.Equal(t, 2, len(rdata)) {
+		assert.Equal(t, "{h\xff\xff}", decodeB64(rdata[0].Data))
+		assert.Equal(t, "h1", rdata[1].Key)
+	}
 
 	stopTestServer()
 }
+
+func Test_Search_cursor(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	for i := 1; i <= 5; i++ {
+		data := NewTestSetKeyData("b1", fmt.Sprintf("g%d", i), []byte(fmt.Sprintf("{game%d}", i)))
+		data.AddAlias(fmt.Sprintf("p1:p%d:g%d", i+1, i))
+		resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	// Returns the keys and the cursor for the next page
+	search := func(sk *TestSearchData) ([]string, string) {
+		resp := HttpSearch(sk, BucketsInstance.authsecret.secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		keys := searchKeysOf(SearchResponseEntryFromResponse(resp))
+		return keys, resp.Trailer.Get(RESP_HEADER_CURSOR)
+	}
+
+	sk := NewTestSearchData("b1")
+	sk.prefix = "g"
+	sk.max = 2
+	keys, cursor := search(sk)
+	assert.Equal(t, []string{"g1", "g2"}, keys)
+	assert.NotEqual(t, "", cursor)
+
+	// The filter state comes from the cursor
+	sk = NewTestSearchData("b1")
+	sk.max = 2
+	sk.cursor = cursor
+	keys, cursor = search(sk)
+	assert.Equal(t, []string{"g3", "g4"}, keys)
+	assert.NotEqual(t, "", cursor)
+
+	sk.cursor = cursor
+	keys, cursor = search(sk)
+	assert.Equal(t, []string{"g5"}, keys)
+	assert.Equal(t, "", cursor)
+
+	// reverse with segments
+	sk = NewTestSearchData("b1")
+	sk.prefix = "p1"
+	sk.reverse = true
+	sk.addSegment("p1")
+	sk.max = 3
+	keys, cursor = search(sk)
+	assert.Equal(t, []string{"p1:p6:g5", "p1:p5:g4", "p1:p4:g3"}, keys)
+
+	sk = NewTestSearchData("b1")
+	sk.max = 3
+	sk.cursor = cursor
+	keys, cursor = search(sk)
+	assert.Equal(t, []string{"p1:p3:g2", "p1:p2:g1"}, keys)
+	assert.Equal(t, "", cursor)
+
+	// explain reports the cursor in the headers
+	sk = NewTestSearchData("b1")
+	sk.max = 1
+	sk.explain = true
+	resp := HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.NotEqual(t, "", resp.Header.Get(RESP_HEADER_CURSOR))
+
+	// bad cursor
+	sk = NewTestSearchData("b1")
+	sk.cursor = "not a cursor"
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_Alias_bookkeeping(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	data := NewTestSetKeyData("b1", "g1", []byte("{game1}"))
+	data.AddAlias("p1:p2:g1")
+	data.AddAlias("p2:p1:g1")
+	resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Listed on the key
+	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, RESP_HEADER_ALIASES, "p1:p2:g1;p2:p1:g1")
+
+	// Change the alias set, the stale one is removed
+	data = NewTestSetKeyData("b1", "g1", []byte("{game1b}"))
+	data.AddAlias("p1:p2:g1")
+	data.AddAlias("p1:p3:g1")
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "p2:p1:g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "p1:p3:g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_ALIASES, "p1:p2:g1;p1:p3:g1")
+
+	// Not written without the header
+	data = NewTestSetKeyData("b1", "g1", []byte("{game1c}"))
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, RESP_HEADER_ALIASES, "p1:p2:g1;p1:p3:g1")
+
+	// The index is not visible
+	sk := NewTestSearchData("b1")
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"g1", "p1:p2:g1", "p1:p3:g1"}, searchKeysOf(SearchResponseEntryFromResponse(resp)))
+
+	sk.reverse = true
+	resp = HttpSearch(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"p1:p3:g1", "p1:p2:g1", "g1"}, searchKeysOf(SearchResponseEntryFromResponse(resp)))
+
+	// The index cannot be deleted directly
+	req, err := http.NewRequest(http.MethodDelete, BucketsInstance.getListenAddr()+"/b1/%00aliases%00g1", nil)
+	assert.Nil(t, err)
+	resp, err = testClient(BucketsInstance.authsecret.secret).Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, RESP_HEADER_ALIASES, "p1:p2:g1;p1:p3:g1")
+
+	// Deleting an alias removes it from the key
+	resp = HttpDeleteKey(NewTestDeleteData("b1", "p1:p3:g1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, RESP_HEADER_ALIASES, "p1:p2:g1")
+
+	// An empty header removes them all
+	data = NewTestSetKeyData("b1", "g1", []byte("{game1d}"))
+	data.headers = map[string]string{HEADER_ALIAS_KEY: ""}
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = HttpSearch(NewTestSearchData("b1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"g1"}, searchKeysOf(SearchResponseEntryFromResponse(resp)))
+
+	// Cascade delete through the batch
+	ops := []*BatchOp{
+		{Op: BATCH_OP_SET, Key: "g2", Value: "{game2}", Aliases: []string{"p1:p2:g2", "p2:p1:g2"}},
+	}
+	resp = HttpBatch("b1", ops, false, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	ops = []*BatchOp{{Op: BATCH_OP_DELETE, Key: "g2"}}
+	resp = HttpBatch("b1", ops, false, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	results := BatchResultsFromResponse(resp)
+	assert.Equal(t, 3, results[0].Deleted)
+
+	resp = HttpSearch(NewTestSearchData("b1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"g1"}, searchKeysOf(SearchResponseEntryFromResponse(resp)))
+
+	stopTestServer()
+}
+
+func Test_Orphans(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	for _, key := range []string{"g1", "g2"} {
+		data := NewTestSetKeyData("b1", key, []byte("{game}"))
+		data.AddAlias("p1:p2:" + key)
+		data.AddAlias("p2:p1:" + key)
+		resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	// Remove the key without its aliases, as older versions did
+	db, _ := BucketsInstance.getDB("b1")
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("g1"))
+	})
+	assert.Nil(t, err)
+
+	resp := HttpOrphans("b1", http.MethodGet, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	report := OrphanReportFromResponse(resp)
+	assert.Equal(t, 4, report.Scanned)
+	assert.Equal(t, 2, report.Orphans)
+	assert.Equal(t, 0, report.Deleted)
+	assert.Equal(t, []string{"p1:p2:g1", "p2:p1:g1"}, report.Keys)
+	assert.Equal(t, int64(2), StatsInstance.bucketStat("b1").numOrphans)
+
+	// Only reported
+	resp = HttpSearch(NewTestSearchData("b1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"g2", "p1:p2:g1", "p1:p2:g2", "p2:p1:g1", "p2:p1:g2"}, searchKeysOf(SearchResponseEntryFromResponse(resp)))
+
+	resp = HttpOrphans("b1", http.MethodDelete, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	report = OrphanReportFromResponse(resp)
+	assert.Equal(t, 2, report.Orphans)
+	assert.Equal(t, 2, report.Deleted)
+	assert.Equal(t, int64(0), StatsInstance.bucketStat("b1").numOrphans)
+	assert.Equal(t, int64(2), StatsInstance.bucketStat("b1").numOrphansDeleted)
+
+	resp = HttpSearch(NewTestSearchData("b1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"g2", "p1:p2:g2", "p2:p1:g2"}, searchKeysOf(SearchResponseEntryFromResponse(resp)))
+
+	// The key can be written again without bringing them back
+	data := NewTestSetKeyData("b1", "g1", []byte("{game}"))
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = HttpGetKeyValue("b1", "g1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, RESP_HEADER_ALIASES, "")
+
+	resp = HttpOrphans("bad", http.MethodGet, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = HttpStatus("")
+	defer resp.Body.Close()
+	assert.Contains(t, ResponseBodyAsString(resp), "Orphaned aliases")
+
+	stopTestServer()
+}
+
+func Test_Watch(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+	db, _ := BucketsInstance.getDB("b1")
+	before := lastCommit(db)
+
+	w := HttpWatch("b1", "?prefix=g&values=1", nil, BucketsInstance.authsecret.secret)
+	defer w.Close()
+	assert.Equal(t, http.StatusOK, w.resp.StatusCode)
+	assertHeader(t, w.resp, "content-type", "text/event-stream")
+	// Nothing is written to start the watch
+	assert.Equal(t, before, lastCommit(db))
+
+	data := NewTestSetKeyData("b1", "g1", []byte("{game1}"))
+	data.AddAlias("p1:p2:g1")
+	resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Outside the prefix
+	resp = HttpSetKey(NewTestSetKeyData("b1", "x1", []byte("{x}")), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+
+	resp = HttpDeleteKey(NewTestDeleteData("b1", "g1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	event := w.next()
+	assert.NotNil(t, event)
+	assert.Equal(t, WATCH_EVENT_SET, event.event)
+	assert.Equal(t, "g1", event.data.Key)
+	assert.Equal(t, "{game1}", event.data.Value)
+	assert.False(t, event.data.Alias)
+	assert.Equal(t, fmt.Sprint(event.data.Version), event.id)
+	setVersion := event.id
+
+	event = w.next()
+	assert.NotNil(t, event)
+	assert.Equal(t, WATCH_EVENT_DELETE, event.event)
+	assert.Equal(t, "g1", event.data.Key)
+	assert.Equal(t, "", event.data.Value)
+
+	// Aliases are flagged
+	w2 := HttpWatch("b1", "?values=1", nil, BucketsInstance.authsecret.secret)
+	defer w2.Close()
+
+	data = NewTestSetKeyData("b1", "g2", []byte("{game2}"))
+	data.AddAlias("p1:p2:g2")
+	resp = HttpSetKey(data, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+
+	// The entries of a transaction are not in a set order
+	events := make(map[string]ChangeEvent)
+	for i := 0; i < 2; i++ {
+		event = w2.next()
+		assert.NotNil(t, event)
+		events[event.data.Key] = event.data
+	}
+	assert.Equal(t, "{game2}", events["g2"].Value)
+	assert.False(t, events["g2"].Alias)
+	assert.Equal(t, "g2", events["p1:p2:g2"].Value)
+	assert.True(t, events["p1:p2:g2"].Alias)
+	w2.Close()
+
+	// Resume after the set, gets the delete and the later write
+	w3 := HttpWatch("b1", "?prefix=g", map[string]string{HEADER_LAST_EVENT_ID: setVersion}, BucketsInstance.authsecret.secret)
+	defer w3.Close()
+
+	event = w3.next()
+	assert.Equal(t, WATCH_EVENT_DELETE, event.event)
+	assert.Equal(t, "g1", event.data.Key)
+	event = w3.next()
+	assert.Equal(t, WATCH_EVENT_SET, event.event)
+	assert.Equal(t, "g2", event.data.Key)
+	assert.Equal(t, "", event.data.Value)
+
+	resp = HttpSetKey(NewTestSetKeyData("b1", "g3", []byte("{game3}")), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	event = w3.next()
+	assert.Equal(t, "g3", event.data.Key)
+
+	// An empty value is a set, the type does not depend on the key existing later
+	resp = HttpSetKey(NewTestSetKeyData("b1", "g5", []byte{}), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = HttpDeleteKey(NewTestDeleteData("b1", "g5"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	resp = HttpSetKey(NewTestSetKeyData("b1", "g5", []byte("{game5}")), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	for _, op := range []string{WATCH_EVENT_SET, WATCH_EVENT_DELETE, WATCH_EVENT_SET} {
+		event = w3.next()
+		if assert.NotNil(t, event) {
+			assert.Equal(t, op, event.event)
+			assert.Equal(t, "g5", event.data.Key)
+		}
+	}
+	w3.Close()
+
+	w4 := HttpWatch("b1", "?since=abc", nil, BucketsInstance.authsecret.secret)
+	defer w4.Close()
+	assert.Equal(t, http.StatusBadRequest, w4.resp.StatusCode)
+
+	// The server stops with a watch open
+	w5 := HttpWatch("b1", "", nil, BucketsInstance.authsecret.secret)
+	defer w5.Close()
+
+	// the client may hold an unused connection, the server waits for it on shutdown
+	http.DefaultClient.CloseIdleConnections()
+	stopTestServer()
+
+	assert.Nil(t, w5.next())
+}
+
+func Test_DeleteKeys(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	ops := []*BatchOp{
+		{Op: BATCH_OP_SET, Key: "t1:a", Value: "1"},
+		{Op: BATCH_OP_SET, Key: "t1:b", Value: "1"},
+		{Op: BATCH_OP_SET, Key: "t1:c", Value: "1"},
+		{Op: BATCH_OP_SET, Key: "t2:x:1", Value: "1", Aliases: []string{"a:t2:x:1"}},
+		{Op: BATCH_OP_SET, Key: "t2:y:1", Value: "1"},
+		{Op: BATCH_OP_SET, Key: "t3:1", Value: "1"},
+		{Op: BATCH_OP_SET, Key: "t3:2", Value: "1"},
+		{Op: BATCH_OP_SET, Key: "t3:3", Value: "1"},
+	}
+	resp := HttpBatch("b1", ops, false, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A selection is required
+	resp = HttpDeleteKeys(NewTestSearchData("b1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	sk := NewTestSearchData("b1")
+	sk.prefix = "t1:"
+	sk.explain = true
+	resp = HttpDeleteKeys(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertHeader(t, resp, "ex_rows_selected", "3")
+
+	resp = HttpSearch(NewTestSearchData("b1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, 9, len(SearchResponseEntryFromResponse(resp)))
+
+	// prefix only, watchers see each key deleted
+	w := HttpWatch("b1", "?prefix=t1:", nil, BucketsInstance.authsecret.secret)
+	defer w.Close()
+	sk.explain = false
+	resp = HttpDeleteKeys(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertHeader(t, resp, "rec_selected", "3")
+	assertHeader(t, resp, "rec_deleted", "3")
+	assert.Equal(t, int64(3), StatsInstance.bucketStat("b1").numDelete)
+	// in any order within a transaction
+	watched := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		if event := w.next(); assert.NotNil(t, event) {
+			assert.Equal(t, WATCH_EVENT_DELETE, event.event)
+			watched = append(watched, event.data.Key)
+		}
+	}
+	assert.ElementsMatch(t, []string{"t1:a", "t1:b", "t1:c"}, watched)
+
+	// segments, the alias goes with the key
+	sk = NewTestSearchData("b1")
+	sk.prefix = "t2:"
+	sk.addSegment("x")
+	resp = HttpDeleteKeys(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assertHeader(t, resp, "rec_selected", "1")
+	assertHeader(t, resp, "rec_deleted", "2")
+
+	// range
+	sk = NewTestSearchData("b1")
+	sk.start = "t3:2"
+	sk.end = "t3:3"
+	sk.endIn = true
+	resp = HttpDeleteKeys(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, "rec_selected", "2")
+
+	resp = HttpSearch(NewTestSearchData("b1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"t2:y:1", "t3:1"}, searchKeysOf(SearchResponseEntryFromResponse(resp)))
+
+	// More than one chunk
+	ops = make([]*BatchOp, 0)
+	for i := 0; i < 1200; i++ {
+		ops = append(ops, &BatchOp{Op: BATCH_OP_SET, Key: fmt.Sprintf("t4:%04d", i), Value: "1", Aliases: []string{fmt.Sprintf("a4:%04d", i)}})
+	}
+	resp = HttpBatch("b1", ops, false, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	sk = NewTestSearchData("b1")
+	sk.prefix = "t4:"
+	resp = HttpDeleteKeys(sk, BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assertHeader(t, resp, "rec_selected", "1200")
+	assertHeader(t, resp, "rec_deleted", "2400")
+
+	resp = HttpSearch(NewTestSearchData("b1"), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"t2:y:1", "t3:1"}, searchKeysOf(SearchResponseEntryFromResponse(resp)))
+
+	stopTestServer()
+}
+
+func Test_CountKeys(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", BucketsInstance.authsecret.secret)
+
+	for _, game := range []struct{ key, p1, p2, rated string }{
+		{"g1", "p1", "p2", "rated"},
+		{"g2", "p1", "p3", "unrated"},
+		{"g3", "p1", "p2", "rated"},
+		{"g4", "p2", "p3", "rated"},
+	} {
+		data := NewTestSetKeyData("b1", game.key, []byte("{game}"))
+		data.AddAlias(game.p1 + ":" + game.p2 + ":" + game.rated + ":" + game.key)
+		data.AddAlias(game.p2 + ":" + game.p1 + ":" + game.rated + ":" + game.key)
+		resp := HttpSetKey(data, BucketsInstance.authsecret.secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	// All, the alias lists are not counted
+	resp := HttpCountKeys(NewTestSearchData("b1"), "", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	result := CountResultFromResponse(resp)
+	assert.Equal(t, 12, result.Count)
+	assert.Nil(t, result.Groups)
+
+	// Games of p1 per opponent
+	sk := NewTestSearchData("b1")
+	sk.prefix = "p1:"
+	resp = HttpCountKeys(sk, "1", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	result = CountResultFromResponse(resp)
+	assert.Equal(t, 3, result.Count)
+	assert.Equal(t, map[string]int{"p2": 2, "p3": 1}, result.Groups)
+
+	sk.addSegment("rated")
+	resp = HttpCountKeys(sk, "", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, CountResultFromResponse(resp).Count)
+
+	// Range, keys without the segment are not grouped
+	sk = NewTestSearchData("b1")
+	sk.start = "g"
+	sk.end = "p1:p3"
+	resp = HttpCountKeys(sk, "3", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	result = CountResultFromResponse(resp)
+	assert.Equal(t, 6, result.Count)
+	assert.Equal(t, map[string]int{"g1": 1, "g3": 1}, result.Groups)
+
+	resp = HttpCountKeys(NewTestSearchData("b1"), "x", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = HttpCountKeys(NewTestSearchData("bad"), "", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_ACL(t *testing.T) {
+	const readToken = "reader-0123456789abcdef"
+	const writeToken = "writer-0123456789abcdef"
+	const noDeleteToken = "nodelete-0123456789abcdef"
+	const adminToken = "admin-0123456789abcdef"
+
+	aclFile := filepath.Join(t.TempDir(), "acl.json")
+	acl := `{ "tokens": [
+		{ "name": "reader", "token": "` + readToken + `", "grants": [ { "buckets": "ctl_*", "rights": "r" } ] },
+		{ "name": "writer", "token": "` + writeToken + `", "grants": [ { "buckets": "ctl_games", "rights": "rwd" } ] },
+		{ "name": "nodelete", "token": "` + noDeleteToken + `", "grants": [ { "buckets": "ctl_games", "rights": "rw" } ] },
+		{ "name": "admin", "token": "` + adminToken + `", "grants": [ { "buckets": "*", "rights": "a" } ] }
+	] }`
+	assert.Nil(t, os.WriteFile(aclFile, []byte(acl), 0600))
+	os.Setenv("ACL_FILE", aclFile)
+	defer os.Unsetenv("ACL_FILE")
+
+	startTestServer("")
+
+	resp := HttpSetKey(NewTestSetKeyData("ctl_games", "g1", []byte("{game1}")), writeToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = HttpGetKeyValue("ctl_games", "g1", readToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "{game1}", ResponseBodyAsString(resp))
+
+	// Valid token without the right
+	resp = HttpSetKey(NewTestSetKeyData("ctl_games", "g1", []byte("{game1}")), readToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = HttpGetKeyValue("ct_games", "g1", readToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = HttpDeleteKey(NewTestDeleteData("ctl_games", "g1"), noDeleteToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	ops := []*BatchOp{{Op: BATCH_OP_SET, Key: "g2", Value: "{game2}"}, {Op: BATCH_OP_DELETE, Key: "g1"}}
+	resp = HttpBatch("ctl_games", ops, false, noDeleteToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = HttpBatch("ctl_games", ops, false, writeToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Invalid token
+	resp = HttpGetKeyValue("ctl_games", "g2", "reader-0123456789abcdeX")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = HttpGetKeyValue("ctl_games", "g2", "")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Only the buckets with access are listed
+	resp = HttpListBuckets(readToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	buckets := ListBucketResponseEntryFromResponse(resp)
+	assert.Equal(t, 1, len(buckets))
+	assert.Equal(t, "ctl_games", buckets[0].Name)
+
+	// Create bucket and admin endpoints need the admin right
+	resp = HttpCreateBucket("b1", writeToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = HttpCreateBucket("b1", adminToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = HttpOrphans("ctl_games", http.MethodGet, writeToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = HttpOrphans("ctl_games", http.MethodGet, adminToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = HttpGetKeyValue("ctl_games", "g2", adminToken)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// SECRET still has all the rights
+	resp = HttpGetKeyValue("b1", "g2", BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = HttpListBuckets(BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.Equal(t, 4, len(ListBucketResponseEntryFromResponse(resp)))
+
+	stopTestServer()
+}
+
+func Test_HMAC(t *testing.T) {
+	const readToken = "reader-0123456789abcdef"
+	aclFile := filepath.Join(t.TempDir(), "acl.json")
+	acl := `{ "tokens": [ { "name": "reader", "token": "` + readToken + `", "grants": [ { "buckets": "ctl_*", "rights": "r" } ] } ] }`
+	assert.Nil(t, os.WriteFile(aclFile, []byte(acl), 0600))
+	os.Setenv("ACL_FILE", aclFile)
+	os.Setenv("AUTH_MODE", "hmac")
+	os.Setenv("AUTH_SKEW_SECONDS", "60")
+	defer os.Unsetenv("ACL_FILE")
+	defer os.Unsetenv("AUTH_MODE")
+	defer os.Unsetenv("AUTH_SKEW_SECONDS")
+
+	startTestServer("")
+	secret := BucketsInstance.authsecret.secret
+
+	resp := HttpSigned(http.MethodPost, "/ctl_games/g1", []byte("{game1}"), SIGN_SECRET_KEY, secret, 0, "n1")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = HttpSigned(http.MethodGet, "/ctl_games/g1", nil, "reader", readToken, 0, "n1")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "{game1}", ResponseBodyAsString(resp))
+
+	// The query is signed
+	resp = HttpSigned(http.MethodGet, "/ctl_games?prefix=g", nil, "reader", readToken, 0, "n2")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// ACL still applies
+	resp = HttpSigned(http.MethodPost, "/ctl_games/g1", []byte("{x}"), "reader", readToken, 0, "n3")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Replayed
+	resp = HttpSigned(http.MethodGet, "/ctl_games/g1", nil, "reader", readToken, 0, "n1")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_ERROR_MSG, "nonce already used")
+
+	// Outside the clock skew
+	resp = HttpSigned(http.MethodGet, "/ctl_games/g1", nil, "reader", readToken, time.Now().Unix()-120, "n4")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_ERROR_MSG, "signed request expired")
+
+	resp = HttpSigned(http.MethodGet, "/ctl_games/g1", nil, "reader", readToken, time.Now().Unix()+120, "n5")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Wrong key, wrong name
+	resp = HttpSigned(http.MethodGet, "/ctl_games/g1", nil, "reader", readToken+"x", 0, "n6")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_ERROR_MSG, "invalid signature")
+
+	resp = HttpSigned(http.MethodGet, "/ctl_games/g1", nil, "other", readToken, 0, "n7")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Body changed after signing
+	req, _ := http.NewRequest(http.MethodPost, BucketsInstance.getListenAddr()+"/ctl_games/g1", bytes.NewBufferString("{changed}"))
+	ts := time.Now().Unix()
+	req.Header.Set(HEADER_SIGN_KEY, SIGN_SECRET_KEY)
+	req.Header.Set(HEADER_SIGN_TS, fmt.Sprint(ts))
+	req.Header.Set(HEADER_SIGN_NONCE, "n8")
+	req.Header.Set(HEADER_SIGN_SIG, SignRequest(secret, http.MethodPost, "/ctl_games/g1", ts, "n8", []byte("{game1}")))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The plain token is not accepted
+	resp = HttpGetKeyValue("ctl_games", "g1", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_ERROR_MSG, "signed request required")
+
+	stopTestServer()
+
+	// Both modes
+	os.Setenv("AUTH_MODE", "both")
+	startTestServer("")
+
+	resp = HttpGetKeyValue("ctl_games", "g1", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = HttpSigned(http.MethodGet, "/ctl_games/g1", nil, SIGN_SECRET_KEY, secret, 0, "n1")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_JWT(t *testing.T) {
+	const jwtSecret = "0123456789abcdef0123456789abcdef"
+	os.Setenv("JWT_HMAC_SECRET", jwtSecret)
+	defer os.Unsetenv("JWT_HMAC_SECRET")
+
+	startTestServer("")
+	secret := BucketsInstance.authsecret.secret
+
+	// The tkn header still works beside the bearer tokens
+	resp := HttpSetKey(&TestSetKeyData{bucket: "ctl_games", key: "g1", data: []byte("{game1}")}, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = HttpSetKey(&TestSetKeyData{bucket: "testbucket", key: "o1", data: []byte("{other1}")}, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	now := time.Now().Unix()
+	reader := MakeJWT("HS256", []byte(jwtSecret), map[string]interface{}{
+		"sub": "reporting", "exp": now + 60,
+		"relkv": []map[string]string{{"buckets": "ctl_*", "rights": "r"}},
+	})
+
+	resp = HttpBearer(http.MethodGet, "/ctl_games/g1", nil, reader)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "{game1}", ResponseBodyAsString(resp))
+
+	// Rights from the claim
+	resp = HttpBearer(http.MethodPost, "/ctl_games/g1", []byte("{x}"), reader)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = HttpBearer(http.MethodGet, "/testbucket/o1", nil, reader)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = HttpBearer(http.MethodGet, "/", nil, reader)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body := ResponseBodyAsString(resp)
+	assert.True(t, strings.Contains(body, "ctl_games"))
+	assert.False(t, strings.Contains(body, "testbucket"))
+
+	// No claim, no rights
+	resp = HttpBearer(http.MethodGet, "/ctl_games/g1", nil, MakeJWT("HS256", []byte(jwtSecret), map[string]interface{}{"sub": "x", "exp": now + 60}))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// exp / nbf
+	resp = HttpBearer(http.MethodGet, "/ctl_games/g1", nil, MakeJWT("HS256", []byte(jwtSecret), map[string]interface{}{"sub": "x", "exp": now - 120}))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_ERROR_MSG, "token expired")
+
+	resp = HttpBearer(http.MethodGet, "/ctl_games/g1", nil, MakeJWT("HS256", []byte(jwtSecret), map[string]interface{}{"sub": "x", "exp": now + 600, "nbf": now + 300}))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertHeader(t, resp, RESP_HEADER_ERROR_MSG, "token not valid yet")
+
+	// Signed with another secret
+	resp = HttpBearer(http.MethodGet, "/ctl_games/g1", nil, MakeJWT("HS256", []byte(jwtSecret+"x"), map[string]interface{}{"sub": "x", "exp": now + 60}))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// A bad bearer is not retried as a tkn
+	req, _ := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/ctl_games/g1", nil)
+	req.Header.Set(HEADER_AUTHORIZATION, "Bearer bad")
+	resp, err := testClient(secret).Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_Metrics(t *testing.T) {
+	startTestServer("")
+	secret := BucketsInstance.authsecret.secret
+
+	resp := HttpSetKey(&TestSetKeyData{bucket: "testbucket", key: "m1", data: []byte("{m1}")}, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = HttpSetKey(&TestSetKeyData{bucket: "testbucket", key: "m2", data: []byte("{m2}")}, secret)
+	defer resp.Body.Close()
+	resp = HttpDeleteKey(&TestDeleteData{bucket: "testbucket", key: "m2"}, secret)
+	defer resp.Body.Close()
+	resp = HttpGetKeyValue("testbucket", "missing", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Not secured, like /status
+	resp = HttpMetrics()
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("content-type"), "text/plain; version=0.0.4"))
+	body := ResponseBodyAsString(resp)
+
+	for _, line := range []string{
+		"# TYPE relkv_writes_total counter",
+		`relkv_writes_total{bucket="testbucket"} 2`,
+		`relkv_deletes_total{bucket="testbucket"} 1`,
+		`relkv_write_errors_total{bucket="testbucket"} 0`,
+		`relkv_sequential_write_errors{bucket="testbucket"} 0`,
+		`relkv_gc_cycles_total{bucket="testbucket"} 0`,
+		`relkv_backup_last_success_timestamp_seconds{bucket="testbucket"} 0`,
+		"# TYPE relkv_http_request_duration_seconds histogram",
+		`relkv_http_requests_total{route="setKey",code="201"} 2`,
+		`relkv_http_requests_total{route="getKey",code="404"} 1`,
+		`relkv_http_request_duration_seconds_bucket{route="setKey",le="+Inf"} 2`,
+		`relkv_http_request_duration_seconds_count{route="delKey"} 1`,
+	} {
+		assert.True(t, strings.Contains(body, line+"\n"), line)
+	}
+	assert.True(t, strings.Contains(body, `relkv_lsm_size_bytes{bucket="testbucket"} `))
+	assert.True(t, strings.Contains(body, `relkv_vlog_size_bytes{bucket="testbucket"} `))
+
+	stopTestServer()
+}
+
+func Test_StatusJSON(t *testing.T) {
+	startTestServer("")
+
+	resp := HttpGetPath("/status?format=json")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("content-type"))
+	report := StatusReportFromResponse(resp)
+	assert.Equal(t, STATUS_OK, report.Status)
+	assert.Equal(t, "running", report.State)
+	assert.False(t, report.BackupsEnabled)
+	assert.Equal(t, 0, len(report.Checks))
+	names := make([]string, 0)
+	for _, bucket := range report.Buckets {
+		names = append(names, bucket.Name)
+		assert.True(t, bucket.Open)
+	}
+	assert.Contains(t, names, "ctl_games")
+
+	resp = HttpGetPath("/api/livez")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = HttpGetPath("/api/readyz")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A closed bucket is not ready, the server is still alive
+	assert.Nil(t, BucketsInstance.DbBucket["ct_games"].Close())
+	resp = HttpGetPath("/api/readyz")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, ResponseBodyAsString(resp), "bucket ct_games is not open")
+	resp = HttpGetPath("/api/livez")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Closed by the admin, no longer in the open buckets
+	assert.Nil(t, BucketsInstance.CloseBucket("ctl_games"))
+	resp = HttpGetPath("/api/readyz")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, ResponseBodyAsString(resp), "bucket ctl_games is not open")
+
+	stopTestServer()
+
+	// Stale backups fail the status by default
+	os.Setenv("NOBACKUP", "0")
+	os.Setenv("BACKUP_GRACE_HOURS", "0")
+	defer os.Unsetenv("NOBACKUP")
+	defer os.Unsetenv("BACKUP_GRACE_HOURS")
+	startTestServer("")
+
+	req, _ := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/status", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	report = StatusReportFromResponse(resp)
+	assert.Equal(t, STATUS_FAILING, report.Status)
+	assert.True(t, len(report.Checks) > 0)
+	assert.Equal(t, "backup_stale", report.Checks[0].Name)
+	assert.Equal(t, STATUS_FAILING, report.Checks[0].Level)
+
+	resp = HttpGetPath("/api/readyz")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stopTestServer()
+
+	// Only degraded
+	os.Setenv("STATUS_FAILING", "write_errors")
+	defer os.Unsetenv("STATUS_FAILING")
+	startTestServer("")
+
+	resp = HttpGetPath("/status?format=json")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	report = StatusReportFromResponse(resp)
+	assert.Equal(t, STATUS_DEGRADED, report.Status)
+	assert.Equal(t, STATUS_DEGRADED, report.Checks[0].Level)
+
+	resp = HttpStatus("")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, ResponseBodyAsString(resp), "warning: backup has not been run")
+
+	// Write errors in a row fail it
+	atomic.StoreInt64(&StatsInstance.bucketStat("ctl_games").seqWriteError, 11)
+	resp = HttpGetPath("/status?format=json")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	report = StatusReportFromResponse(resp)
+	assert.Equal(t, STATUS_FAILING, report.Status)
+
+	stopTestServer()
+}
+
+func Test_AccessLog(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "access.log")
+	os.Setenv("ACCESS_LOG", logFile)
+	defer os.Unsetenv("ACCESS_LOG")
+
+	startTestServer("")
+	secret := BucketsInstance.authsecret.secret
+
+	req, _ := http.NewRequest(http.MethodPost, BucketsInstance.getListenAddr()+"/ctl_games/g1", bytes.NewBufferString("{game1}"))
+	req.Header.Set(HEADER_REQUEST_ID, "gateway-123")
+	resp, err := testClient(secret).Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assertHeader(t, resp, HEADER_REQUEST_ID, "gateway-123")
+
+	resp = HttpGetKeyValue("ctl_games", "g1", secret)
+	defer resp.Body.Close()
+	generated := resp.Header.Get(HEADER_REQUEST_ID)
+	assert.Equal(t, 32, len(generated))
+	assert.Equal(t, "{game1}", ResponseBodyAsString(resp))
+
+	resp = HttpGetKeyValue("ctl_games", "g1", "bad token")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Not routed, still logged
+	req, _ = http.NewRequest(http.MethodPatch, BucketsInstance.getListenAddr()+"/status", nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	stopTestServer()
+
+	data, err := os.ReadFile(logFile)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	entries := make([]*accessEntry, 0)
+	for _, line := range lines {
+		entry := &accessEntry{}
+		assert.Nil(t, json.Unmarshal([]byte(line), entry), line)
+		entries = append(entries, entry)
+	}
+	// the health checks of WaitTillStarted are plain tcp
+	if !assert.Equal(t, 4, len(entries)) {
+		return
+	}
+
+	assert.Equal(t, "gateway-123", entries[0].RequestID)
+	assert.Equal(t, http.MethodPost, entries[0].Method)
+	assert.Equal(t, "/ctl_games/g1", entries[0].Path)
+	assert.Equal(t, "setKey", entries[0].Route)
+	assert.Equal(t, "ctl_games", entries[0].Bucket)
+	assert.Equal(t, "g1", entries[0].Key)
+	assert.Equal(t, SIGN_SECRET_KEY, entries[0].User)
+	assert.Equal(t, http.StatusCreated, entries[0].Status)
+	assert.Equal(t, int64(7), entries[0].BytesIn)
+	assert.True(t, entries[0].LatencyMs > 0)
+
+	assert.Equal(t, generated, entries[1].RequestID)
+	assert.Equal(t, "getKey", entries[1].Route)
+	assert.Equal(t, int64(7), entries[1].Bytes)
+
+	assert.Equal(t, http.StatusUnauthorized, entries[2].Status)
+	assert.Equal(t, "", entries[2].User)
+	assert.Equal(t, http.StatusText(http.StatusUnauthorized), entries[2].Error)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, entries[3].Status)
+	assert.Equal(t, "", entries[3].Route)
+}
+
+func Test_Audit(t *testing.T) {
+	startTestServer("")
+	secret := BucketsInstance.authsecret.secret
+
+	// Not enabled
+	resp := HttpAudit("ctl_games", "", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	stopTestServer()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	os.Setenv("AUDIT_LOG", auditFile)
+	defer os.Unsetenv("AUDIT_LOG")
+	startTestServer("")
+
+	resp = HttpCreateBucket("audited", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	data := NewTestSetKeyData("audited", "g1", []byte("{game1}"))
+	data.AddAlias("a1")
+	resp = HttpSetKey(data, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag := resp.Header.Get(RESP_HEADER_ETAG)
+
+	resp = HttpBatch("audited", []*BatchOp{
+		{Op: BATCH_OP_SET, Key: "g2", Value: "{game2}", Aliases: []string{"a2"}},
+		{Op: BATCH_OP_SET, Key: "h1", Value: "{h1}"},
+		{Op: BATCH_OP_DELETE, Key: "g2"},
+	}, false, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = HttpDeleteKey(&TestDeleteData{bucket: "audited", key: "g1"}, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Failed changes are not recorded
+	data = NewTestSetKeyData("audited", "h1", []byte("{x}"))
+	data.headers = map[string]string{HEADER_IF_MATCH: etag}
+	resp = HttpSetKey(data, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	mid := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	sk := NewTestSearchData("audited")
+	sk.prefix = "h"
+	resp = HttpDeleteKeys(sk, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = HttpAudit("audited", "", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	entries := AuditEntriesFromResponse(resp)
+	if !assert.Equal(t, 7, len(entries)) {
+		return
+	}
+
+	assert.Equal(t, AUDIT_OP_CREATE_BUCKET, entries[0].Op)
+	assert.Equal(t, SIGN_SECRET_KEY, entries[0].User)
+	assert.True(t, len(entries[0].Remote) > 0)
+	assert.True(t, len(entries[0].RequestID) > 0)
+
+	assert.Equal(t, AUDIT_OP_SET, entries[1].Op)
+	assert.Equal(t, "g1", entries[1].Key)
+	assert.Equal(t, []string{"a1"}, entries[1].Aliases)
+	assert.Equal(t, etag, formatETag(entries[1].Version))
+
+	assert.Equal(t, AUDIT_OP_SET, entries[2].Op)
+	assert.Equal(t, "g2", entries[2].Key)
+	assert.Equal(t, "h1", entries[3].Key)
+	assert.True(t, entries[3].Version > 0)
+	assert.Equal(t, entries[2].RequestID, entries[4].RequestID)
+	assert.Equal(t, AUDIT_OP_DELETE, entries[4].Op)
+	assert.Equal(t, "g2", entries[4].Key)
+	// The aliases deleted by the server, none were sent
+	assert.Equal(t, []string{"a2"}, entries[4].Aliases)
+	assert.Equal(t, 2, entries[4].Count)
+
+	assert.Equal(t, AUDIT_OP_DELETE, entries[5].Op)
+	assert.Equal(t, "g1", entries[5].Key)
+	assert.Equal(t, 2, entries[5].Count)
+	assert.Equal(t, []string{"a1"}, entries[5].Aliases)
+
+	assert.Equal(t, AUDIT_OP_DELETE_KEYS, entries[6].Op)
+	assert.Equal(t, "h", entries[6].Key)
+	assert.Equal(t, "prefix=h", entries[6].Detail)
+	assert.Equal(t, 1, entries[6].Count)
+
+	// Key prefix and time range
+	resp = HttpAudit("audited", "?prefix=g", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, 4, len(AuditEntriesFromResponse(resp)))
+
+	resp = HttpAudit("audited", fmt.Sprintf("?from=%s", mid.UTC().Format(time.RFC3339Nano)), secret)
+	defer resp.Body.Close()
+	entries = AuditEntriesFromResponse(resp)
+	assert.Equal(t, 1, len(entries))
+
+	resp = HttpAudit("audited", fmt.Sprintf("?to=%s&max=2", mid.UTC().Format(time.RFC3339Nano)), secret)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, len(AuditEntriesFromResponse(resp)))
+
+	resp = HttpAudit("ctl_games", "", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, 0, len(AuditEntriesFromResponse(resp)))
+
+	resp = HttpAudit("audited", "?from=yesterday", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_RateLimit(t *testing.T) {
+	os.Setenv("RATE_LIMIT_TOKEN", "0.01")
+	os.Setenv("RATE_BURST_TOKEN", "2")
+	defer os.Unsetenv("RATE_LIMIT_TOKEN")
+	defer os.Unsetenv("RATE_BURST_TOKEN")
+	startTestServer("")
+	secret := BucketsInstance.authsecret.secret
+
+	for i := 0; i < 2; i++ {
+		resp := HttpGetKeyValue("testbucket", "missing", secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+
+	resp := HttpGetKeyValue("testbucket", "missing", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	retry := stringToInt(resp.Header.Get(RESP_HEADER_RETRY_AFTER))
+	assert.True(t, retry > 1 && retry <= 100)
+
+	// Not limited
+	resp = HttpGetPath("/status?format=json")
+	defer resp.Body.Close()
+	report := StatusReportFromResponse(resp)
+	if assert.Equal(t, 1, len(report.Throttled)) {
+		assert.Equal(t, &ThrottleStat{Scope: "token", Name: SIGN_SECRET_KEY, Reason: "rate", Count: 1}, report.Throttled[0])
+	}
+
+	resp = HttpMetrics()
+	defer resp.Body.Close()
+	assert.Contains(t, ResponseBodyAsString(resp), `relkv_throttled_requests_total{scope="token",name="secret",reason="rate"} 1`)
+
+	stopTestServer()
+}
+
+func Test_RateLimitBuckets(t *testing.T) {
+	os.Setenv("RATE_LIMIT_BUCKET", "1000")
+	os.Setenv("MAX_INFLIGHT_BUCKET", "1")
+	defer os.Unsetenv("RATE_LIMIT_BUCKET")
+	defer os.Unsetenv("MAX_INFLIGHT_BUCKET")
+	startTestServer("")
+	secret := testSecret()
+
+	// The buckets not open share one limit
+	for i := 0; i < 50; i++ {
+		resp := HttpGetKeyValue(fmt.Sprintf("nobucket%d", i), "missing", secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+	limits := BucketsInstance.runtime().limits
+	limits.bucket.lock.Lock()
+	assert.True(t, len(limits.bucket.states) <= 1)
+	limits.bucket.lock.Unlock()
+
+	// A watch does not hold the bucket
+	w := HttpWatch("testbucket", "", nil, secret)
+	defer w.Close()
+	assert.Equal(t, http.StatusOK, w.resp.StatusCode)
+
+	resp := HttpGetKeyValue("testbucket", "missing", secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_ScanTimeout(t *testing.T) {
+	startTestServer("")
+	secret := BucketsInstance.authsecret.secret
+
+	for _, key := range []string{"s1", "s2"} {
+		resp := HttpSetKey(NewTestSetKeyData("testbucket", key, []byte("{"+key+"}")), secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	sk := NewTestSearchData("testbucket")
+	sk.timeout = "5"
+	resp := HttpSearch(sk, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, len(SearchResponseEntryFromResponse(resp)))
+
+	sk.timeout = "soon"
+	resp = HttpSearch(sk, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// The client is gone, the scan ends with the error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/testbucket?values=1", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	BucketsInstance.searchKeys(rec, mux.SetURLVars(req, map[string]string{"bucket": "testbucket"}))
+	rdata := SearchResponseEntryFromResponse(rec.Result())
+	if assert.Equal(t, 1, len(rdata)) {
+		assert.Equal(t, "scan truncated: request cancelled", rdata[0].Error)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/get/testbucket", strings.NewReader("s1\ns2")).WithContext(ctx)
+	rec = httptest.NewRecorder()
+	BucketsInstance.getKeys(rec, mux.SetURLVars(req, map[string]string{"bucket": "testbucket"}))
+	rdata = SearchResponseEntryFromResponse(rec.Result())
+	if assert.Equal(t, 1, len(rdata)) {
+		assert.Equal(t, "scan truncated: request cancelled", rdata[0].Error)
+	}
+
+	stopTestServer()
+}
+
+func Test_GetKeysError(t *testing.T) {
+	startTestServer("")
+
+	HttpCreateBucket("b1", testSecret())
+	resp := HttpSetKey(NewTestSetKeyData("b1", "g1", []byte("{game1}")), testSecret())
+	defer resp.Body.Close()
+
+	// The stream has started, the error is the last entry
+	db, _ := BucketsInstance.getDB("b1")
+	db.Close()
+	req := httptest.NewRequest(http.MethodPost, "/get/b1", strings.NewReader("g1"))
+	rec := httptest.NewRecorder()
+	BucketsInstance.getKeys(rec, mux.SetURLVars(req, map[string]string{"bucket": "b1"}))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var rdata []SearchResponseEntry
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &rdata))
+	if assert.Equal(t, 1, len(rdata)) {
+		assert.Equal(t, badger.ErrDBClosed.Error(), rdata[0].Error)
+	}
+
+	stopTestServer()
+}
+
+func Test_ConfigReload(t *testing.T) {
+	startTestServer("")
+	oldSecret := BucketsInstance.authsecret.secret
+	newSecret := "reloaded-secret-1234"
+	defer os.Unsetenv("SECRET")
+	defer os.Unsetenv("LOG_LEVEL")
+	defer os.Unsetenv("HTTP_HOST")
+	defer os.Unsetenv("RATE_LIMIT_TOKEN")
+
+	os.Setenv("SECRET", newSecret)
+	os.Setenv("LOG_LEVEL", "ERROR")
+	os.Setenv("HTTP_HOST", "0.0.0.0:9393")
+	status := BucketsInstance.reloadConfig(reloadTriggerSignal)
+	assert.True(t, status.Ok)
+	assert.Equal(t, []string{"LOG_LEVEL", "SECRET"}, status.Applied)
+	assert.Equal(t, []string{"HTTP_HOST"}, status.RestartRequired)
+	assert.Equal(t, ERROR, BucketsInstance.logger.getLevel())
+
+	resp := HttpListBuckets(oldSecret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = HttpListBuckets(newSecret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A bad value keeps the settings in use
+	os.Setenv("RATE_LIMIT_TOKEN", "fast")
+	status = BucketsInstance.reloadConfig(reloadTriggerSignal)
+	assert.False(t, status.Ok)
+	assert.Contains(t, status.Error, "RATE_LIMIT_TOKEN")
+	resp = HttpListBuckets(newSecret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	os.Unsetenv("RATE_LIMIT_TOKEN")
+
+	// Reported, not a panic of the reload
+	os.Setenv("NOBACKUP", "maybe")
+	status = BucketsInstance.reloadConfig(reloadTriggerSignal)
+	assert.False(t, status.Ok)
+	assert.Contains(t, status.Error, "NOBACKUP")
+	os.Unsetenv("NOBACKUP")
+
+	os.Setenv("SECRET", "")
+	status = BucketsInstance.reloadConfig(reloadTriggerSignal)
+	assert.False(t, status.Ok)
+	resp = HttpListBuckets(newSecret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The signal reloads, shown in the status
+	os.Unsetenv("SECRET")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	var report *StatusReport
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		resp = HttpGetPath("/status?format=json")
+		defer resp.Body.Close()
+		report = StatusReportFromResponse(resp)
+		if report.Reload != nil && report.Reload.Ok {
+			break
+		}
+	}
+	if assert.NotNil(t, report.Reload) {
+		assert.True(t, report.Reload.Ok)
+		assert.Equal(t, reloadTriggerSignal, report.Reload.Trigger)
+		assert.Equal(t, []string{"SECRET"}, report.Reload.Applied)
+	}
+	resp = HttpListBuckets(oldSecret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stopTestServer()
+}
+
+func Test_ConfigWatch(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "test.env")
+	data, _ := os.ReadFile("../test/test.env")
+	os.WriteFile(envFile, data, 0600)
+	os.Setenv("CONFIG_WATCH", "1")
+	defer os.Unsetenv("CONFIG_WATCH")
+	startTestServer(envFile)
+
+	os.WriteFile(envFile, append(data, []byte("\nSTATUS_FAILING=backup_error\n")...), 0600)
+	var reload *ReloadStatus
+	for i := 0; i < 100 && reload == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		reload = BucketsInstance.lastReloadStatus()
+	}
+	if assert.NotNil(t, reload) {
+		assert.True(t, reload.Ok)
+		assert.Equal(t, reloadTriggerFile, reload.Trigger)
+		assert.Equal(t, []string{"STATUS_FAILING"}, reload.Applied)
+	}
+	assert.Equal(t, map[string]bool{checkBackupError: true}, BucketsInstance.runtime().statusFailing)
+
+	stopTestServer()
+}
+
+func Test_AdminSocket(t *testing.T) {
+	startTestServer("")
+	defer stopTestServer()
+
+	admin := newAdminConn()
+	defer admin.conn.Close()
+
+	reply := admin.send(ADMIN_CMD_HELP)
+	assert.Equal(t, http.StatusOK, reply.Code)
+
+	reply = admin.send("nocommand")
+	assert.Equal(t, http.StatusBadRequest, reply.Code)
+	assert.Contains(t, reply.Error, "invalid command")
+
+	reply = admin.send(ADMIN_CMD_CREATE + " admin_bucket")
+	assert.Equal(t, http.StatusOK, reply.Code)
+	_, err := BucketsInstance.getDB("admin_bucket")
+	assert.Nil(t, err)
+
+	reply = admin.send(ADMIN_CMD_CREATE + " bad/name")
+	assert.Equal(t, http.StatusBadRequest, reply.Code)
+
+	// not registered when it cannot be opened
+	assert.Nil(t, os.WriteFile(filepath.Join(BucketsInstance.dbPath, "a_file"), []byte("x"), 0600))
+	reply = admin.send(ADMIN_CMD_CREATE + " a_file")
+	assert.NotEqual(t, http.StatusOK, reply.Code)
+	assert.NotContains(t, BucketsInstance.configuredBuckets(), BucketName("a_file"))
+	assert.Nil(t, StatsInstance.bucketStat("a_file"))
+
+	reply = admin.send(ADMIN_CMD_BUCKETS)
+	assert.Equal(t, http.StatusOK, reply.Code)
+	var buckets []*BucketStatus
+	assert.Nil(t, json.Unmarshal(reply.Data, &buckets))
+	found := false
+	for _, bucket := range buckets {
+		found = found || bucket.Name == "admin_bucket"
+	}
+	assert.True(t, found)
+
+	reply = admin.send(ADMIN_CMD_GC + " admin_bucket")
+	assert.Equal(t, http.StatusOK, reply.Code)
+	var gc []*AdminGC
+	assert.Nil(t, json.Unmarshal(reply.Data, &gc))
+	assert.Equal(t, 1, len(gc))
+	assert.Equal(t, "admin_bucket", gc[0].Bucket)
+
+	reply = admin.send(ADMIN_CMD_FLATTEN + " admin_bucket 2")
+	assert.Equal(t, http.StatusOK, reply.Code)
+	reply = admin.send(ADMIN_CMD_FLATTEN + " admin_bucket many")
+	assert.Equal(t, http.StatusBadRequest, reply.Code)
+
+	// the watch is ended when the bucket is closed, the close does not wait for the client
+	w := HttpWatch("admin_bucket", "", nil, BucketsInstance.authsecret.secret)
+	defer w.Close()
+	resp := HttpSetKey(NewTestSetKeyData("admin_bucket", "g1", []byte("x")), BucketsInstance.authsecret.secret)
+	defer resp.Body.Close()
+	assert.NotNil(t, w.next())
+
+	start := time.Now()
+	reply = admin.send(ADMIN_CMD_CLOSE + " admin_bucket")
+	assert.Equal(t, http.StatusOK, reply.Code)
+	assert.True(t, time.Since(start) < bucketDrainTimeout)
+	_, err = BucketsInstance.getDB("admin_bucket")
+	assert.NotNil(t, err)
+	select {
+	case _, open := <-w.events:
+		assert.False(t, open)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the watch was not ended")
+	}
+	reply = admin.send(ADMIN_CMD_CLOSE + " admin_bucket")
+	assert.Equal(t, http.StatusNotFound, reply.Code)
+	reply = admin.send(ADMIN_CMD_GC + " admin_bucket")
+	assert.Equal(t, http.StatusNotFound, reply.Code)
+
+	// NOBACKUP=1
+	reply = admin.send(ADMIN_CMD_BACKUP)
+	assert.Equal(t, http.StatusConflict, reply.Code)
+
+	reply = admin.send(ADMIN_CMD_LOGLEVEL + " ERROR")
+	assert.Equal(t, http.StatusOK, reply.Code)
+	assert.Equal(t, ERROR, BucketsInstance.logger.getLevel())
+	reply = admin.send(ADMIN_CMD_LOGLEVEL + " LOUD")
+	assert.Equal(t, http.StatusBadRequest, reply.Code)
+
+	reply = admin.send(ADMIN_CMD_RELOAD)
+	assert.Equal(t, http.StatusOK, reply.Code)
+	assert.Equal(t, reloadTriggerAdmin, BucketsInstance.lastReloadStatus().Trigger)
+	assert.Equal(t, DEBUG, BucketsInstance.logger.getLevel())
+
+	reply = admin.send(ADMIN_CMD_STATUS)
+	assert.Equal(t, http.StatusOK, reply.Code)
+	var status StatusReport
+	assert.Nil(t, json.Unmarshal(reply.Data, &status))
+	assert.Equal(t, reloadTriggerAdmin, status.Reload.Trigger)
+}
+
+func Test_SearchWithAliases(t *testing.T) {
+	startTestServer("")
+	defer stopTestServer()
+	secret := BucketsInstance.authsecret.secret
+
+	data := NewTestSetKeyData("ctl_games", "g1", []byte("{game1}"))
+	data.AddAlias("p1:p2:g1")
+	data.AddAlias("p2:p1:g1")
+	resp := HttpSetKey(data, secret)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = HttpSearch(&TestSearchData{bucket: "ctl_games", values: true, aliases: true}, secret)
+	defer resp.Body.Close()
+	entries := SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, "g1", entries[0].Key)
+	assert.Equal(t, []string{"p1:p2:g1", "p2:p1:g1"}, entries[0].Aliases)
+	assert.Equal(t, "", entries[0].Alias)
+	assert.Equal(t, "p1:p2:g1", entries[1].Key)
+	assert.Equal(t, "g1", entries[1].Alias)
+	assert.Equal(t, "{game1}", entries[1].Data)
+	assert.Equal(t, "g1", entries[2].Alias)
+
+	// Not requested
+	resp = HttpSearch(&TestSearchData{bucket: "ctl_games"}, secret)
+	defer resp.Body.Close()
+	entries = SearchResponseEntryFromResponse(resp)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, "", entries[1].Alias)
+	assert.Nil(t, entries[0].Aliases)
+}
+
+func Test_Inspect(t *testing.T) {
+	startTestServer("")
+	secret := BucketsInstance.authsecret.secret
+
+	for _, key := range []string{"g1", "g2"} {
+		data := NewTestSetKeyData("ctl_games", key, []byte("{game}"))
+		data.AddAlias("p1:p2:" + key)
+		resp := HttpSetKey(data, secret)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	resp := HttpSetKey(NewTestSetKeyData("ctl_games", "g1", []byte("{game1}")), secret)
+	defer resp.Body.Close()
+
+	// Remove the key without its aliases
+	db, _ := BucketsInstance.getDB("ctl_games")
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("g2"))
+	})
+	assert.Nil(t, err)
+
+	// The server holds the lock
+	_, err = OpenInspector("ctl_games")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "stop the server")
+
+	stopTestServer()
+
+	_, err = OpenInspector("nobucket")
+	assert.NotNil(t, err)
+
+	in, err := OpenInspector("ctl_games")
+	assert.Nil(t, err)
+	defer in.Close()
+
+	var keys []*KV
+	err = in.Keys("", 0, func(kv *KV) error {
+		keys = append(keys, kv)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(keys))
+	assert.Equal(t, "g1", keys[0].Key)
+	assert.Equal(t, []string{"p1:p2:g1"}, keys[0].Aliases)
+	assert.Equal(t, "p1:p2:g2", keys[2].Key)
+	assert.Equal(t, "g2", keys[2].Alias)
+
+	keys = nil
+	in.Keys("p1:", 1, func(kv *KV) error {
+		keys = append(keys, kv)
+		return nil
+	})
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, "p1:p2:g1", keys[0].Key)
+
+	kv, err := in.Get("p1:p2:g1")
+	assert.Nil(t, err)
+	assert.Equal(t, "g1", kv.Alias)
+	assert.Equal(t, "{game1}", kv.Value)
+	kv, err = in.Get("p1:p2:g2")
+	assert.Nil(t, err)
+	assert.Contains(t, kv.Error, "orphaned")
+	_, err = in.Get("g2")
+	assert.Equal(t, badger.ErrKeyNotFound, err)
+
+	count, err := in.Count("")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count.Keys)
+	assert.Equal(t, 2, count.Aliases)
+	// the alias list of g2 is left too
+	assert.Equal(t, 2, count.Hidden)
+
+	// the older versions can be removed by the compaction on close
+	kv, _ = in.Get("g1")
+	versions, err := in.Versions("g1")
+	assert.Nil(t, err)
+	assert.True(t, len(versions) > 0)
+	assert.Equal(t, kv.Version, versions[0].Version)
+	assert.False(t, versions[0].Deleted)
+	versions, err = in.Versions("nokey")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(versions))
+
+	info, err := in.Info()
+	assert.Nil(t, err)
+	assert.Equal(t, "ctl_games", info.Bucket)
+	assert.True(t, info.MaxVersion > 0)
+	assert.True(t, len(info.VlogFiles) > 0)
+
+	report, err := in.Orphans()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Orphans)
+	assert.Equal(t, []string{"p1:p2:g2"}, report.Keys)
+}
+
+func Test_Client(t *testing.T) {
+	startTestServer("")
+	defer stopTestServer()
+	c := testClient(BucketsInstance.authsecret.secret)
+	ctx := context.Background()
+
+	version, err := c.Set(ctx, "ctl_games", "g1", []byte("{game1}"), &client.SetOptions{Aliases: []string{"p1:g1", "p2:g1"}, TTL: 100})
+	assert.Nil(t, err)
+	assert.True(t, version > 0)
+
+	item, err := c.Get(ctx, "ctl_games", "p1:g1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "{game1}", string(item.Value))
+		assert.Equal(t, version, item.Version)
+		assert.True(t, item.TTL > 90 && item.TTL <= 100)
+	}
+	item, err = c.Get(ctx, "ctl_games", "g1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"p1:g1", "p2:g1"}, item.Aliases)
+	}
+
+	// The aliases are kept when not given
+	_, err = c.Set(ctx, "ctl_games", "g1", []byte("{game1b}"), nil)
+	assert.Nil(t, err)
+	item, err = c.Get(ctx, "ctl_games", "p2:g1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "{game1b}", string(item.Value))
+	}
+
+	// Typed errors
+	_, err = c.Get(ctx, "ctl_games", "missing")
+	assert.True(t, errors.Is(err, client.ErrNotFound))
+	_, err = c.Get(ctx, "no_bucket", "g1")
+	assert.True(t, errors.Is(err, client.ErrBadBucket))
+	assert.False(t, errors.Is(err, client.ErrNotFound))
+	// told by the error code, not the message
+	assert.False(t, errors.Is(&client.Error{Status: http.StatusBadRequest, Message: "bucket not found"}, client.ErrBadBucket))
+
+	_, err = c.Set(ctx, "ctl_games", "g2", []byte("{game2}"), &client.SetOptions{Aliases: []string{"p1:g1"}})
+	assert.True(t, errors.Is(err, client.ErrDuplicateKey))
+	var cerr *client.Error
+	if assert.True(t, errors.As(err, &cerr)) {
+		assert.Equal(t, http.StatusBadRequest, cerr.Status)
+		assert.Equal(t, "p1:g1", cerr.DuplicateKey)
+	}
+	assert.False(t, errors.Is(err, client.ErrBadBucket))
+
+	_, err = c.Set(ctx, "ctl_games", "g1", []byte("{stale}"), &client.SetOptions{IfMatch: version})
+	assert.True(t, errors.Is(err, client.ErrPrecondition))
+	_, err = c.Set(ctx, "ctl_games", "g1", []byte("{again}"), &client.SetOptions{IfNoneMatch: true})
+	assert.True(t, errors.Is(err, client.ErrPrecondition))
+
+	// Search, streamed and paged with the cursor
+	for _, key := range []string{"g2", "g3", "g4"} {
+		_, err = c.Set(ctx, "ctl_games", key, []byte("{"+key+"}"), nil)
+		assert.Nil(t, err)
+	}
+	kvs, cursor, err := c.Search(ctx, "ctl_games", &client.SearchOptions{Prefix: "g", Max: 3, Values: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(kvs))
+	assert.Equal(t, "{game1b}", kvs[0].Value)
+	assert.True(t, len(cursor) > 0)
+
+	var keys []string
+	cursor, err = c.SearchEach(ctx, "ctl_games", &client.SearchOptions{Prefix: "g", Cursor: cursor}, func(kv *KV) error {
+		keys = append(keys, kv.Key)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "", cursor)
+	assert.Equal(t, []string{"g4"}, keys)
+
+	kvs, _, err = c.Search(ctx, "ctl_games", &client.SearchOptions{Segments: []string{"p1"}, WithAliases: true})
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(kvs)) {
+		assert.Equal(t, "g1", kvs[0].Alias)
+	}
+
+	_, _, err = c.Search(ctx, "no_bucket", nil)
+	assert.True(t, errors.Is(err, client.ErrBadBucket))
+
+	kvs, err = c.GetKeys(ctx, "ctl_games", []string{"g2", "missing"}, false)
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(kvs)) {
+		assert.Equal(t, "{g2}", kvs[0].Value)
+		assert.True(t, len(kvs[1].Error) > 0)
+	}
+
+	deleted, err := c.Delete(ctx, "ctl_games", "g1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, deleted)
+	_, err = c.Get(ctx, "ctl_games", "p1:g1")
+	assert.True(t, errors.Is(err, client.ErrNotFound))
+
+	// Buckets
+	assert.Nil(t, c.CreateBucket(ctx, "client_bucket"))
+	err = c.CreateBucket(ctx, "bad bucket!")
+	assert.True(t, errors.Is(err, client.ErrBadBucket))
+
+	buckets, err := c.ListBuckets(ctx)
+	assert.Nil(t, err)
+	names := make([]string, 0)
+	for _, bk := range buckets {
+		names = append(names, bk.Name)
+	}
+	assert.Contains(t, names, "client_bucket")
+
+	status, err := c.Status(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, STATUS_OK, status.Status)
+	}
+
+	_, err = testClient("wrong").Get(ctx, "ctl_games", "g2")
+	if assert.True(t, errors.As(err, &cerr)) {
+		assert.Equal(t, http.StatusUnauthorized, cerr.Status)
+	}
+}
+
+func Test_ClientRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "tk", r.Header.Get("tkn"))
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "{v}", string(body))
+		w.Header().Set(RESP_HEADER_ETAG, `"7"`)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := client.New(srv.URL, "tk")
+	c.SetRetries(2, 10*time.Millisecond)
+	version, err := c.Set(context.Background(), "b", "k", []byte("{v}"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), version)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Not retried
+	atomic.StoreInt32(&calls, 0)
+	c.SetRetries(0, 0)
+	_, err = c.Set(context.Background(), "b", "k", []byte("{v}"), nil)
+	var cerr *client.Error
+	if assert.True(t, errors.As(err, &cerr)) {
+		assert.Equal(t, http.StatusServiceUnavailable, cerr.Status)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// The connection is dropped after the request was sent, a POST may have been run
+	atomic.StoreInt32(&calls, 0)
+	drop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if assert.Nil(t, err) {
+			conn.Close()
+		}
+	}))
+	defer drop.Close()
+	c = client.New(drop.URL, "tk")
+	c.SetRetries(2, 10*time.Millisecond)
+	_, err = c.Set(context.Background(), "b", "k", []byte("{v}"), nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.Get(context.Background(), "b", "k")
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func Test_ClientRateLimit(t *testing.T) {
+	os.Setenv("RATE_LIMIT_TOKEN", "0.01")
+	os.Setenv("RATE_BURST_TOKEN", "1")
+	defer os.Unsetenv("RATE_LIMIT_TOKEN")
+	defer os.Unsetenv("RATE_BURST_TOKEN")
+	startTestServer("")
+	defer stopTestServer()
+	c := testClient(BucketsInstance.authsecret.secret)
+
+	_, err := c.Get(context.Background(), "testbucket", "missing")
+	assert.True(t, errors.Is(err, client.ErrNotFound))
+
+	_, err = c.Get(context.Background(), "testbucket", "missing")
+	var cerr *client.Error
+	if assert.True(t, errors.As(err, &cerr)) {
+		assert.Equal(t, http.StatusTooManyRequests, cerr.Status)
+		assert.True(t, cerr.RetryAfter > time.Second)
+	}
+
+	// The wait for the Retry-After ends with the context
+	c.SetRetries(3, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.Get(ctx, "testbucket", "missing")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// certReloader - holds the server certificate and client CAs, they are read again on reload
+// so new certificates are used by new connections without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// newCertReloader - loads the certificate and key, caFile is optional and enables client certificates.
+func newCertReloader(certFile string, keyFile string, caFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload - reads the files, on an error the current certificates are kept.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS_CERT / TLS_KEY: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if len(c.caFile) > 0 {
+		data, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return fmt.Errorf("error loading TLS_CLIENT_CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("error loading TLS_CLIENT_CA: no certificates found")
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCAs = pool
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// tlsConfig - the server config, each connection gets the current certificates.
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: c.getCertificate,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}
+			if c.clientCAs != nil {
+				config.ClientCAs = c.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// newCertReloaderFromEnv - nil if TLS_CERT and TLS_KEY are not set
+func newCertReloaderFromEnv() (*certReloader, error) {
+	certFile := EnvironmentInstance.GetEnv("TLS_CERT", "")
+	keyFile := EnvironmentInstance.GetEnv("TLS_KEY", "")
+	caFile := EnvironmentInstance.GetEnv("TLS_CLIENT_CA", "")
+
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		if len(caFile) > 0 {
+			return nil, errors.New("TLS_CLIENT_CA requires TLS_CERT and TLS_KEY")
+		}
+		return nil, nil
+	}
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("both TLS_CERT and TLS_KEY are required for TLS")
+	}
+	return newCertReloader(certFile, keyFile, caFile)
+}
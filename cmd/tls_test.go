@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA - a certificate authority created for the test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "relKV test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue - a certificate signed by the CA, returns the cert and key as pem
+func (ca *testCA) issue(t *testing.T, serial int64, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeServerCert - writes a server certificate and sets TLS_CERT / TLS_KEY
+func writeServerCert(t *testing.T, dir string, ca *testCA, serial int64) {
+	certPem, keyPem := ca.issue(t, serial, "localhost", x509.ExtKeyUsageServerAuth)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "server.crt"), certPem, 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "server.key"), keyPem, 0600))
+	os.Setenv("TLS_CERT", filepath.Join(dir, "server.crt"))
+	os.Setenv("TLS_KEY", filepath.Join(dir, "server.key"))
+}
+
+func clearTLSEnv() {
+	os.Unsetenv("TLS_CERT")
+	os.Unsetenv("TLS_KEY")
+	os.Unsetenv("TLS_CLIENT_CA")
+}
+
+// tlsClient - trusts the CA, presents the client certificate if given
+func tlsClient(ca *testCA, clientCert *tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{*clientCert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func tlsListBuckets(client *http.Client) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, BucketsInstance.getListenAddr()+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	AddAuth(testSecret(), req)
+	return client.Do(req)
+}
+
+func Test_PlainHTTP(t *testing.T) {
+	clearTLSEnv()
+	startTestServer("")
+
+	assert.True(t, strings.HasPrefix(BucketsInstance.getListenAddr(), "http://"))
+
+	resp := HttpListBuckets(testSecret())
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.TLS)
+
+	stopTestServer()
+}
+
+func Test_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	writeServerCert(t, dir, ca, 10)
+	defer clearTLSEnv()
+
+	startTestServer("")
+
+	assert.True(t, strings.HasPrefix(BucketsInstance.getListenAddr(), "https://"))
+
+	client := tlsClient(ca, nil)
+	resp, err := tlsListBuckets(client)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotNil(t, resp.TLS)
+	assert.Equal(t, int64(10), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// Plain http is refused
+	plainReq, _ := http.NewRequest(http.MethodGet, "http://"+BucketsInstance.getHostPort()+"/", nil)
+	resp, err = http.DefaultClient.Do(plainReq)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// New certificate on SIGHUP
+	writeServerCert(t, dir, ca, 11)
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	serial := int64(0)
+	for i := 0; i < 50 && serial != 11; i++ {
+		time.Sleep(20 * time.Millisecond)
+		client = tlsClient(ca, nil)
+		resp, err = tlsListBuckets(client)
+		if !assert.Nil(t, err) {
+			break
+		}
+		resp.Body.Close()
+		serial = resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+		client.CloseIdleConnections()
+	}
+	assert.Equal(t, int64(11), serial)
+
+	// A bad file keeps the current certificate
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "server.crt"), []byte("bad"), 0600))
+	assert.NotNil(t, BucketsInstance.certs.reload())
+
+	client = tlsClient(ca, nil)
+	resp, err = tlsListBuckets(client)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, int64(11), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+	client.CloseIdleConnections()
+
+	stopTestServer()
+}
+
+func Test_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	writeServerCert(t, dir, ca, 10)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ca.crt"), ca.pem, 0600))
+	os.Setenv("TLS_CLIENT_CA", filepath.Join(dir, "ca.crt"))
+	defer clearTLSEnv()
+
+	startTestServer("")
+
+	// No client certificate
+	client := tlsClient(ca, nil)
+	_, err := tlsListBuckets(client)
+	assert.NotNil(t, err)
+
+	// Signed by another CA
+	other := newTestCA(t)
+	certPem, keyPem := other.issue(t, 20, "client", x509.ExtKeyUsageClientAuth)
+	otherCert, err := tls.X509KeyPair(certPem, keyPem)
+	assert.Nil(t, err)
+	client = tlsClient(ca, &otherCert)
+	_, err = tlsListBuckets(client)
+	assert.NotNil(t, err)
+
+	certPem, keyPem = ca.issue(t, 21, "client", x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(certPem, keyPem)
+	assert.Nil(t, err)
+	client = tlsClient(ca, &clientCert)
+	resp, err := tlsListBuckets(client)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	client.CloseIdleConnections()
+
+	stopTestServer()
+}
@@ -12,6 +12,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Environment struct {
@@ -22,9 +24,14 @@ var EnvironmentInstance Environment = Environment{
 	envFile: ".env",
 }
 
+// viperLock - the .env file is read again on a config reload while the settings are read
+var viperLock sync.RWMutex
+
 // EnvInit - Called at startup.
 func EnvInit() {
 	var fileName = EnvironmentInstance.envFile
+	viperLock.Lock()
+	defer viperLock.Unlock()
 	viper.SetConfigFile(fileName)
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -32,12 +39,26 @@ func EnvInit() {
 	}
 }
 
+// EnvReload - reads the .env file again, on an error the values are kept
+func EnvReload() error {
+	viperLock.Lock()
+	defer viperLock.Unlock()
+	return viper.ReadInConfig()
+}
+
+func viperGet(key string) (string, bool) {
+	viperLock.RLock()
+	defer viperLock.RUnlock()
+	val, found := viper.Get(key).(string)
+	return val, found
+}
+
 // GetEnv -- Gets the value of the Environment.
 // If not specified and no default in the .env file it will return fallback
 func (e *Environment) GetEnv(key string, fallback string) string {
 	val, found := os.LookupEnv(key)
 	if !found {
-		val, found = viper.Get(key).(string)
+		val, found = viperGet(key)
 	}
 	if !found {
 		return fallback
@@ -61,7 +82,7 @@ func (e *Environment) GetBoolEnv(key string) bool {
 func (e *Environment) LookupEnv(key string) (string, bool) {
 	val, ok := os.LookupEnv(key)
 	if !ok {
-		val, ok = viper.Get(key).(string)
+		val, ok = viperGet(key)
 	}
 	return val, ok
 }
@@ -153,6 +174,10 @@ func isKeyValid(key string) bool {
 	if strings.Contains(key, "\r") {
 		return false
 	}
+	// reserved for the hidden entries
+	if strings.Contains(key, "\x00") {
+		return false
+	}
 	return true
 }
 
@@ -236,7 +261,7 @@ func validateBucketName(bname string) bool {
 	if strings.Contains(bname, "/") {
 		return false
 	}
-	if bname == "status" {
+	if reservedKeys[bname] {
 		return false
 	}
 	return true
@@ -250,11 +275,63 @@ func isAlias(item *badger.Item) bool {
 	return item.UserMeta()&BADGER_FLAG_ALIAS == BADGER_FLAG_ALIAS
 }
 
+// getExpiresAt - reads the ttl option (seconds) and returns the badger expiry time.
+// returns 0 when no ttl was requested.
+func getExpiresAt(r *http.Request) (uint64, error) {
+	data := getHeaderKey(HEADER_TTL_KEY, r)
+	if data == "" {
+		return 0, nil
+	}
+	ttl, err := strconv.ParseInt(data, 10, 64)
+	if err != nil || ttl < 0 || ttl > MAX_TTL_SECONDS {
+		return 0, fmt.Errorf("invalid value for %s, expected seconds up to %d found: %s", HEADER_TTL_KEY, MAX_TTL_SECONDS, data)
+	}
+	return expiresAtTTL(ttl), nil
+}
+
+// expiresAtTTL - the badger expiry of a ttl in seconds, 0 = no expiry. ttl must be at most MAX_TTL_SECONDS
+func expiresAtTTL(ttl int64) uint64 {
+	if ttl == 0 {
+		return 0
+	}
+	return uint64(time.Now().Unix() + ttl)
+}
+
+// getTTL - seconds remaining before the item expires, 0 if the item does not expire.
+func getTTL(item *badger.Item) int64 {
+	expiresAt := item.ExpiresAt()
+	if expiresAt == 0 {
+		return 0
+	}
+	remaining := int64(expiresAt) - time.Now().Unix()
+	if remaining < 1 {
+		// Still readable, about to expire
+		remaining = 1
+	}
+	return remaining
+}
+
+// isHidden - entries maintained by the server, not returned to clients
+func isHidden(item *badger.Item) bool {
+	if item == nil {
+		return false
+	}
+	return item.UserMeta()&BADGER_FLAG_ALIAS_INDEX == BADGER_FLAG_ALIAS_INDEX
+}
+
 func SendError(writer http.ResponseWriter, message string, status int) {
 	writer.Header().Set(RESP_HEADER_ERROR_MSG, message)
 	http.Error(writer, message, status)
 }
 
+// sendBucketError - the error of getDB, an unknown bucket is told by the error_code header
+func sendBucketError(writer http.ResponseWriter, err error) {
+	if err == errBucketNotFound {
+		writer.Header().Set(RESP_HEADER_ERROR_CODE, ERROR_CODE_BUCKET_NOT_FOUND)
+	}
+	SendError(writer, err.Error(), http.StatusBadRequest)
+}
+
 // sortBucketKeys - could have make totally generic but
 // don't have the golang.org/x/exp  package
 func sortBucketKeys[V any](theMap map[BucketName]V) []BucketName {
@@ -1,8 +1,23 @@
 package cmd
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/dgraph-io/badger/v3"
+	. "github.com/samlotti/relKV/common"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 import "github.com/stretchr/testify/assert"
 
@@ -30,4 +45,434 @@ func TestSegments(t *testing.T) {
 	assert.Equal(t, 56, arr[2])
 	os.Unsetenv("test")
 
+	part, ok := keySegment("p1:p2:g1", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "p2", part)
+	part, ok = keySegment("p1:p2:g1", 2)
+	assert.Equal(t, "g1", part)
+	_, ok = keySegment("p1:p2:g1", 3)
+	assert.False(t, ok)
+	part, ok = keySegment("g1", 0)
+	assert.Equal(t, "g1", part)
+	// the segments are in the last portion of the key, like segmentMatch
+	part, ok = keySegment("a:b/p1:p2:g1", 0)
+	assert.True(t, ok)
+	assert.Equal(t, "p1", part)
+	assert.True(t, segmentMatch("a:b/p1:p2:g1", []string{":p1:"}))
+}
+
+func TestETag(t *testing.T) {
+	assert.Equal(t, "\"12\"", formatETag(12))
+	assert.True(t, etagMatches("\"12\"", 12))
+	assert.True(t, etagMatches("W/\"12\"", 12))
+	assert.True(t, etagMatches("\"3\", \"12\"", 12))
+	assert.True(t, etagMatches("*", 12))
+	assert.False(t, etagMatches("\"13\"", 12))
+	assert.False(t, etagMatches("", 12))
+}
+
+func TestCommittedVersion(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLoggingLevel(badger.ERROR))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	write := func(key string, del bool) uint64 {
+		var readTs uint64
+		assert.Nil(t, db.Update(func(txn *badger.Txn) error {
+			readTs = txn.ReadTs()
+			_, _ = txn.Get([]byte(key))
+			if del {
+				return txn.Delete([]byte(key))
+			}
+			return txn.Set([]byte(key), []byte("v"))
+		}))
+		return readTs
+	}
+
+	readTs := write("g1", false)
+	first := committedVersion(db, []byte("g1"), readTs)
+	assert.True(t, first > readTs)
+
+	// later writes to the key and a longer key do not change it
+	write("g1", false)
+	write("g10", false)
+	assert.Equal(t, first, committedVersion(db, []byte("g1"), readTs))
+
+	readTs = write("g1", true)
+	assert.Equal(t, uint64(0), committedVersion(db, []byte("g1"), readTs))
+}
+
+func TestACL(t *testing.T) {
+	dir := t.TempDir()
+	write := func(acl string) string {
+		file := filepath.Join(dir, "acl.json")
+		assert.Nil(t, os.WriteFile(file, []byte(acl), 0600))
+		return file
+	}
+
+	tokens, err := loadACL(write(`{ "tokens": [ { "name": "t1", "token": "0123456789abcdef", "grants": [
+		{ "buckets": "ctl_*", "rights": "r" }, { "buckets": "games", "rights": "rwd" } ] } ] }`))
+	assert.Nil(t, err)
+	assert.True(t, tokens[0].allows("ctl_games", rightRead))
+	assert.False(t, tokens[0].allows("ctl_games", rightWrite))
+	assert.True(t, tokens[0].allows("games", rightDelete))
+	assert.False(t, tokens[0].allows("games", rightAdmin))
+	assert.False(t, tokens[0].allows("ct_games", rightRead))
+	assert.True(t, tokens[0].allowsAny("ctl_x"))
+	assert.False(t, tokens[0].allowsAny("x"))
+
+	_, err = loadACL(write(`{ "tokens": [ { "name": "t1", "token": "short" } ] }`))
+	assert.NotNil(t, err)
+	_, err = loadACL(write(`{ "tokens": [ { "name": "t1", "token": "0123456789abcdef", "grants": [ { "buckets": "*", "rights": "x" } ] } ] }`))
+	assert.NotNil(t, err)
+	_, err = loadACL(write(`{ "tokens": [ { "name": "t1", "token": "0123456789abcdef", "grants": [ { "buckets": "[", "rights": "r" } ] } ] }`))
+	assert.NotNil(t, err)
+	_, err = loadACL(write(`{ "tokens": [ { "name": "t1", "token": "0123456789abcdef" }, { "name": "t1", "token": "0123456789abcdeg" } ] }`))
+	assert.NotNil(t, err)
+	_, err = loadACL(filepath.Join(dir, "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestJWT(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"sub": "gateway", "exp": now + 60,
+		"relkv": []map[string]string{{"buckets": "ctl_*", "rights": "rw"}},
+	}
+
+	v := &jwtVerifier{hmacSecret: secret, claim: "relkv"}
+	for _, alg := range []string{"HS256", "HS384", "HS512"} {
+		token, err := v.verify(MakeJWT(alg, secret, claims))
+		assert.Nil(t, err, alg)
+		assert.Equal(t, "jwt:gateway", token.Name)
+		assert.True(t, token.allows("ctl_games", rightWrite))
+		assert.False(t, token.allows("ctl_games", rightDelete))
+		assert.False(t, token.allows("games", rightRead))
+	}
+
+	// Only the algorithms of the configured key
+	_, err = v.verify(MakeJWT("ES256", ecKey, claims))
+	assert.NotNil(t, err)
+	_, err = v.verify(MakeJWT("HS256", []byte("another secret"), claims))
+	assert.Equal(t, "invalid token signature", err.Error())
+	none := strings.Split(MakeJWT("HS256", secret, claims), ".")
+	none[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	_, err = v.verify(none[0] + "." + none[1] + ".")
+	assert.NotNil(t, err)
+
+	// Claims changed after signing
+	parts := strings.Split(MakeJWT("HS256", secret, claims), ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"gateway","exp":9999999999,"relkv":[{"buckets":"*","rights":"rwda"}]}`))
+	_, err = v.verify(strings.Join(parts, "."))
+	assert.Equal(t, "invalid token signature", err.Error())
+
+	// exp and nbf
+	expired := map[string]interface{}{"sub": "gateway", "exp": now - 60}
+	_, err = v.verify(MakeJWT("HS256", secret, expired))
+	assert.Equal(t, "token expired", err.Error())
+	v.leeway = 2 * time.Minute
+	_, err = v.verify(MakeJWT("HS256", secret, expired))
+	assert.Nil(t, err)
+	v.leeway = 0
+
+	_, err = v.verify(MakeJWT("HS256", secret, map[string]interface{}{"sub": "gateway"}))
+	assert.Equal(t, "token has no exp", err.Error())
+	_, err = v.verify(MakeJWT("HS256", secret, map[string]interface{}{"sub": "gateway", "exp": now + 120, "nbf": now + 60}))
+	assert.Equal(t, "token not valid yet", err.Error())
+
+	// iss, aud and the claim
+	v.issuer = "gw"
+	v.audience = "relkv"
+	_, err = v.verify(MakeJWT("HS256", secret, claims))
+	assert.Equal(t, "token issuer not accepted", err.Error())
+	_, err = v.verify(MakeJWT("HS256", secret, map[string]interface{}{"exp": now + 60, "iss": "gw", "aud": []string{"x", "relkv"}}))
+	assert.Nil(t, err)
+	_, err = v.verify(MakeJWT("HS256", secret, map[string]interface{}{"exp": now + 60, "iss": "gw", "aud": "x"}))
+	assert.Equal(t, "token audience not accepted", err.Error())
+	_, err = v.verify(MakeJWT("HS256", secret, map[string]interface{}{"exp": now + 60, "iss": "gw", "aud": "relkv",
+		"relkv": []map[string]string{{"buckets": "*", "rights": "x"}}}))
+	assert.NotNil(t, err)
+
+	// Public keys from a pem file
+	dir := t.TempDir()
+	writeKey := func(pub interface{}) string {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		assert.Nil(t, err)
+		file := filepath.Join(dir, "jwt.pem")
+		assert.Nil(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+		return file
+	}
+
+	key, err := loadPublicKey(writeKey(&ecKey.PublicKey))
+	assert.Nil(t, err)
+	v = &jwtVerifier{publicKey: key, claim: "relkv"}
+	token, err := v.verify(MakeJWT("ES256", ecKey, claims))
+	assert.Nil(t, err)
+	assert.True(t, token.allows("ctl_games", rightRead))
+	_, err = v.verify(MakeJWT("ES384", ecKey, claims))
+	assert.NotNil(t, err)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, err = v.verify(MakeJWT("ES256", otherKey, claims))
+	assert.Equal(t, "invalid token signature", err.Error())
+
+	key, err = loadPublicKey(writeKey(&rsaKey.PublicKey))
+	assert.Nil(t, err)
+	v = &jwtVerifier{publicKey: key, claim: "relkv"}
+	for _, alg := range []string{"RS256", "RS384", "RS512"} {
+		_, err = v.verify(MakeJWT(alg, rsaKey, claims))
+		assert.Nil(t, err, alg)
+	}
+	// The public key is not an hmac secret
+	pubPem, _ := os.ReadFile(filepath.Join(dir, "jwt.pem"))
+	_, err = v.verify(MakeJWT("HS256", pubPem, claims))
+	assert.NotNil(t, err)
+
+	_, err = loadPublicKey(filepath.Join(dir, "missing.pem"))
+	assert.NotNil(t, err)
+}
+
+func TestStatusFailing(t *testing.T) {
+	os.Unsetenv("STATUS_FAILING")
+	failing, err := loadStatusFailing()
+	assert.Nil(t, err)
+	assert.Equal(t, len(allStatusChecks), len(failing))
+
+	os.Setenv("STATUS_FAILING", "write_errors, backup_error")
+	defer os.Unsetenv("STATUS_FAILING")
+	failing, err = loadStatusFailing()
+	assert.Nil(t, err)
+	assert.True(t, failing[checkWriteErrors])
+	assert.True(t, failing[checkBackupError])
+	assert.False(t, failing[checkScpError])
+
+	os.Setenv("STATUS_FAILING", "")
+	failing, err = loadStatusFailing()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(failing))
+
+	os.Setenv("STATUS_FAILING", "backup")
+	_, err = loadStatusFailing()
+	assert.NotNil(t, err)
+}
+
+func TestRequestID(t *testing.T) {
+	assert.True(t, validRequestID("gateway-123"))
+	assert.False(t, validRequestID(""))
+	assert.False(t, validRequestID("has space"))
+	assert.False(t, validRequestID("line\nbreak"))
+	assert.False(t, validRequestID(strings.Repeat("x", 129)))
+	assert.NotEqual(t, newRequestID(), newRequestID())
+}
+
+func TestLogLevel(t *testing.T) {
+	assert.Equal(t, WARNING, convertLogLevel("WARN"))
+	assert.Equal(t, WARNING, convertLogLevel("WARNING"))
+	assert.Equal(t, ERROR, convertLogLevel("ERROR"))
+	assert.Panics(t, func() { convertLogLevel("TRACE") })
+}
+
+func TestAuditQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	entries, err := QueryAudit(path, &AuditQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	log, err := OpenAuditLog(path)
+	assert.Nil(t, err)
+	start := time.Unix(1000, 0).UTC()
+	log.Write(&AuditEntry{Time: start, Op: AUDIT_OP_SET, Bucket: "b1", Key: "g1"})
+	log.Write(&AuditEntry{Time: start.Add(time.Minute), Op: AUDIT_OP_SET, Bucket: "b2", Key: "g2"})
+	log.Write(&AuditEntry{Time: start.Add(2 * time.Minute), Op: AUDIT_OP_DELETE, Bucket: "b1", Key: "h1"})
+	log.Close()
+
+	entries, _ = QueryAudit(path, &AuditQuery{Bucket: "b1"})
+	assert.Equal(t, 2, len(entries))
+	entries, _ = QueryAudit(path, &AuditQuery{Prefix: "g"})
+	assert.Equal(t, 2, len(entries))
+	entries, _ = QueryAudit(path, &AuditQuery{From: start.Add(time.Minute), To: start.Add(2 * time.Minute)})
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "g2", entries[0].Key)
+	entries, _ = QueryAudit(path, &AuditQuery{Max: 1})
+	assert.Equal(t, 1, len(entries))
+
+	at, err := ParseAuditTime("1060")
+	assert.Nil(t, err)
+	assert.True(t, at.Equal(start.Add(time.Minute)))
+	at, err = ParseAuditTime("1970-01-01T00:16:40Z")
+	assert.Nil(t, err)
+	assert.True(t, at.Equal(start))
+	_, err = ParseAuditTime("yesterday")
+	assert.NotNil(t, err)
+
+	var none *AuditLog
+	assert.Nil(t, none.Write(&AuditEntry{}))
+}
+
+func TestLimiter(t *testing.T) {
+	l, err := newLimiter("token", 0, 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+	_, err = newLimiter("token", -1, 0, 0)
+	assert.NotNil(t, err)
+
+	now := time.Now()
+	l, _ = newLimiter("token", 2, 0, 0)
+	assert.Equal(t, 2.0, l.burst)
+	reason, _ := l.acquire("a", now)
+	assert.Equal(t, "", reason)
+	reason, _ = l.acquire("a", now)
+	assert.Equal(t, "", reason)
+	reason, wait := l.acquire("a", now)
+	assert.Equal(t, throttleReasonRate, reason)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	reason, _ = l.acquire("b", now)
+	assert.Equal(t, "", reason)
+	reason, _ = l.acquire("a", now.Add(500*time.Millisecond))
+	assert.Equal(t, "", reason)
+
+	// a refund gives the token back
+	l.release("a", true)
+	reason, _ = l.acquire("a", now.Add(500*time.Millisecond))
+	assert.Equal(t, "", reason)
+
+	// the addresses and bucket names are not counted one by one
+	req := httptest.NewRequest(http.MethodGet, "/b1/g1", nil)
+	token, bucket := throttleStatNames(req, "no_such_bucket")
+	assert.Equal(t, throttleNameAnonymous, token)
+	assert.Equal(t, throttleNameUnknown, bucket)
+
+	l, _ = newLimiter("bucket", 0, 0, 2)
+	l.acquire("a", now)
+	l.acquire("a", now)
+	reason, wait = l.acquire("a", now)
+	assert.Equal(t, throttleReasonInFlight, reason)
+	assert.Equal(t, time.Second, wait)
+	l.release("a", false)
+	reason, _ = l.acquire("a", now)
+	assert.Equal(t, "", reason)
+	l.release("a", false)
+	l.release("a", false)
+	assert.Equal(t, 0, len(l.states))
+
+	// a stream does not hold an in flight slot
+	l, _ = newLimiter("bucket", 0, 0, 1)
+	reason, _ = l.acquireStream("a", now)
+	assert.Equal(t, "", reason)
+	reason, _ = l.acquire("a", now)
+	assert.Equal(t, "", reason)
+
+	// the states idle for a refill period are removed
+	l, _ = newLimiter("token", 1, 2, 0)
+	l.acquire("a", now)
+	l.acquire("b", now)
+	l.release("a", false)
+	l.release("b", false)
+	assert.Equal(t, 2, len(l.states))
+	l.acquire("c", now.Add(time.Second))
+	assert.Equal(t, 3, len(l.states))
+	l.acquire("c", now.Add(2*time.Second))
+	assert.Equal(t, 1, len(l.states))
+}
+
+func TestScanTimeouts(t *testing.T) {
+	st, err := loadScanTimeouts()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), st.dflt)
+	assert.Equal(t, 300*time.Second, st.max)
+
+	// no limit unless asked for
+	req := httptest.NewRequest(http.MethodGet, "/bucket", nil)
+	timeout, err := st.timeout(req)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	req = httptest.NewRequest(http.MethodGet, "/bucket?timeout=10", nil)
+	timeout, _ = st.timeout(req)
+	assert.Equal(t, 10*time.Second, timeout)
+
+	// capped
+	req = httptest.NewRequest(http.MethodGet, "/bucket", nil)
+	req.Header.Set(HEADER_TIMEOUT_KEY, "3600")
+	timeout, _ = st.timeout(req)
+	assert.Equal(t, 300*time.Second, timeout)
+
+	req = httptest.NewRequest(http.MethodGet, "/bucket?timeout=0", nil)
+	_, err = st.timeout(req)
+	assert.NotNil(t, err)
+
+	os.Setenv("SCAN_TIMEOUT_SECONDS", "60")
+	defer os.Unsetenv("SCAN_TIMEOUT_SECONDS")
+	st, _ = loadScanTimeouts()
+	req = httptest.NewRequest(http.MethodGet, "/bucket", nil)
+	timeout, _ = st.timeout(req)
+	assert.Equal(t, 60*time.Second, timeout)
+
+	os.Setenv("SCAN_TIMEOUT_SECONDS", "0")
+	os.Setenv("SCAN_TIMEOUT_MAX_SECONDS", "0")
+	defer os.Unsetenv("SCAN_TIMEOUT_MAX_SECONDS")
+	st, _ = loadScanTimeouts()
+	req = httptest.NewRequest(http.MethodGet, "/bucket?timeout=3600", nil)
+	timeout, _ = st.timeout(req)
+	assert.Equal(t, time.Hour, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Nil(t, scanTruncated(context.Background()))
+	<-ctx.Done()
+	assert.Equal(t, "scan truncated: timeout", scanTruncated(ctx).Error())
+}
+
+func TestCheckValue(t *testing.T) {
+	assert.Nil(t, checkValue("K", "int", " 12 "))
+	assert.NotNil(t, checkValue("K", "int", "1.5"))
+	assert.Nil(t, checkValue("K", "float", "0.5"))
+	assert.Nil(t, checkValue("K", "bool", "1"))
+	assert.NotNil(t, checkValue("K", "bool", "yes"))
+	assert.Nil(t, checkValue("K", "ints", "0, 17,22"))
+	assert.NotNil(t, checkValue("K", "ints", "0,x"))
+	assert.Nil(t, checkValue("K", "level", "WARN"))
+	assert.NotNil(t, checkValue("K", "level", "TRACE"))
+	assert.Nil(t, checkValue("K", "int", ""))
+
+	values := map[string]string{"NOBACKUP": "1", "BK_HOURS": ""}
+	assert.Nil(t, checkValues(values))
+	values["NOBACKUP"] = "0"
+	assert.NotNil(t, checkValues(values))
+	values["BK_HOURS"] = "3"
+	assert.Nil(t, checkValues(values))
+	values["NOBACKUP"] = "off"
+	assert.Equal(t, "invalid value for NOBACKUP found off", checkValues(values).Error())
+
+	before := map[string]string{"A": "1", "B": "2"}
+	after := map[string]string{"A": "1", "B": "3", "C": "4"}
+	assert.Equal(t, []string{"B", "C"}, changedKeys([]string{"A", "B", "C"}, before, after))
+}
+
+func TestHTTPRouter(t *testing.T) {
+	// built without the settings loaded
+	router := (&BucketsDb{}).newHTTPRouter()
+	assert.Nil(t, router.Get("createBucket"))
+	assert.NotNil(t, router.Get("watch"))
+	assert.NotNil(t, router.Get("status"))
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	assert.Equal(t, []byte("h"), prefixSuccessor([]byte("g")))
+	assert.Equal(t, []byte("h"), prefixSuccessor([]byte("g\xff\xff")))
+	assert.Nil(t, prefixSuccessor([]byte("\xff\xff")))
+
+	k := &keyRange{prefix: []byte("g"), reverse: true}
+	assert.Equal(t, []byte("h"), k.seekKey())
+	selected, done := k.check([]byte("h"))
+	assert.False(t, selected)
+	assert.False(t, done)
+	selected, done = k.check([]byte("f"))
+	assert.False(t, selected)
+	assert.True(t, done)
 }
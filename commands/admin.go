@@ -0,0 +1,72 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/samlotti/relKV/cmd"
+	"github.com/samlotti/relKV/common"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// handleAdmin - sends the command to the running instance on the CMD_UNIX_SOCKET,
+// prints the data of the reply, exits with 12 if the command failed
+func handleAdmin(cmds []string) {
+	reply, err := sendAdmin(strings.Join(cmds, " "))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(12)
+	}
+	if reply.Code != http.StatusOK {
+		fmt.Printf("error %d: %s\n", reply.Code, reply.Error)
+		os.Exit(12)
+	}
+
+	var data interface{}
+	if len(reply.Data) > 0 && json.Unmarshal(reply.Data, &data) == nil {
+		if s, ok := data.(string); ok {
+			fmt.Println(s)
+			return
+		}
+		if lines, ok := data.([]interface{}); ok && reply.Command == common.ADMIN_CMD_HELP {
+			for _, line := range lines {
+				fmt.Println(" ", line)
+			}
+			return
+		}
+		out, _ := json.MarshalIndent(data, "", "  ")
+		fmt.Println(string(out))
+	}
+}
+
+// sendAdmin - one command and its reply
+func sendAdmin(line string) (*common.AdminReply, error) {
+	unixSocket := cmd.EnvironmentInstance.GetEnv("CMD_UNIX_SOCKET", "")
+	if len(unixSocket) == 0 {
+		return nil, fmt.Errorf("No socket defined in the environment variable: CMD_UNIX_SOCKET")
+	}
+
+	c, err := net.Dial("unix", unixSocket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to server: %s", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte(line + "\n")); err != nil {
+		return nil, fmt.Errorf("cannot send the command: %s", err)
+	}
+
+	reader := bufio.NewReader(c)
+	data, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("server disconnected")
+	}
+	reply := &common.AdminReply{}
+	if err := json.Unmarshal(data, reply); err != nil {
+		return nil, fmt.Errorf("invalid reply: %s", string(data))
+	}
+	return reply, nil
+}
@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/samlotti/relKV/cmd"
+	"os"
+)
+
+// handleAudit - prints the matching entries of the audit log, one json line each
+func handleAudit(cmds []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	bucket := fs.String("bucket", "", "only the changes of the bucket")
+	prefix := fs.String("prefix", "", "only the keys starting with the prefix")
+	from := fs.String("from", "", "changes at or after, RFC3339 or unix seconds")
+	to := fs.String("to", "", "changes before, RFC3339 or unix seconds")
+	max := fs.Int("max", 0, "maximum number of entries, 0 = all")
+	fs.Parse(cmds[1:])
+
+	auditFile := cmd.EnvironmentInstance.GetEnv("AUDIT_LOG", "")
+	if len(auditFile) == 0 {
+		fmt.Println("No audit log defined in the environment variable: AUDIT_LOG")
+		os.Exit(12)
+	}
+
+	q := &cmd.AuditQuery{Bucket: *bucket, Prefix: *prefix, Max: *max}
+	var err error
+	if q.From, err = cmd.ParseAuditTime(*from); err != nil {
+		fmt.Println(err)
+		os.Exit(12)
+	}
+	if q.To, err = cmd.ParseAuditTime(*to); err != nil {
+		fmt.Println(err)
+		os.Exit(12)
+	}
+
+	entries, err := cmd.QueryAudit(auditFile, q)
+	if err != nil {
+		fmt.Printf("error reading the audit log: %s\n", err)
+		os.Exit(12)
+	}
+	for _, entry := range entries {
+		data, _ := json.Marshal(entry)
+		fmt.Println(string(data))
+	}
+}
@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/samlotti/relKV/client"
+	"github.com/samlotti/relKV/cmd"
+	"net"
+	"net/http"
+	"os"
+)
+
+// newClient - the running server at HTTP_HOST with the SECRET of the .env.
+// With TLS_CERT the server certificate is trusted, it can be self signed.
+func newClient() (*client.Client, error) {
+	host := cmd.EnvironmentInstance.GetEnv("HTTP_HOST", "")
+	if len(host) == 0 {
+		return nil, fmt.Errorf("No host defined in the environment variable: HTTP_HOST")
+	}
+	// the server listens on all the interfaces, localhost like the server uses for itself
+	// so the name matches the certificate
+	if h, port, err := net.SplitHostPort(host); err == nil && (len(h) == 0 || h == "0.0.0.0" || h == "::") {
+		host = net.JoinHostPort("localhost", port)
+	}
+
+	scheme := "http"
+	hc := http.DefaultClient
+	if certFile := cmd.EnvironmentInstance.GetEnv("TLS_CERT", ""); len(certFile) > 0 {
+		config, err := clientTLSConfig(certFile)
+		if err != nil {
+			return nil, err
+		}
+		scheme = "https"
+		hc = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+
+	c := client.New(scheme+"://"+host, cmd.EnvironmentInstance.GetEnv("SECRET", ""))
+	c.SetHTTPClient(hc)
+	// AUTH_MODE=hmac, the secret is not sent
+	if cmd.EnvironmentInstance.GetEnv("AUTH_MODE", "") == "hmac" {
+		c.SetSigning("secret")
+	}
+	return c, nil
+}
+
+// clientTLSConfig - trusts the server certificate.
+//
+//	TLS_SERVER_NAME <- optional, the name in the server certificate when it is not the host
+//	TLS_CLIENT_CERT, TLS_CLIENT_KEY <- the client certificate when the server has TLS_CLIENT_CA
+func clientTLSConfig(certFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	roots.AppendCertsFromPEM(pem)
+	config := &tls.Config{RootCAs: roots, ServerName: cmd.EnvironmentInstance.GetEnv("TLS_SERVER_NAME", "")}
+
+	clientCert := cmd.EnvironmentInstance.GetEnv("TLS_CLIENT_CERT", "")
+	clientKey := cmd.EnvironmentInstance.GetEnv("TLS_CLIENT_KEY", "")
+	if len(clientCert) > 0 || len(clientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS_CLIENT_CERT / TLS_CLIENT_KEY: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,364 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/samlotti/relKV/client"
+	"github.com/samlotti/relKV/cmd"
+	"github.com/samlotti/relKV/common"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// exportPage - keys read per search request by export
+const exportPage = 1000
+
+// importBatch - default number of keys written per batch by import
+const importBatch = 500
+
+// exportEntry - one line of an export, the value is base64
+type exportEntry struct {
+	Key     string   `json:"key"`
+	Value   string   `json:"value"`
+	TTL     int64    `json:"ttl,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// fail - prints the error and exits with 12 like the other commands
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(12)
+}
+
+func mustClient() *client.Client {
+	c, err := newClient()
+	if err != nil {
+		fail(err)
+	}
+	return c
+}
+
+// parseArgs - the flags then count positional arguments, min of them required
+func parseArgs(fs *flag.FlagSet, cmds []string, min int, max int, usage string) []string {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: relKv %s\n", usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(cmds[1:])
+	args := fs.Args()
+	if len(args) < min || len(args) > max {
+		fs.Usage()
+		os.Exit(12)
+	}
+	return args
+}
+
+func printJSON(v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(data))
+}
+
+// handleGet - prints the value, with -json the key, value, ttl, version and aliases
+func handleGet(cmds []string) {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the key, value, ttl, version and aliases as json")
+	args := parseArgs(fs, cmds, 2, 2, "get [-json] {bucket} {key}")
+
+	item, err := mustClient().Get(context.Background(), args[0], args[1])
+	if err != nil {
+		fail(err)
+	}
+	if !*asJSON {
+		os.Stdout.Write(item.Value)
+		return
+	}
+	printJSON(&common.KV{Key: item.Key, Value: string(item.Value), TTL: item.TTL, Version: item.Version, Aliases: item.Aliases})
+}
+
+// handleSet - the value is the argument or stdin if not given or -
+func handleSet(cmds []string) {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	aliases := fs.String("aliases", "", "the aliases of the key ; separated, replaces the current ones")
+	ttl := fs.Int("ttl", 0, "seconds until the key expires, 0 = never")
+	args := parseArgs(fs, cmds, 2, 3, "set [-aliases a1;a2] [-ttl seconds] {bucket} {key} [value|-]")
+
+	var value []byte
+	if len(args) == 3 && args[2] != "-" {
+		value = []byte(args[2])
+	} else {
+		var err error
+		if value, err = io.ReadAll(os.Stdin); err != nil {
+			fail(err)
+		}
+	}
+
+	opts := &client.SetOptions{TTL: int64(*ttl)}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "aliases" {
+			opts.Aliases = splitAliases(*aliases)
+		}
+	})
+
+	version, err := mustClient().Set(context.Background(), args[0], args[1], value, opts)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("version %d\n", version)
+}
+
+// handleDel - deletes the key and its aliases
+func handleDel(cmds []string) {
+	fs := flag.NewFlagSet("del", flag.ExitOnError)
+	aliases := fs.String("aliases", "", "additional aliases to delete ; separated")
+	args := parseArgs(fs, cmds, 2, 2, "del [-aliases a1;a2] {bucket} {key}")
+
+	deleted, err := mustClient().Delete(context.Background(), args[0], args[1], &client.DeleteOptions{Aliases: splitAliases(*aliases)})
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("deleted %d\n", deleted)
+}
+
+// splitAliases - the ; separated aliases of a flag, empty for none
+func splitAliases(aliases string) []string {
+	if len(aliases) == 0 {
+		return []string{}
+	}
+	return strings.Split(aliases, common.HEADER_ALIAS_SEPARATOR)
+}
+
+// handleSearch - a table of the keys, or a json line per key
+func handleSearch(cmds []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "keys starting with the prefix")
+	segments := fs.String("segments", "", "keys with the segments, : separated")
+	skip := fs.Int("skip", 0, "keys to skip")
+	max := fs.Int("max", 0, "maximum number of keys, 0 = all")
+	cursor := fs.String("cursor", "", "continue a previous search")
+	reverse := fs.Bool("reverse", false, "descending order")
+	values := fs.Bool("values", false, "include the values")
+	asJSON := fs.Bool("json", false, "one json line per key")
+	args := parseArgs(fs, cmds, 1, 1, "search [-prefix p] [-segments s1:s2] [-skip n] [-max n] [-cursor c] [-reverse] [-values] [-json] {bucket}")
+
+	opts := &client.SearchOptions{Prefix: *prefix, Skip: *skip, Max: *max, Cursor: *cursor, Reverse: *reverse, Values: *values}
+	if len(*segments) > 0 {
+		opts.Segments = strings.Split(*segments, common.HEADER_SEGMENT_SEPARATOR)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !*asJSON {
+		fmt.Fprintln(w, "KEY\tVERSION\tTTL\tVALUE")
+	}
+	next, err := mustClient().SearchEach(context.Background(), args[0], opts, func(kv *common.KV) error {
+		if *asJSON {
+			data, _ := json.Marshal(kv)
+			fmt.Println(string(data))
+		} else {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", kv.Key, kv.Version, kv.TTL, kv.Value)
+		}
+		return nil
+	})
+	w.Flush()
+	if len(next) > 0 {
+		fmt.Fprintf(os.Stderr, "more keys, continue with -cursor %s\n", next)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// handleList - the buckets the token has access to
+func handleList(cmds []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print as json")
+	parseArgs(fs, cmds, 0, 0, "list [-json]")
+
+	buckets, err := mustClient().ListBuckets(context.Background())
+	if err != nil {
+		fail(err)
+	}
+	if *asJSON {
+		printJSON(buckets)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BUCKET\tLSM\tVLOG\tERROR")
+	for _, bk := range buckets {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", bk.Name, bk.LsmSize, bk.VlogSize, bk.Error)
+	}
+	w.Flush()
+}
+
+// handleMkBucket - creates the bucket, the server requires ALLOW_CREATE_DB
+func handleMkBucket(cmds []string) {
+	fs := flag.NewFlagSet("mkbucket", flag.ExitOnError)
+	args := parseArgs(fs, cmds, 1, 1, "mkbucket {bucket}")
+
+	if err := mustClient().CreateBucket(context.Background(), args[0]); err != nil {
+		fail(err)
+	}
+	fmt.Printf("created %s\n", args[0])
+}
+
+// handleStatus - the status of the server, from the admin socket if CMD_UNIX_SOCKET is set unless -http
+func handleStatus(cmds []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	useHttp := fs.Bool("http", false, "ask the server at HTTP_HOST")
+	asJSON := fs.Bool("json", false, "print as json")
+	parseArgs(fs, cmds, 0, 0, "status [-http] [-json]")
+
+	status := &common.StatusReport{}
+	if *useHttp || len(cmd.EnvironmentInstance.GetEnv("CMD_UNIX_SOCKET", "")) == 0 {
+		var err error
+		if status, err = mustClient().Status(context.Background()); err != nil {
+			fail(err)
+		}
+	} else {
+		reply, err := sendAdmin(common.ADMIN_CMD_STATUS)
+		if err != nil {
+			fail(err)
+		}
+		if reply.Code != http.StatusOK {
+			fail(fmt.Errorf("error %d: %s", reply.Code, reply.Error))
+		}
+		if err := json.Unmarshal(reply.Data, status); err != nil {
+			fail(err)
+		}
+	}
+
+	if *asJSON {
+		printJSON(status)
+	} else {
+		printStatus(status)
+	}
+	if status.Status == common.STATUS_FAILING {
+		os.Exit(12)
+	}
+}
+
+func printStatus(status *common.StatusReport) {
+	fmt.Printf("status: %s, state: %s, version: %s\n", status.Status, status.State, status.Version)
+	for _, check := range status.Checks {
+		fmt.Printf("  %s: %s %s\n", check.Level, check.Name, check.Message)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BUCKET\tOPEN\tWRITES\tDELETES\tWRITE ERRORS\tLAST ERROR")
+	for _, bk := range status.Buckets {
+		fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%d\t%s\n", bk.Name, bk.Open, bk.Writes, bk.Deletes, bk.WriteErrors, bk.LastError)
+	}
+	w.Flush()
+}
+
+// handleExport - one json line per key with its aliases, the values are base64
+func handleExport(cmds []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "keys starting with the prefix")
+	args := parseArgs(fs, cmds, 1, 2, "export [-prefix p] {bucket} [file]")
+
+	out := os.Stdout
+	if len(args) == 2 {
+		f, err := os.Create(args[1])
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	c := mustClient()
+	opts := &client.SearchOptions{Prefix: *prefix, Max: exportPage, Values: true, B64: true, WithAliases: true}
+	count := 0
+	for {
+		cursor, err := c.SearchEach(context.Background(), args[0], opts, func(kv *common.KV) error {
+			// written with their key
+			if len(kv.Alias) > 0 {
+				return nil
+			}
+			data, err := json.Marshal(&exportEntry{Key: kv.Key, Value: kv.Value, TTL: kv.TTL, Aliases: kv.Aliases})
+			if err != nil {
+				return err
+			}
+			count++
+			w.Write(data)
+			return w.WriteByte('\n')
+		})
+		if err != nil {
+			w.Flush()
+			fail(err)
+		}
+		if len(cursor) == 0 {
+			break
+		}
+		opts.Cursor = cursor
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", count)
+}
+
+// handleImport - writes the lines of an export in batches, a failed batch stops the import
+func handleImport(cmds []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	batch := fs.Int("batch", importBatch, "keys per transaction")
+	args := parseArgs(fs, cmds, 1, 2, "import [-batch n] {bucket} [file]")
+	if *batch <= 0 {
+		fail(fmt.Errorf("invalid batch: %d", *batch))
+	}
+
+	in := os.Stdin
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	c := mustClient()
+	count := 0
+	var ops []*common.BatchOp
+	send := func() {
+		if len(ops) == 0 {
+			return
+		}
+		if _, err := c.Batch(context.Background(), args[0], ops, true); err != nil {
+			fail(fmt.Errorf("imported %d keys, %s", count, err))
+		}
+		count += len(ops)
+		ops = ops[:0]
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		entry := &exportEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			fail(fmt.Errorf("line %d: %s", line, err))
+		}
+		if _, err := base64.StdEncoding.DecodeString(entry.Value); err != nil {
+			fail(fmt.Errorf("line %d: the value is not base64", line))
+		}
+		ops = append(ops, &common.BatchOp{Op: "set", Key: entry.Key, Value: entry.Value, Aliases: entry.Aliases, TTL: entry.TTL})
+		if len(ops) >= *batch {
+			send()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail(err)
+	}
+	send()
+	fmt.Fprintf(os.Stderr, "imported %d keys\n", count)
+}
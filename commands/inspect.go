@@ -0,0 +1,177 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/samlotti/relKV/cmd"
+	"github.com/samlotti/relKV/common"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const inspectUsage = "inspect {keys|get|count|versions|info|orphans} [options] {bucket} [key]"
+
+// handleInspect - reads a bucket under DB_PATH read-only, the server must be stopped
+func handleInspect(cmds []string) {
+	if len(cmds) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: relKv %s\n", inspectUsage)
+		os.Exit(12)
+	}
+	sub := cmds[1:]
+
+	fs := flag.NewFlagSet("inspect "+sub[0], flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print as json")
+	switch sub[0] {
+	case "keys":
+		prefix := fs.String("prefix", "", "keys starting with the prefix")
+		max := fs.Int("max", 0, "maximum number of keys, 0 = all")
+		args := parseArgs(fs, sub, 1, 1, "inspect keys [-prefix p] [-max n] [-json] {bucket}")
+		inspectKeys(openInspector(args[0]), *prefix, *max, *asJSON)
+	case "get":
+		args := parseArgs(fs, sub, 2, 2, "inspect get [-json] {bucket} {key}")
+		inspectGet(openInspector(args[0]), args[1], *asJSON)
+	case "count":
+		prefix := fs.String("prefix", "", "keys starting with the prefix")
+		args := parseArgs(fs, sub, 1, 1, "inspect count [-prefix p] [-json] {bucket}")
+		in := openInspector(args[0])
+		defer in.Close()
+		count, err := in.Count(*prefix)
+		if err != nil {
+			fail(err)
+		}
+		if *asJSON {
+			printJSON(count)
+		} else {
+			fmt.Printf("keys: %d, aliases: %d, hidden: %d\n", count.Keys, count.Aliases, count.Hidden)
+		}
+	case "versions":
+		args := parseArgs(fs, sub, 2, 2, "inspect versions [-json] {bucket} {key}")
+		inspectVersions(openInspector(args[0]), args[1], *asJSON)
+	case "info":
+		args := parseArgs(fs, sub, 1, 1, "inspect info [-json] {bucket}")
+		inspectInfo(openInspector(args[0]), *asJSON)
+	case "orphans":
+		args := parseArgs(fs, sub, 1, 1, "inspect orphans [-json] {bucket}")
+		in := openInspector(args[0])
+		defer in.Close()
+		report, err := in.Orphans()
+		if err != nil {
+			fail(err)
+		}
+		if *asJSON {
+			printJSON(report)
+			return
+		}
+		fmt.Printf("aliases: %d, orphans: %d\n", report.Scanned, report.Orphans)
+		for _, key := range report.Keys {
+			fmt.Println(" ", key)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "usage: relKv %s\n", inspectUsage)
+		os.Exit(12)
+	}
+}
+
+func openInspector(bucket string) *cmd.Inspector {
+	in, err := cmd.OpenInspector(bucket)
+	if err != nil {
+		fail(err)
+	}
+	return in
+}
+
+func inspectKeys(in *cmd.Inspector, prefix string, max int, asJSON bool) {
+	defer in.Close()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !asJSON {
+		fmt.Fprintln(w, "KEY\tVERSION\tTTL\tALIAS OF\tALIASES")
+	}
+	err := in.Keys(prefix, max, func(kv *common.KV) error {
+		if asJSON {
+			data, _ := json.Marshal(kv)
+			fmt.Println(string(data))
+		} else {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", kv.Key, kv.Version, kv.TTL, kv.Alias, strings.Join(kv.Aliases, common.HEADER_ALIAS_SEPARATOR))
+		}
+		return nil
+	})
+	w.Flush()
+	if err != nil {
+		fail(err)
+	}
+}
+
+func inspectGet(in *cmd.Inspector, key string, asJSON bool) {
+	defer in.Close()
+	kv, err := in.Get(key)
+	if err != nil {
+		fail(fmt.Errorf("%s: %s", err, key))
+	}
+	if asJSON {
+		printJSON(kv)
+		return
+	}
+	if len(kv.Alias) > 0 {
+		fmt.Fprintf(os.Stderr, "alias of %s\n", kv.Alias)
+	}
+	if len(kv.Error) > 0 {
+		fail(errors.New(kv.Error))
+	}
+	os.Stdout.Write([]byte(kv.Value))
+}
+
+func inspectVersions(in *cmd.Inspector, key string, asJSON bool) {
+	defer in.Close()
+	versions, err := in.Versions(key)
+	if err != nil {
+		fail(err)
+	}
+	if asJSON {
+		printJSON(versions)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tDELETED\tEXPIRES\tALIAS\tSIZE")
+	for _, v := range versions {
+		expires := ""
+		if v.ExpiresAt > 0 {
+			expires = time.Unix(int64(v.ExpiresAt), 0).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%t\t%s\t%t\t%d\n", v.Version, v.Deleted, expires, v.Alias, v.Size)
+	}
+	w.Flush()
+}
+
+func inspectInfo(in *cmd.Inspector, asJSON bool) {
+	defer in.Close()
+	info, err := in.Info()
+	if err != nil {
+		fail(err)
+	}
+	if asJSON {
+		printJSON(info)
+		return
+	}
+
+	fmt.Printf("bucket: %s, lsm: %d, vlog: %d, max version: %d\n", info.Bucket, info.LsmSize, info.VlogSize, info.MaxVersion)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LEVEL\tTABLES\tSIZE\tTARGET\tSTALE")
+	for _, l := range info.Levels {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\n", l.Level, l.Tables, l.Size, l.TargetSize, l.StaleSize)
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "TABLE\tLEVEL\tKEYS\tSIZE\tSTALE\tMAX VERSION\tLEFT\tRIGHT")
+	for _, t := range info.Tables {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%q\t%q\n", t.ID, t.Level, t.Keys, t.Size, t.StaleSize, t.MaxVersion, t.Left, t.Right)
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "VLOG FILE\tSIZE")
+	for _, f := range info.VlogFiles {
+		fmt.Fprintf(w, "%s\t%d\n", f.Name, f.Size)
+	}
+	w.Flush()
+}
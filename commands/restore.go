@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/samlotti/relKV/cmd"
+	"github.com/samlotti/relKV/common"
 	"io"
 	"log"
 	"math"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strings"
 )
@@ -104,5 +106,27 @@ func do_restore(file io.ReadCloser, dest string) {
 		os.Exit(12)
 	} else {
 		log.Printf("database %s restored", dest)
+		auditRestore(dest, file)
+	}
+}
+
+// auditRestore - records the restore when AUDIT_LOG is set
+func auditRestore(dest string, file io.ReadCloser) {
+	auditLog, err := cmd.OpenAuditLog(cmd.EnvironmentInstance.GetEnv("AUDIT_LOG", ""))
+	if err != nil {
+		log.Printf("restore not recorded in the audit log: %s", err)
+		return
+	}
+	defer auditLog.Close()
+
+	entry := &common.AuditEntry{Op: common.AUDIT_OP_RESTORE, Bucket: dest, Remote: "local"}
+	if f, ok := file.(*os.File); ok {
+		entry.Detail = f.Name()
+	}
+	if u, err := user.Current(); err == nil {
+		entry.User = "os:" + u.Username
+	}
+	if err = auditLog.Write(entry); err != nil {
+		log.Printf("restore not recorded in the audit log: %s", err)
 	}
 }
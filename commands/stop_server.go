@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/samlotti/relKV/cmd"
 	"log"
-	"net"
 )
 
 func ProcessCommands(cmds []string) {
@@ -18,10 +17,32 @@ func ProcessCommands(cmds []string) {
 	switch cmds[0] {
 	case "help":
 		handleHelp()
-	case "stop":
-		handleStop()
+	case "get":
+		handleGet(cmds)
+	case "set":
+		handleSet(cmds)
+	case "del":
+		handleDel(cmds)
+	case "search":
+		handleSearch(cmds)
+	case "list":
+		handleList(cmds)
+	case "mkbucket":
+		handleMkBucket(cmds)
+	case "export":
+		handleExport(cmds)
+	case "import":
+		handleImport(cmds)
+	case "status":
+		handleStatus(cmds)
+	case "stop", "buckets", "create", "close", "backup", "gc", "flatten", "loglevel", "reload":
+		handleAdmin(cmds)
 	case "restore":
 		handleRestore(cmds)
+	case "audit":
+		handleAudit(cmds)
+	case "inspect":
+		handleInspect(cmds)
 	default:
 		log.Fatal("Invalid command: ", cmds[0])
 		handleHelp()
@@ -31,30 +52,37 @@ func ProcessCommands(cmds []string) {
 func handleHelp() {
 	fmt.Println("Commands are: ")
 	fmt.Println(" stop -> stop the running instance ")
+	fmt.Println(" status [-http] [-json] -> the status report of the running instance ")
+	fmt.Println(" buckets -> the buckets of the running instance ")
+	fmt.Println(" create {bucket} -> create or open a bucket ")
+	fmt.Println(" close {bucket} -> close a bucket ")
+	fmt.Println(" backup [bucket] -> start a backup, all the open buckets if not given ")
+	fmt.Println(" gc [bucket] -> run a value log gc cycle, all the open buckets if not given ")
+	fmt.Println(" flatten {bucket} [workers] -> compact the LSM tree of a bucket ")
+	fmt.Println(" loglevel {DEBUG|INFO|WARNING|ERROR} -> change the log level until the next reload ")
+	fmt.Println(" reload -> reload the config ")
+	fmt.Println("     these commands use the CMD_UNIX_SOCKET of the running instance ")
+	fmt.Println(" get [-json] {bucket} {key} -> print the value of a key ")
+	fmt.Println(" set [-aliases a1;a2] [-ttl seconds] {bucket} {key} [value] -> the value is read from stdin if not given ")
+	fmt.Println(" del [-aliases a1;a2] {bucket} {key} -> delete a key and its aliases ")
+	fmt.Println(" search [-prefix p] [-segments s1:s2] [-skip n] [-max n] [-cursor c] [-reverse] [-values] [-json] {bucket} ")
+	fmt.Println(" list [-json] -> list the buckets ")
+	fmt.Println(" mkbucket {bucket} -> create a bucket, the server requires ALLOW_CREATE_DB ")
+	fmt.Println(" export [-prefix p] {bucket} [file] -> write the keys with their aliases, one json line each ")
+	fmt.Println(" import [-batch n] {bucket} [file] -> write the keys of an export ")
+	fmt.Println("     these commands use HTTP_HOST and SECRET, add -json for json output ")
 	fmt.Println(" restore -> restore a backup file ")
 	fmt.Println("     restore {backupfilename} {databaseName}")
+	fmt.Println(" audit -> list the changes from the AUDIT_LOG file ")
+	fmt.Println("     audit [-bucket name] [-prefix keyPrefix] [-from time] [-to time] [-max n]")
+	fmt.Println("     time is RFC3339 or unix seconds")
+	fmt.Println(" inspect -> read a bucket under DB_PATH, the server must be stopped ")
+	fmt.Println("     inspect keys [-prefix p] [-max n] {bucket} ")
+	fmt.Println("     inspect get {bucket} {key} ")
+	fmt.Println("     inspect count [-prefix p] {bucket} ")
+	fmt.Println("     inspect versions {bucket} {key} ")
+	fmt.Println("     inspect info {bucket} -> the LSM tables and value log files ")
+	fmt.Println("     inspect orphans {bucket} -> the aliases pointing to a missing key ")
+	fmt.Println("     add -json for json output ")
 
 }
-
-func handleStop() {
-
-	unixSocket := cmd.EnvironmentInstance.GetEnv("CMD_UNIX_SOCKET", "")
-	if len(unixSocket) == 0 {
-		fmt.Println("No socket defined in the environment variable: CMD_UNIX_SOCKET")
-	}
-
-	c, err := net.Dial("unix", unixSocket)
-	if err != nil {
-		log.Fatal("cannot connect to server:", err.Error())
-	}
-	defer c.Close()
-
-	c.Write([]byte("stop\n"))
-
-	buf := make([]byte, 1024)
-	n, err := c.Read(buf[:])
-	if err != nil {
-		log.Fatal("server disconnected")
-	}
-	log.Printf("Server response: %s", string(buf[0:n]))
-}
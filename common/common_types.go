@@ -1,13 +1,63 @@
 package common
 
 import (
+	"encoding/json"
 	"time"
 )
 
 type KV struct {
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
-	Error string `json:"error,omitempty"`
+	Key     string   `json:"key,omitempty"`
+	Value   string   `json:"value,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	TTL     int64    `json:"ttl,omitempty"`     // seconds remaining, 0 = does not expire
+	Version uint64   `json:"version,omitempty"` // badger version, same value as the ETag
+	Alias   string   `json:"alias,omitempty"`   // with_aliases, the key of an alias
+	Aliases []string `json:"aliases,omitempty"` // with_aliases, the aliases of a key
+}
+
+// BatchOp - a single set or delete in a batch write
+type BatchOp struct {
+	Op      string   `json:"op"` // set or del
+	Key     string   `json:"key"`
+	Value   string   `json:"value,omitempty"` // base64 if b64 was requested
+	Aliases []string `json:"aliases,omitempty"`
+	TTL     int64    `json:"ttl,omitempty"`
+}
+
+// BatchResult - the outcome of a BatchOp, in the same order as the request
+type BatchResult struct {
+	Op           string `json:"op"`
+	Key          string `json:"key"`
+	Status       int    `json:"status"`
+	Version      uint64 `json:"version,omitempty"`
+	Deleted      int    `json:"deleted,omitempty"`
+	DuplicateKey string `json:"duplicate_key,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ChangeEvent - a key change sent by the watch endpoint, the version is also the event id
+type ChangeEvent struct {
+	Op      string `json:"op"` // set or del
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+	Value   string `json:"value,omitempty"` // only if values were requested, the key for an alias
+	Alias   bool   `json:"alias,omitempty"`
+}
+
+// CountResult - the number of keys selected, Groups has the count per value of the group segment
+type CountResult struct {
+	Bucket string         `json:"bucket"`
+	Count  int            `json:"count"`
+	Groups map[string]int `json:"groups,omitempty"`
+}
+
+// OrphanReport - the result of scanning a bucket for aliases that point to a missing key
+type OrphanReport struct {
+	Bucket  string   `json:"bucket"`
+	Scanned int      `json:"scanned"` // number of aliases checked
+	Orphans int      `json:"orphans"`
+	Deleted int      `json:"deleted"`
+	Keys    []string `json:"keys"` // the orphaned aliases, limited to the first 1000
 }
 
 type BucketData struct {
@@ -37,3 +87,208 @@ type ScpJob struct {
 	LastEnd    time.Time
 	NextSend   time.Time
 }
+
+// Status levels, the checks that are failing make the status return 500
+const (
+	STATUS_OK       = "ok"
+	STATUS_DEGRADED = "degraded"
+	STATUS_FAILING  = "failing"
+)
+
+// StatusReport - the json variant of /status
+type StatusReport struct {
+	Version          string          `json:"version"`
+	Status           string          `json:"status"` // ok, degraded or failing
+	State            string          `json:"state"`  // starting, running or stopped
+	Start            time.Time       `json:"start"`
+	Uptime           string          `json:"uptime"`
+	BackupsEnabled   bool            `json:"backupsEnabled"`
+	BackupHours      string          `json:"backupHours,omitempty"`
+	BackupGraceHours int             `json:"backupGraceHours"`
+	Checks           []*StatusCheck  `json:"checks"`
+	Buckets          []*BucketStatus `json:"buckets"`
+	Backups          []*BackupStatus `json:"backups,omitempty"`
+	ScpJobs          []*ScpJobStatus `json:"scpJobs,omitempty"`
+	Throttled        []*ThrottleStat `json:"throttled,omitempty"`
+	Reload           *ReloadStatus   `json:"reload,omitempty"`
+}
+
+// StatusCheck - a condition found by the status, the level is degraded or failing
+type StatusCheck struct {
+	Name    string `json:"name"`
+	Bucket  string `json:"bucket,omitempty"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+type BucketStatus struct {
+	Name           string     `json:"name"`
+	Open           bool       `json:"open"`
+	Writes         int64      `json:"writes"`
+	Deletes        int64      `json:"deletes"`
+	WriteErrors    int64      `json:"writeErrors"`
+	SeqWriteErrors int64      `json:"seqWriteErrors"` // in a row, reset by a successful write
+	LastError      string     `json:"lastError,omitempty"`
+	GCCycles       int64      `json:"gcCycles"`
+	GCNoRewrite    int64      `json:"gcNoRewrite"`
+	Orphans        int64      `json:"orphans"`
+	OrphansDeleted int64      `json:"orphansDeleted"`
+	LastOrphanScan *time.Time `json:"lastOrphanScan,omitempty"`
+	LsmSize        int64      `json:"lsmSize"`
+	VlogSize       int64      `json:"vlogSize"`
+}
+
+type BackupStatus struct {
+	Bucket      string     `json:"bucket"`
+	Status      string     `json:"status"` // empty if not run since the start
+	LastStart   *time.Time `json:"lastStart,omitempty"`
+	LastEnd     *time.Time `json:"lastEnd,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Duration    string     `json:"duration"`
+	Message     string     `json:"message,omitempty"`
+}
+
+type ScpJobStatus struct {
+	Bucket    string     `json:"bucket"`
+	Status    string     `json:"status"` // pending, running, complete or error
+	Duration  string     `json:"duration"`
+	NextSend  *time.Time `json:"nextSend,omitempty"`
+	LastStart *time.Time `json:"lastStart,omitempty"`
+	Message   string     `json:"message,omitempty"`
+}
+
+// ThrottleStat - requests refused with 429 since the start
+type ThrottleStat struct {
+	Scope  string `json:"scope"`  // token or bucket
+	Name   string `json:"name"`   // the token name or client address, or the bucket
+	Reason string `json:"reason"` // rate or inflight
+	Count  int64  `json:"count"`
+}
+
+// ReloadStatus - the result of the last config reload, on an error the previous settings are kept
+type ReloadStatus struct {
+	Time            time.Time `json:"time"`
+	Trigger         string    `json:"trigger"` // sighup or file
+	Ok              bool      `json:"ok"`
+	Error           string    `json:"error,omitempty"`
+	Applied         []string  `json:"applied,omitempty"`         // settings changed and in use
+	RestartRequired []string  `json:"restartRequired,omitempty"` // settings changed that are not used until a restart
+}
+
+// ProbeResult - the response of /livez and /readyz
+type ProbeResult struct {
+	Status string   `json:"status"` // ok or failing
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Audit operations
+const (
+	AUDIT_OP_SET           = "set"
+	AUDIT_OP_DELETE        = "del"
+	AUDIT_OP_DELETE_KEYS   = "delete_keys"
+	AUDIT_OP_CREATE_BUCKET = "create_bucket"
+	AUDIT_OP_RESTORE       = "restore"
+)
+
+// AuditEntry - a change recorded in the audit log
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key,omitempty"`
+	Aliases   []string  `json:"aliases,omitempty"`
+	Version   uint64    `json:"version,omitempty"` // of the key after a set
+	Count     int       `json:"count,omitempty"`   // keys deleted including the aliases
+	Detail    string    `json:"detail,omitempty"`  // selection of delete_keys, file of a restore
+	User      string    `json:"user,omitempty"`    // the token name, secret for SECRET
+	Remote    string    `json:"remote,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// Commands of the admin protocol on the CMD_UNIX_SOCKET, one command per line with the arguments separated by spaces
+const (
+	ADMIN_CMD_HELP     = "help"
+	ADMIN_CMD_STATUS   = "status"
+	ADMIN_CMD_BUCKETS  = "buckets"
+	ADMIN_CMD_CREATE   = "create"   // create {bucket}
+	ADMIN_CMD_CLOSE    = "close"    // close {bucket}
+	ADMIN_CMD_BACKUP   = "backup"   // backup [bucket]
+	ADMIN_CMD_GC       = "gc"       // gc [bucket]
+	ADMIN_CMD_FLATTEN  = "flatten"  // flatten {bucket} [workers]
+	ADMIN_CMD_LOGLEVEL = "loglevel" // loglevel {DEBUG|INFO|WARNING|ERROR}
+	ADMIN_CMD_RELOAD   = "reload"
+	ADMIN_CMD_STOP     = "stop"
+	ADMIN_CMD_QUIT     = "quit" // ends the connection
+)
+
+// AdminReply - the reply to a command, one json line per command.
+// Code is an http status code, 200 when the command worked.
+type AdminReply struct {
+	Command string          `json:"command"`
+	Code    int             `json:"code"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// AdminGC - the result of a value log gc cycle on a bucket
+type AdminGC struct {
+	Bucket    string `json:"bucket"`
+	Rewritten bool   `json:"rewritten"`
+	Error     string `json:"error,omitempty"`
+}
+
+// InspectCount - the entries of a bucket read by inspect, with the server stopped
+type InspectCount struct {
+	Bucket  string `json:"bucket"`
+	Prefix  string `json:"prefix,omitempty"`
+	Keys    int    `json:"keys"`    // primary keys
+	Aliases int    `json:"aliases"` // alias keys
+	Hidden  int    `json:"hidden"`  // entries maintained by the server, the alias lists
+}
+
+// KeyVersion - a version of a key still in the LSM tree
+type KeyVersion struct {
+	Version   uint64 `json:"version"`
+	Deleted   bool   `json:"deleted,omitempty"` // deleted or expired
+	ExpiresAt uint64 `json:"expiresAt,omitempty"`
+	Alias     bool   `json:"alias,omitempty"`
+	Size      int64  `json:"size"` // estimated size of the key and value
+}
+
+// InspectLevel - a level of the LSM tree
+type InspectLevel struct {
+	Level      int   `json:"level"`
+	Tables     int   `json:"tables"`
+	Size       int64 `json:"size"`
+	TargetSize int64 `json:"targetSize"`
+	StaleSize  int64 `json:"staleSize"`
+}
+
+// InspectTable - a table of the LSM tree
+type InspectTable struct {
+	ID         uint64 `json:"id"`
+	Level      int    `json:"level"`
+	Left       string `json:"left"`
+	Right      string `json:"right"`
+	Keys       uint32 `json:"keys"`
+	Size       uint32 `json:"size"`
+	StaleSize  uint32 `json:"staleSize"`
+	MaxVersion uint64 `json:"maxVersion"`
+}
+
+// InspectFile - a value log file
+type InspectFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// InspectInfo - the LSM tree and value log of a bucket
+type InspectInfo struct {
+	Bucket     string          `json:"bucket"`
+	LsmSize    int64           `json:"lsmSize"`
+	VlogSize   int64           `json:"vlogSize"`
+	MaxVersion uint64          `json:"maxVersion"`
+	Levels     []*InspectLevel `json:"levels"`
+	Tables     []*InspectTable `json:"tables"`
+	VlogFiles  []*InspectFile  `json:"vlogFiles"`
+}
@@ -1,7 +1,26 @@
 package common
 
 const (
-	BADGER_FLAG_ALIAS = 1
+	BADGER_FLAG_ALIAS       = 1
+	BADGER_FLAG_ALIAS_INDEX = 2
+	// Set on the keys written, badger only publishes the user meta so a change without a flag is a delete
+	BADGER_FLAG_VALUE = 4
+
+	// Hidden entries listing the aliases of a primary key, not visible to clients
+	ALIAS_INDEX_PREFIX = "\x00aliases\x00"
+
+	BATCH_OP_SET    = "set"
+	BATCH_OP_DELETE = "del"
+
+	// 100 years, larger values overflow the expiry time
+	MAX_TTL_SECONDS = 100 * 365 * 24 * 3600
+
+	// error_code of a request to a bucket that is not open, and of a bucket name that is not valid
+	ERROR_CODE_BUCKET_NOT_FOUND = "bucket_not_found"
+	ERROR_CODE_INVALID_BUCKET   = "invalid_bucket_name"
+
+	WATCH_EVENT_SET    = "set"
+	WATCH_EVENT_DELETE = "del"
 
 	HEADER_B64_KEY              = "b64"
 	HEADER_SKIP_KEY             = "skip"
@@ -13,7 +32,32 @@ const (
 	HEADER_ALIAS_SEPARATOR      = ";"
 	HEADER_SEGMENT_KEY          = "segments"
 	HEADER_SEGMENT_SEPARATOR    = ":"
+	HEADER_TTL_KEY              = "ttl"
+	HEADER_START_KEY            = "start"
+	HEADER_START_EXCLUSIVE_KEY  = "start_ex"
+	HEADER_END_KEY              = "end"
+	HEADER_END_INCLUSIVE_KEY    = "end_in"
+	HEADER_REVERSE_KEY          = "reverse"
+	HEADER_CURSOR_KEY           = "cursor"
+	HEADER_IF_MATCH             = "If-Match"
+	HEADER_IF_NONE_MATCH        = "If-None-Match"
+	HEADER_SINCE_KEY            = "since"
+	HEADER_GROUP_KEY            = "group"
+	HEADER_FORMAT_KEY           = "format"
+	HEADER_FROM_KEY             = "from"
+	HEADER_TO_KEY               = "to"
+	HEADER_TIMEOUT_KEY          = "timeout"
+	HEADER_WITH_ALIASES_KEY     = "with_aliases"
+	HEADER_LAST_EVENT_ID        = "Last-Event-ID"
+	HEADER_AUTHORIZATION        = "Authorization"
+	HEADER_REQUEST_ID           = "X-Request-ID"
 	RESP_HEADER_RELDB_FUNCTION  = "func"
 	RESP_HEADER_DUPLICATE_ERROR = "duplicate_key"
 	RESP_HEADER_ERROR_MSG       = "error_msg"
+	RESP_HEADER_ERROR_CODE      = "error_code"
+	RESP_HEADER_TTL             = "ttl"
+	RESP_HEADER_ETAG            = "ETag"
+	RESP_HEADER_CURSOR          = "cursor"
+	RESP_HEADER_ALIASES         = "aliases"
+	RESP_HEADER_RETRY_AFTER     = "Retry-After"
 )
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Headers of a signed request, used when AUTH_MODE is hmac or both
+const (
+	HEADER_SIGN_KEY   = "x-relkv-key"   // the name of the token used to sign, secret for SECRET
+	HEADER_SIGN_TS    = "x-relkv-ts"    // unix seconds
+	HEADER_SIGN_NONCE = "x-relkv-nonce" // unique per request
+	HEADER_SIGN_SIG   = "x-relkv-sig"   // hex of the HMAC-SHA256
+)
+
+// SIGN_SECRET_KEY - the key name for requests signed with SECRET
+const SIGN_SECRET_KEY = "secret"
+
+// CanonicalRequest - the string that is signed, one value per line:
+//
+//	method
+//	path and query as sent
+//	timestamp
+//	nonce
+//	hex sha256 of the body
+func CanonicalRequest(method string, uri string, ts int64, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		uri,
+		strconv.FormatInt(ts, 10),
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// SignRequest - the hex HMAC-SHA256 of the canonical request with the token
+func SignRequest(token string, method string, uri string, ts int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(CanonicalRequest(method, uri, ts, nonce, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}